@@ -0,0 +1,120 @@
+package azure_client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+const (
+	ARM_BASE_URI = "https://management.azure.com"
+)
+
+// ArmClient sends requests to Azure Resource Manager for the resource types
+// and api-versions which the vendored SDK does not cover.
+type ArmClient struct {
+	autorest.Client
+	BaseUri        string
+	SubscriptionId string
+}
+
+// ServiceError is the error body returned by Azure Resource Manager.
+type ServiceError struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	// The Retry-After header of a throttled request
+	RetryAfter string `json:"-"`
+}
+
+func (e ServiceError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func NewArmClient(subscriptionId string) ArmClient {
+	return NewArmClientWithBaseUri(ARM_BASE_URI, subscriptionId)
+}
+
+func NewArmClientWithBaseUri(baseUri string, subscriptionId string) ArmClient {
+	return ArmClient{
+		Client:         autorest.DefaultClient,
+		BaseUri:        baseUri,
+		SubscriptionId: subscriptionId,
+	}
+}
+
+// Send issues a request against the ARM path, which may reference
+// {subscriptionId} and the keys of pathParameters. The JSON response is
+// decoded into result unless the request is accepted asynchronously.
+func (client ArmClient) Send(method, path string, pathParameters, queryParameters map[string]interface{}, body, result interface{}, codes ...int) (autorest.Response, error) {
+	escaped := map[string]interface{}{
+		"subscriptionId": url.QueryEscape(client.SubscriptionId),
+	}
+	for k, v := range pathParameters {
+		escaped[k] = url.QueryEscape(fmt.Sprint(v))
+	}
+
+	decorators := []autorest.PrepareDecorator{
+		autorest.AsJSON(),
+		autorest.WithMethod(method),
+		autorest.WithBaseURL(client.BaseUri),
+		autorest.WithPath(path),
+		autorest.WithPathParameters(escaped),
+		autorest.WithQueryParameters(queryParameters),
+	}
+	if body != nil {
+		decorators = append(decorators, autorest.WithJSON(body))
+	}
+	decorators = append(decorators, client.WithAuthorization(), client.WithInspection())
+
+	req, err := autorest.Prepare(&http.Request{}, decorators...)
+	if err != nil {
+		return autorest.Response{}, autorest.NewErrorWithError(err, "azure_client.ArmClient", method, "Failure preparing request for %s", path)
+	}
+
+	resp, err := autorest.SendWithSender(client, req)
+	if err != nil {
+		return autorest.Response{Response: resp}, autorest.NewErrorWithError(err, "azure_client.ArmClient", method, "Failure sending request for %s", path)
+	}
+	defer autorest.Respond(resp, autorest.ByClosing())
+
+	if !autorest.ResponseHasStatusCode(resp, codes...) {
+		return autorest.Response{Response: resp}, newServiceError(resp)
+	}
+
+	if result != nil && resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNoContent {
+		err = autorest.Respond(resp,
+			client.ByInspecting(),
+			autorest.ByUnmarshallingJSON(result))
+		if err != nil {
+			return autorest.Response{Response: resp}, autorest.NewErrorWithError(err, "azure_client.ArmClient", method, "Failure responding to request for %s", path)
+		}
+	}
+
+	return autorest.Response{Response: resp}, nil
+}
+
+func newServiceError(resp *http.Response) error {
+	serviceError := ServiceError{
+		StatusCode: resp.StatusCode,
+		Code:       http.StatusText(resp.StatusCode),
+		RetryAfter: resp.Header.Get("Retry-After"),
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err == nil {
+		var wrapper struct {
+			Error *ServiceError `json:"error"`
+		}
+		wrapper.Error = &serviceError
+		if json.Unmarshal(body, &wrapper) != nil || serviceError.Message == "" {
+			serviceError.Message = string(body)
+		}
+	}
+
+	return serviceError
+}
@@ -4,128 +4,373 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"reflect"
 	"strings"
+	"sync"
 
 	"github.com/Azure/azure-sdk-for-go/arm/resources"
 	"github.com/Azure/azure-sdk-for-go/arm/storage"
 	storageclient "github.com/Azure/azure-sdk-for-go/storage"
 	"github.com/Azure/go-autorest/autorest"
-	"github.com/Azure/go-autorest/autorest/azure"
+
+	"github.com/bingosummer/azure_storage_service_broker/config"
+	"github.com/bingosummer/azure_storage_service_broker/model"
 )
 
 const (
-	RESOURCE_GROUP_NAME_PREFIX  = "cloud-foundry-"
-	STORAGE_ACCOUNT_NAME_PREFIX = "cf"
-	CONTAINER_NAME_PREFIX       = "cloud-foundry-"
-	LOCATION                    = "westus"
+	// Instances provisioned before container names were generated from the
+	// naming templates use this prefix and their instance ID
+	LEGACY_CONTAINER_NAME_PREFIX = "cloud-foundry-"
 )
 
 type Client interface {
-	CreateInstance(instanceId string, parameters interface{}) (string, string, error)
+	CreateInstance(instance *model.ServiceInstance, plan *model.ServicePlan) (string, string, string, error)
+	UpdateInstance(instance *model.ServiceInstance, plan *model.ServicePlan, parameters interface{}) error
+	TagInstance(instance *model.ServiceInstance, plan *model.ServicePlan) error
+	UpgradeInstance(resourceGroupName, storageAccountName, fromVersion, toVersion string) error
 	GetInstanceState(resourceGroupName, storageAccountName string) (storage.ProvisioningState, error)
 	GetAccessKeys(resourceGroupName, storageAccountName, containerName string, containerAccessType storageclient.ContainerAccessType) (string, string, string, error)
 	DeleteInstance(resourceGroupName, storageAccountName string) error
 	RegenerateAccessKeys(resourceGroupName, storageAccountName string) error
+	StorageEndpointSuffix() string
+	StorageAccountUsage(location string) (int, int, error)
+	Locations() ([]string, error)
+	BrokerStorageAccounts() ([]StorageAccount, error)
+	ListContainers(resourceGroupName, storageAccountName string, policies bool) ([]Container, error)
+	RecordBinding(resourceGroupName, storageAccountName, containerName, bindingId string) error
+	ForgetBinding(resourceGroupName, storageAccountName, containerName, bindingId string) error
+	GrantContainerAccess(resourceGroupName, storageAccountName, containerName string, containerAccessType storageclient.ContainerAccessType, bindingId, principalId string) error
+	RevokeContainerAccess(resourceGroupName, storageAccountName, containerName, bindingId string) error
+	ContainerGrants(resourceGroupName, storageAccountName string) ([]ContainerGrant, error)
+	AccountConfiguration(resourceGroupName, storageAccountName string) (*model.AccountConfiguration, error)
+	RemediateInstance(resourceGroupName, storageAccountName string, desired *model.AccountConfiguration, drift []model.Drift) error
+	ProvisionPrivateEndpoint(instance *model.ServiceInstance) (bool, error)
+	DeletePrivateEndpoint(resourceGroupName, privateEndpointName string) (bool, error)
+	FindPrivateEndpoint(instance *model.ServiceInstance) (*model.PrivateEndpoint, error)
+	AdoptResourceGroup(instance *model.ServiceInstance, dryRun bool) (bool, error)
 }
 
 type AzureClient struct {
 	ResourceManagementClient *resources.ResourceGroupsClient
 	StorageAccountsClient    *storage.StorageAccountsClient
+	ArmClient                *ArmClient
+	Namer                    *Namer
+	Environment              Environment
+
+	// The regions of the subscription, read once
+	locationsMutex sync.Mutex
+	locations      []string
+
+	// Used only when the plan does not declare its own defaults
+	defaults config.DefaultsConfig
+
+	// The broker ID and the extra tags of the operator, set on every resource
+	brokerId     string
+	operatorTags map[string]string
+
+	// Added to the IP rules of storage accounts which deny by default
+	egressIps []string
+	// Where private endpoints are placed and registered
+	privateEndpointSubnetId string
+	privateDnsZoneId        string
 }
 
-func NewClient() *AzureClient {
-	c, err := LoadAzureCredentials()
+// NewClient creates the client of the named credential profile.
+func NewClient(conf *config.Config, profile string) (*AzureClient, error) {
+	c, ok := conf.Profile(profile)
+	if !ok {
+		return nil, fmt.Errorf("credential profile %q does not exist", profile)
+	}
+
+	namer, err := NewNamer(conf.Naming)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return nil
+		return nil, err
 	}
 
-	spt, err := NewServicePrincipalTokenFromCredentials(c, azure.AzureResourceManagerScope)
+	env, err := LookupEnvironment(c)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return nil
+		return nil, err
+	}
+
+	source, err := NewTokenSource(env, c)
+	if err != nil {
+		return nil, err
 	}
+	spt := NewRefreshingToken(source)
 
-	rmc := resources.NewResourceGroupsClient(c["subscriptionID"])
+	rmc := resources.NewResourceGroupsClientWithBaseUri(env.ResourceManagerEndpoint, c.SubscriptionId)
 	rmc.Authorizer = spt
 	rmc.PollingMode = autorest.DoNotPoll
 
-	sac := storage.NewStorageAccountsClient(c["subscriptionID"])
+	sac := storage.NewStorageAccountsClientWithBaseUri(env.ResourceManagerEndpoint, c.SubscriptionId)
 	sac.Authorizer = spt
 	sac.PollingMode = autorest.DoNotPoll
 
+	arm := NewArmClientWithBaseUri(env.ResourceManagerEndpoint, c.SubscriptionId)
+	arm.Authorizer = spt
+	arm.PollingMode = autorest.DoNotPoll
+
 	return &AzureClient{
 		ResourceManagementClient: &rmc,
 		StorageAccountsClient:    &sac,
-	}
+		ArmClient:                &arm,
+		Namer:                    namer,
+		Environment:              env,
+		defaults:                 conf.Defaults,
+		brokerId:                 conf.BrokerId,
+		operatorTags:             conf.Tags,
+		egressIps:                conf.Network.EgressIps,
+		privateEndpointSubnetId:  conf.Network.PrivateEndpointSubnetId,
+		privateDnsZoneId:         conf.Network.PrivateDnsZoneId,
+	}, nil
 }
 
-func (c *AzureClient) CreateInstance(instanceId string, parameters interface{}) (string, string, error) {
-	var resourceGroupName, storageAccountName, location string
-	var accountType storage.AccountType
+func (c *AzureClient) CreateInstance(instance *model.ServiceInstance, plan *model.ServicePlan) (string, string, string, error) {
+	location := InstanceLocation(plan, instance.Parameters, c.defaults)
+	sku := c.planSku(plan)
+	accessTier := plan.Metadata.AccessTier
+
+	resourceGroupName, err := c.Namer.ResourceGroupName(instance)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	containerName, err := c.Namer.ContainerName(instance)
+	if err != nil {
+		return "", "", "", err
+	}
 
-	switch parameters.(type) {
-	case map[string]interface{}:
-		param := parameters.(map[string]interface{})
+	if param, ok := instance.Parameters.(map[string]interface{}); ok {
+		if v, ok := param["resource_group_name"].(string); ok {
+			resourceGroupName = v
+		}
 
-		if param["resource_group_name"] != nil {
-			resourceGroupName = param["resource_group_name"].(string)
-		} else {
-			resourceGroupName = RESOURCE_GROUP_NAME_PREFIX + instanceId
+		if v, ok := param["sku"].(string); ok {
+			sku = v
+		} else if v, ok := param["account_type"].(string); ok {
+			sku = v
 		}
 
-		if param["location"] != nil {
-			location = param["location"].(string)
-		} else {
-			location = LOCATION
+		if v, ok := param["access_tier"].(string); ok {
+			accessTier = v
 		}
+	}
+
+	properties, err := maintenanceProperties("", planMaintenanceVersion(plan))
+	if err != nil {
+		return "", "", "", err
+	}
+	properties.AccessTier = accessTier
+	kind := c.planKind(plan)
+
+	security, err := InstanceSecurity(&plan.Metadata, instance.Parameters)
+	if err != nil {
+		return "", "", "", err
+	}
+	security.apply(&properties)
+
+	networkRules, err := InstanceNetworkRules(instance.Parameters, c.egressIps)
+	if err != nil {
+		return "", "", "", err
+	}
 
-		if param["account_type"] != nil {
-			accountType = storage.AccountType(param["account_type"].(string))
-		} else {
-			accountType = storage.StandardLRS
+	usePrivateEndpoint, err := UsesPrivateEndpoint(plan, instance.Parameters)
+	if err != nil {
+		return "", "", "", err
+	}
+	if usePrivateEndpoint {
+		if c.privateEndpointSubnetId == "" {
+			return "", "", "", errors.New("private endpoints are not configured")
 		}
-	default:
-		resourceGroupName = RESOURCE_GROUP_NAME_PREFIX + instanceId
-		location = LOCATION
-		accountType = storage.StandardLRS
+		// Public traffic is denied until public network access is disabled
+		// once the private endpoint is ready
+		if networkRules == nil {
+			networkRules = &model.NetworkRules{DefaultAction: NETWORK_ACTION_DENY}
+		}
+	}
+	if networkRules != nil {
+		properties.NetworkRuleSet = networkRuleSet(networkRules)
 	}
 
-	err := c.createResourceGroup(resourceGroupName, location)
+	userTags, err := UserTags(instance.Parameters, c.operatorTags)
+	if err != nil {
+		return "", "", "", err
+	}
+	tags := c.instanceTags(instance, plan, userTags)
+
+	unlock := c.lockResourceGroup(resourceGroupName)
+	defer unlock()
+
+	err = c.ensureResourceGroup(resourceGroupName, location, c.resourceGroupTags(instance, tags))
 	if err != nil {
 		fmt.Printf("Creating resource group %s failed with error:\n%v\n", resourceGroupName, err)
-		return "", "", err
+		return "", "", "", err
 	}
 
-	storageAccountName = STORAGE_ACCOUNT_NAME_PREFIX + strings.Replace(instanceId, "-", "", -1)[0:22]
-	err = c.createStorageAccount(resourceGroupName, storageAccountName, location, accountType)
+	var storageAccountName string
+	for attempt := 0; ; attempt++ {
+		storageAccountName, err = c.Namer.StorageAccountName(instance, attempt)
+		if err != nil {
+			return "", "", "", err
+		}
+
+		err = c.createStorageAccount(resourceGroupName, storageAccountName, StorageAccount{
+			Location:   location,
+			Kind:       kind,
+			Sku:        &Sku{Name: sku},
+			Tags:       tags,
+			Properties: properties,
+		})
+		if e, ok := err.(NameUnavailableError); ok && e.Reason == storage.AlreadyExists && attempt+1 < MAX_NAME_ATTEMPTS {
+			fmt.Printf("Storage account name %s is taken, retrying with a new suffix\n", storageAccountName)
+			continue
+		}
+		break
+	}
 	if err != nil {
 		fmt.Printf("Creating storage account %s.%s failed with error:\n%v\n", resourceGroupName, storageAccountName, err)
-		return "", "", err
+		return "", "", "", err
 	}
 
-	return resourceGroupName, storageAccountName, nil
+	instance.Configuration = accountConfiguration(&Sku{Name: sku}, kind, properties)
+	instance.NetworkRules = networkRules
+	if usePrivateEndpoint {
+		instance.PrivateEndpoint = &model.PrivateEndpoint{Name: storageAccountName + "-" + BLOB_GROUP_ID}
+	}
+	return resourceGroupName, storageAccountName, containerName, nil
+}
+
+// UpdateInstance applies the plan and parameters to the storage account of
+// the instance. The parameters are merged over those the instance was
+// provisioned and updated with, as far as the plan allows them, so earlier
+// overrides are kept; the defaults of the plan only apply when the plan
+// changes. Only settings which differ from the desired configuration of the
+// instance are sent, and the account is only tagged anew when the plan or
+// the tags change, so an update which changes nothing leaves Azure alone.
+// The desired configuration of the instance takes on the new settings.
+func (c *AzureClient) UpdateInstance(instance *model.ServiceInstance, plan *model.ServicePlan, parameters interface{}) error {
+	resourceGroupName, storageAccountName := instance.ResourceGroupName, instance.StorageAccountName
+	planChanged := plan.Id != instance.PlanId
+	request, _ := parameters.(map[string]interface{})
+	param := updateParameters(instance.Parameters, plan, request)
+
+	var sku, kind, accessTier string
+	var defaults *model.ServicePlanMetadata
+	if planChanged {
+		sku, kind, accessTier = c.planSku(plan), c.planKind(plan), plan.Metadata.AccessTier
+		defaults = &plan.Metadata
+	}
+	if v, ok := param["sku"].(string); ok {
+		sku = v
+	} else if v, ok := param["account_type"].(string); ok {
+		sku = v
+	}
+	if v, ok := param["access_tier"].(string); ok {
+		accessTier = v
+	}
+
+	security, err := InstanceSecurity(defaults, param)
+	if err != nil {
+		return err
+	}
+	properties := StorageAccountProperties{AccessTier: accessTier}
+	security.apply(&properties)
+
+	desired := instance.Configuration
+	if desired == nil {
+		desired = &model.AccountConfiguration{}
+	}
+	wanted := accountConfiguration(&Sku{Name: sku}, kind, properties)
+	up := driftUpdate(wanted, wanted.Diff(desired))
+
+	networkRules, err := InstanceNetworkRules(param, c.egressIps)
+	if err != nil {
+		return err
+	}
+	if networkRules != nil && !reflect.DeepEqual(networkRules, instance.NetworkRules) {
+		up.Properties.NetworkRuleSet = networkRuleSet(networkRules)
+	}
+
+	if _, ok := request[TAGS_PARAMETER]; ok || planChanged {
+		userTags, err := UserTags(param, c.operatorTags)
+		if err != nil {
+			return err
+		}
+		up.Tags = c.instanceTags(instance, plan, userTags)
+	}
+
+	if reflect.DeepEqual(up, StorageAccountUpdateParameters{}) {
+		fmt.Printf("Updating of %s.%s to plan %s changes nothing\n", resourceGroupName, storageAccountName, plan.Name)
+		return nil
+	}
+
+	err = c.ArmClient.UpdateStorageAccount(resourceGroupName, storageAccountName, up)
+	if err != nil {
+		fmt.Printf("Updating %s.%s to plan %s failed with error:\n%v\n", resourceGroupName, storageAccountName, plan.Name, err)
+		return err
+	}
+
+	fmt.Printf("Updating of %s.%s to plan %s succeeded\n", resourceGroupName, storageAccountName, plan.Name)
+	instance.Configuration = mergeConfiguration(instance.Configuration, accountConfiguration(up.Sku, up.Kind, up.Properties))
+	if up.Properties.NetworkRuleSet != nil {
+		instance.NetworkRules = networkRules
+	}
+	return nil
+}
+
+// updateParameters returns the parameters of an update: those the instance
+// has, as far as the plan allows them, with those of the request on top.
+func updateParameters(stored interface{}, plan *model.ServicePlan, request map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	if param, ok := stored.(map[string]interface{}); ok {
+		for name, value := range param {
+			if plan.AllowsParameter(name) {
+				merged[name] = value
+			}
+		}
+	}
+	for name, value := range request {
+		merged[name] = value
+	}
+	return merged
+}
+
+// UpgradeInstance applies the maintenance steps between the instance's
+// maintenance_info version and the version of its plan.
+func (c *AzureClient) UpgradeInstance(resourceGroupName, storageAccountName, fromVersion, toVersion string) error {
+	properties, err := maintenanceProperties(fromVersion, toVersion)
+	if err != nil {
+		return err
+	}
+
+	err = c.ArmClient.UpdateStorageAccount(resourceGroupName, storageAccountName, StorageAccountUpdateParameters{Properties: properties})
+	if err != nil {
+		fmt.Printf("Upgrading %s.%s from maintenance version %q to %q failed with error:\n%v\n", resourceGroupName, storageAccountName, fromVersion, toVersion, err)
+		return err
+	}
+
+	fmt.Printf("Upgrading of %s.%s to maintenance version %s succeeded\n", resourceGroupName, storageAccountName, toVersion)
+	return nil
 }
 
 func (c *AzureClient) GetInstanceState(resourceGroupName, storageAccountName string) (storage.ProvisioningState, error) {
 	sa, err := c.StorageAccountsClient.GetProperties(resourceGroupName, storageAccountName)
 	if err != nil {
 		fmt.Printf("Getting instance state failed with error:\n%v\n", err)
-		return "", err
+		return "", wrapResponseError(sa.Response, err)
 	}
 
 	return sa.Properties.ProvisioningState, nil
 }
 
-func (c *AzureClient) GetAccessKeys(instanceId, resourceGroupName, storageAccountName string, containerAccessType storageclient.ContainerAccessType) (string, string, string, error) {
+func (c *AzureClient) GetAccessKeys(resourceGroupName, storageAccountName, containerName string, containerAccessType storageclient.ContainerAccessType) (string, string, string, error) {
 	keys, err1 := c.StorageAccountsClient.ListKeys(resourceGroupName, storageAccountName)
 	if err1 != nil {
 		fmt.Printf("Getting access keys of %s.%s failed with error:\n%v\n", resourceGroupName, storageAccountName, err1)
-		return "", "", "", err1
+		return "", "", "", wrapResponseError(keys.Response, err1)
 	}
 
-	containerName := CONTAINER_NAME_PREFIX + instanceId
-	err2 := c.createContainer(storageAccountName, keys.Key1, containerName, containerAccessType)
+	err2 := c.createContainer(resourceGroupName, storageAccountName, containerName, containerAccessType)
 	if err2 != nil {
 		fmt.Printf("Creating storage container %s.%s.%s failed with error:\n%v\n", resourceGroupName, storageAccountName, containerName, err2)
 		return "", "", "", err2
@@ -134,100 +379,161 @@ func (c *AzureClient) GetAccessKeys(instanceId, resourceGroupName, storageAccoun
 	return keys.Key1, keys.Key2, containerName, nil
 }
 
+// DeleteInstance deletes the storage account, then its resource group once
+// the group is empty. A group which cannot be deleted is left behind rather
+// than failing the deprovisioning.
 func (c *AzureClient) DeleteInstance(resourceGroupName, storageAccountName string) error {
+	unlock := c.lockResourceGroup(resourceGroupName)
+	defer unlock()
+
 	r, err := c.StorageAccountsClient.Delete(resourceGroupName, storageAccountName)
 	if err != nil {
 		fmt.Printf("Deleting of %s.%s failed with status %s\n...%v\n", resourceGroupName, storageAccountName, r.Status, err)
-		return err
+		if r.Response == nil || r.StatusCode != http.StatusNotFound {
+			return wrapResponseError(r, err)
+		}
+	} else {
+		fmt.Printf("Deleting of %s.%s succeeded\n", resourceGroupName, storageAccountName)
 	}
-	fmt.Printf("Deleting of %s.%s succeeded\n", resourceGroupName, storageAccountName)
-	return nil
+
+	// A storage account which is already gone may have left its group behind
+	groupErr := c.deleteResourceGroupIfEmpty(resourceGroupName)
+	if groupErr != nil {
+		fmt.Printf("WARNING: deleting resource group %s failed with error:\n%v\n", resourceGroupName, groupErr)
+	}
+	return wrapResponseError(r, err)
 }
 
 func (c *AzureClient) RegenerateAccessKeys(resourceGroupName, storageAccountName string) error {
-	_, err := c.StorageAccountsClient.RegenerateKey(resourceGroupName, storageAccountName,
+	keys, err := c.StorageAccountsClient.RegenerateKey(resourceGroupName, storageAccountName,
 		storage.StorageAccountRegenerateKeyParameters{
 			KeyName: storage.Key1})
 	if err != nil {
 		fmt.Printf("Regenerating primary access key of %s.%s failed with error:\n%v\n", resourceGroupName, storageAccountName, err)
-		return err
+		return wrapResponseError(keys.Response, err)
 	}
 
-	_, err = c.StorageAccountsClient.RegenerateKey(resourceGroupName, storageAccountName,
+	keys, err = c.StorageAccountsClient.RegenerateKey(resourceGroupName, storageAccountName,
 		storage.StorageAccountRegenerateKeyParameters{
 			KeyName: storage.Key2})
 	if err != nil {
 		fmt.Printf("Regenerating secondary access key of %s.%s failed with error:\n%v\n", resourceGroupName, storageAccountName, err)
-		return err
+		return wrapResponseError(keys.Response, err)
 	}
 
 	return nil
 }
 
-func (c *AzureClient) createResourceGroup(resourceGroupName, location string) error {
-	rg := resources.ResourceGroup{}
-	rg.Location = location
+// StorageEndpointSuffix returns the DNS suffix of the storage accounts in the
+// client's environment.
+func (c *AzureClient) StorageEndpointSuffix() string {
+	return c.Environment.StorageEndpointSuffix
+}
 
-	resourceGroup, err := c.ResourceManagementClient.CreateOrUpdate(resourceGroupName, rg)
+// BrokerStorageAccounts returns the storage accounts of the subscription
+// which this broker tagged with an instance ID.
+func (c *AzureClient) BrokerStorageAccounts() ([]StorageAccount, error) {
+	accounts, err := c.ArmClient.ListStorageAccounts()
 	if err != nil {
-		statusCode := resourceGroup.Response.StatusCode
-		if statusCode != http.StatusAccepted && statusCode != http.StatusCreated {
-			fmt.Printf("Creating resource group %s failed\n", resourceGroupName)
-			return err
+		fmt.Printf("Listing the storage accounts of subscription %s failed with error:\n%v\n", c.ArmClient.SubscriptionId, err)
+		return nil, err
+	}
+
+	var tagged []StorageAccount
+	for _, account := range accounts {
+		if account.Tags["broker_id"] == c.brokerId && account.Tags["instance_id"] != "" {
+			tagged = append(tagged, account)
 		}
 	}
+	return tagged, nil
+}
 
-	fmt.Printf("Creation initiated %s\n", resourceGroupName)
-	return nil
+// ResourceGroupOf returns the resource group in the ID of an Azure resource.
+func ResourceGroupOf(resourceId string) string {
+	parts := strings.Split(resourceId, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if strings.EqualFold(parts[i], "resourceGroups") {
+			return parts[i+1]
+		}
+	}
+	return ""
 }
 
-func (c *AzureClient) createStorageAccount(resourceGroupName, storageAccountName, location string, accountType storage.AccountType) error {
+func (c *AzureClient) createStorageAccount(resourceGroupName, storageAccountName string, cp StorageAccount) error {
 	cna, err := c.StorageAccountsClient.CheckNameAvailability(
 		storage.StorageAccountCheckNameAvailabilityParameters{
 			Name: storageAccountName,
 			Type: "Microsoft.Storage/storageAccounts"})
 	if err != nil {
 		fmt.Printf("Error: %v", err)
-		return err
+		return wrapResponseError(cna.Response, err)
 	}
 	if !cna.NameAvailable {
 		fmt.Printf("%s is unavailable -- try again\n", storageAccountName)
-		return errors.New(storageAccountName + " is unavailable")
+		return NameUnavailableError{Name: storageAccountName, Reason: cna.Reason, Message: cna.Message}
 	}
 	fmt.Printf("Storage account name %s is available\n", storageAccountName)
 
-	cp := storage.StorageAccountCreateParameters{}
-	cp.Location = location
-	cp.Properties.AccountType = accountType
-
-	sa, err := c.StorageAccountsClient.Create(resourceGroupName, storageAccountName, cp)
-	if err != nil {
-		if sa.Response.StatusCode != http.StatusAccepted {
-			fmt.Printf("Creation of %s.%s failed", resourceGroupName, storageAccountName)
-			return err
-		}
+	if err := c.ArmClient.CreateStorageAccount(resourceGroupName, storageAccountName, cp); err != nil {
+		fmt.Printf("Creation of %s.%s failed\n", resourceGroupName, storageAccountName)
+		return err
 	}
 
 	fmt.Printf("Creation initiated %s.%s\n", resourceGroupName, storageAccountName)
 	return nil
 }
 
-func (c *AzureClient) createContainer(storageAccountName, primaryAccessKey, containerName string, containerAccessType storageclient.ContainerAccessType) error {
-	storageClient, err1 := storageclient.NewBasicClient(storageAccountName, primaryAccessKey)
-	if err1 != nil {
-		fmt.Println("Creating storage client failed")
-		return err1
+// InstanceLocation returns the region an instance is provisioned in: the
+// location parameter, then the plan's default location, then the configured
+// default.
+func InstanceLocation(plan *model.ServicePlan, parameters interface{}, defaults config.DefaultsConfig) string {
+	if param, ok := parameters.(map[string]interface{}); ok {
+		if v, ok := param["location"].(string); ok && v != "" {
+			return config.NormalizeLocation(v)
+		}
+	}
+	if plan.Metadata.Location != "" {
+		return config.NormalizeLocation(plan.Metadata.Location)
 	}
+	return config.NormalizeLocation(defaults.Location)
+}
 
-	blobStorageClient := storageClient.GetBlobService()
-	ok, err2 := blobStorageClient.CreateContainerIfNotExists(containerName, containerAccessType)
-	if err2 != nil {
-		fmt.Println("Creating storage container failed")
-		return err2
+func (c *AzureClient) planSku(plan *model.ServicePlan) string {
+	if plan.Metadata.Sku != "" {
+		return plan.Metadata.Sku
 	}
-	if !ok {
-		fmt.Println("Storage container already existed")
+	return c.defaults.Sku
+}
+
+func (c *AzureClient) planKind(plan *model.ServicePlan) string {
+	if plan.Metadata.Kind != "" {
+		return plan.Metadata.Kind
 	}
+	return c.defaults.Kind
+}
 
-	return nil
+// platformTags identifies where on the platform the instance lives, by the
+// GUIDs and, when the platform sent them, the names of its organization and
+// space.
+func platformTags(instance *model.ServiceInstance) map[string]string {
+	tags := map[string]string{"platform": instance.Platform()}
+
+	add := func(name, value string) {
+		if value != "" {
+			tags[name] = value
+		}
+	}
+	if instance.Platform() == model.PLATFORM_KUBERNETES {
+		add("namespace", instance.Context.Namespace)
+		add("cluster_id", instance.Context.ClusterId)
+	} else {
+		add("organization_guid", instance.OrganizationGuid)
+		add("space_guid", instance.SpaceGuid)
+		if instance.Context != nil {
+			add("organization_name", instance.Context.OrganizationName)
+			add("space_name", instance.Context.SpaceName)
+		}
+	}
+
+	return tags
 }
@@ -0,0 +1,128 @@
+package azure_client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/bingosummer/azure_storage_service_broker/config"
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+const instanceId = "2eac2d52-bfc9-4d0f-af28-c02187689d72"
+
+func TestPlatformTags(t *testing.T) {
+	for i, test := range []struct {
+		instance *model.ServiceInstance
+		expected map[string]string
+	}{
+		{
+			&model.ServiceInstance{OrganizationGuid: "org-guid", SpaceGuid: "space-guid"},
+			map[string]string{"platform": "cloudfoundry", "organization_guid": "org-guid", "space_guid": "space-guid"},
+		},
+		{
+			&model.ServiceInstance{OrganizationGuid: "org-guid", SpaceGuid: "space-guid", Context: &model.Context{OrganizationName: "finance", SpaceName: "dev"}},
+			map[string]string{"platform": "cloudfoundry", "organization_guid": "org-guid", "organization_name": "finance", "space_guid": "space-guid", "space_name": "dev"},
+		},
+		{
+			&model.ServiceInstance{Context: &model.Context{Platform: model.PLATFORM_KUBERNETES, Namespace: "default", ClusterId: "cluster-id"}},
+			map[string]string{"platform": "kubernetes", "namespace": "default", "cluster_id": "cluster-id"},
+		},
+		{
+			&model.ServiceInstance{Context: &model.Context{Platform: model.PLATFORM_KUBERNETES, Namespace: "default"}},
+			map[string]string{"platform": "kubernetes", "namespace": "default"},
+		},
+	} {
+		tags := platformTags(test.instance)
+		if !reflect.DeepEqual(tags, test.expected) {
+			t.Errorf("Test %d: tags were %v but expected %v\n", i, tags, test.expected)
+		}
+	}
+}
+
+func TestResourceGroupTags(t *testing.T) {
+	instance := &model.ServiceInstance{OrganizationGuid: "org-guid", SpaceGuid: "space-guid", Context: &model.Context{OrganizationName: "finance", SpaceName: "dev"}}
+	instanceTags := map[string]string{"instance_id": instanceId}
+
+	for i, test := range []struct {
+		strategy string
+		expected map[string]string
+	}{
+		{config.RESOURCE_GROUP_PER_INSTANCE, instanceTags},
+		{config.RESOURCE_GROUP_PER_SPACE, map[string]string{"broker_id": "broker", "cost_center": "42", "platform": "cloudfoundry", "organization_guid": "org-guid", "organization_name": "finance", "space_guid": "space-guid", "space_name": "dev"}},
+		{config.RESOURCE_GROUP_PER_ORG, map[string]string{"broker_id": "broker", "cost_center": "42", "platform": "cloudfoundry", "organization_guid": "org-guid", "organization_name": "finance"}},
+		{config.RESOURCE_GROUP_FIXED, map[string]string{"broker_id": "broker", "cost_center": "42"}},
+	} {
+		c := &AzureClient{
+			Namer:        &Namer{templates: config.NamingConfig{ResourceGroupStrategy: test.strategy}},
+			brokerId:     "broker",
+			operatorTags: map[string]string{"cost_center": "42"},
+		}
+		tags := c.resourceGroupTags(instance, instanceTags)
+		if !reflect.DeepEqual(tags, test.expected) {
+			t.Errorf("Test %d: tags were %v but expected %v\n", i, tags, test.expected)
+		}
+	}
+}
+
+func TestUpdateInstanceKeepsOverrides(t *testing.T) {
+	var patches []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var patch map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&patch)
+		patches = append(patches, patch)
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	arm := NewArmClientWithBaseUri(server.URL, "sub")
+	c := &AzureClient{ArmClient: &arm, brokerId: "broker"}
+	hot := model.ServicePlan{Id: "hot", Name: "hot", Metadata: model.ServicePlanMetadata{Sku: "Standard_LRS", AccessTier: "Hot"}}
+	cool := model.ServicePlan{Id: "cool", Name: "cool", Metadata: model.ServicePlanMetadata{Sku: "Standard_LRS", AccessTier: "Cool", AllowedParameters: []string{"tags"}}}
+
+	for i, test := range []struct {
+		plan       model.ServicePlan
+		parameters interface{}
+		patch      bool
+		accessTier string
+	}{
+		// Nothing changes
+		{hot, map[string]interface{}{}, false, "Cool"},
+		{hot, nil, false, "Cool"},
+		// Only the tags change, the access tier stays Cool
+		{hot, map[string]interface{}{"tags": map[string]interface{}{"team": "storage"}}, true, "Cool"},
+		{hot, map[string]interface{}{"access_tier": "Hot"}, true, "Hot"},
+		// The new plan does not allow the override
+		{cool, map[string]interface{}{}, true, "Cool"},
+	} {
+		patches = nil
+		instance := &model.ServiceInstance{
+			Id:                 instanceId,
+			PlanId:             "hot",
+			ResourceGroupName:  "rg",
+			StorageAccountName: "account",
+			Parameters:         map[string]interface{}{"access_tier": "Cool"},
+			Configuration:      &model.AccountConfiguration{Sku: "Standard_LRS", AccessTier: "Cool"},
+		}
+		plan := test.plan
+		err := c.UpdateInstance(instance, &plan, test.parameters)
+		if err != nil {
+			t.Errorf("Test %d: UpdateInstance failed: %v\n", i, err)
+			continue
+		}
+		if test.patch != (len(patches) == 1) {
+			t.Errorf("Test %d: expected a PATCH: %v, got %v\n", i, test.patch, patches)
+		}
+		if instance.Configuration.AccessTier != test.accessTier {
+			t.Errorf("Test %d: expected access tier %s, got %s\n", i, test.accessTier, instance.Configuration.AccessTier)
+		}
+		for _, patch := range patches {
+			properties, _ := patch["properties"].(map[string]interface{})
+			if tier, ok := properties["accessTier"]; ok && tier != test.accessTier {
+				t.Errorf("Test %d: the PATCH set access tier %v\n", i, tier)
+			}
+		}
+	}
+}
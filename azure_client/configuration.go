@@ -0,0 +1,130 @@
+package azure_client
+
+import (
+	"fmt"
+
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+// accountConfiguration describes the settings the broker sends when it
+// creates or updates a storage account.
+func accountConfiguration(sku *Sku, kind string, properties StorageAccountProperties) *model.AccountConfiguration {
+	configuration := &model.AccountConfiguration{
+		Kind:              kind,
+		AccessTier:        properties.AccessTier,
+		HttpsOnly:         properties.EnableHttpsTrafficOnly,
+		MinimumTlsVersion: properties.MinimumTlsVersion,
+
+		AllowBlobPublicAccess: properties.AllowBlobPublicAccess,
+		AllowSharedKeyAccess:  properties.AllowSharedKeyAccess,
+
+		NetworkRules: networkRulesOf(properties.NetworkRuleSet),
+	}
+	if sku != nil {
+		configuration.Sku = sku.Name
+	}
+	return configuration
+}
+
+// ConfigurationOf returns the configuration of a listed storage account.
+func ConfigurationOf(account StorageAccount) *model.AccountConfiguration {
+	return accountConfiguration(account.Sku, account.Kind, account.Properties)
+}
+
+// mergeConfiguration returns the desired configuration with the settings of
+// an update applied.
+func mergeConfiguration(desired, update *model.AccountConfiguration) *model.AccountConfiguration {
+	var merged model.AccountConfiguration
+	if desired != nil {
+		merged = *desired
+	}
+
+	for _, setting := range []struct {
+		target *string
+		value  string
+	}{
+		{&merged.Sku, update.Sku},
+		{&merged.Kind, update.Kind},
+		{&merged.AccessTier, update.AccessTier},
+		{&merged.MinimumTlsVersion, update.MinimumTlsVersion},
+	} {
+		if setting.value != "" {
+			*setting.target = setting.value
+		}
+	}
+	for _, setting := range []struct {
+		target **bool
+		value  *bool
+	}{
+		{&merged.HttpsOnly, update.HttpsOnly},
+		{&merged.AllowBlobPublicAccess, update.AllowBlobPublicAccess},
+		{&merged.AllowSharedKeyAccess, update.AllowSharedKeyAccess},
+	} {
+		if setting.value != nil {
+			*setting.target = setting.value
+		}
+	}
+	if update.NetworkRules != nil {
+		merged.NetworkRules = update.NetworkRules
+	}
+	return &merged
+}
+
+// UpgradeConfiguration returns the desired configuration of an instance
+// after the maintenance steps between the two versions.
+func UpgradeConfiguration(desired *model.AccountConfiguration, fromVersion, toVersion string) (*model.AccountConfiguration, error) {
+	properties, err := maintenanceProperties(fromVersion, toVersion)
+	if err != nil {
+		return nil, err
+	}
+	return mergeConfiguration(desired, accountConfiguration(nil, "", properties)), nil
+}
+
+// AccountConfiguration reads the live configuration of the storage account.
+func (c *AzureClient) AccountConfiguration(resourceGroupName, storageAccountName string) (*model.AccountConfiguration, error) {
+	account, err := c.ArmClient.GetStorageAccount(resourceGroupName, storageAccountName)
+	if err != nil {
+		return nil, err
+	}
+	return accountConfiguration(account.Sku, account.Kind, account.Properties), nil
+}
+
+// RemediateInstance resets the drifted settings of the storage account to
+// their desired values.
+func (c *AzureClient) RemediateInstance(resourceGroupName, storageAccountName string, desired *model.AccountConfiguration, drift []model.Drift) error {
+	err := c.ArmClient.UpdateStorageAccount(resourceGroupName, storageAccountName, driftUpdate(desired, drift))
+	if err != nil {
+		fmt.Printf("Remediating the drift of %s.%s failed with error:\n%v\n", resourceGroupName, storageAccountName, err)
+		return err
+	}
+
+	fmt.Printf("Remediated the drift of %s.%s: %v\n", resourceGroupName, storageAccountName, drift)
+	return nil
+}
+
+// driftUpdate returns the update which sets the drifted settings to their
+// desired values, and leaves the others alone.
+func driftUpdate(desired *model.AccountConfiguration, drift []model.Drift) StorageAccountUpdateParameters {
+	var up StorageAccountUpdateParameters
+	for _, d := range drift {
+		switch d.Setting {
+		case "sku":
+			up.Sku = &Sku{Name: desired.Sku}
+		case "kind":
+			up.Kind = desired.Kind
+		case "access_tier":
+			up.Properties.AccessTier = desired.AccessTier
+		case "https_only":
+			up.Properties.EnableHttpsTrafficOnly = desired.HttpsOnly
+		case "minimum_tls_version":
+			up.Properties.MinimumTlsVersion = desired.MinimumTlsVersion
+		case "allow_blob_public_access":
+			up.Properties.AllowBlobPublicAccess = desired.AllowBlobPublicAccess
+		case "allow_shared_key_access":
+			up.Properties.AllowSharedKeyAccess = desired.AllowSharedKeyAccess
+		case "network_rules":
+			up.Properties.NetworkRuleSet = networkRuleSet(desired.NetworkRules)
+		}
+	}
+	return up
+}
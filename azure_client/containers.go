@@ -0,0 +1,400 @@
+package azure_client
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	storageclient "github.com/Azure/azure-sdk-for-go/storage"
+)
+
+const (
+	CONTAINER_PATH = STORAGE_ACCOUNT_PATH + "/blobServices/default/containers/{containerName}"
+
+	// The blob service version of the container access policy requests, which
+	// the vendored storage client does not cover
+	BLOB_API_VERSION = "2019-02-02"
+
+	// Azure allows five stored access policies per container
+	MAX_CONTAINER_POLICIES = 5
+
+	// How long a request to the blob service may take
+	BLOB_REQUEST_TIMEOUT = 30 * time.Second
+)
+
+// blobHttpClient sends the requests of all blob clients.
+var blobHttpClient = &http.Client{Timeout: BLOB_REQUEST_TIMEOUT}
+
+// containerAclLocks serializes the read-modify-write of a container ACL, in
+// which concurrent bindings would drop each other's access policies.
+var containerAclLocks = newKeyedLocks()
+
+// Container is a blob container with the IDs of its stored access policies.
+// The broker adds a policy named after each binding of the instance, so that
+// bindings can be recovered from Azure.
+type Container struct {
+	Name       string
+	AccessType storageclient.ContainerAccessType
+	Policies   []string
+}
+
+type blobContainer struct {
+	Name       string                  `json:"name,omitempty"`
+	Properties blobContainerProperties `json:"properties"`
+}
+
+type blobContainerList struct {
+	Value    []blobContainer `json:"value"`
+	NextLink string          `json:"nextLink"`
+}
+
+type blobContainerProperties struct {
+	PublicAccess string `json:"publicAccess"`
+}
+
+// CreateBlobContainer creates the container through the resource manager,
+// which works when shared key access to the account is disabled. It returns
+// false if the container already existed.
+func (client ArmClient) CreateBlobContainer(resourceGroupName, accountName, containerName string, accessType storageclient.ContainerAccessType) (bool, error) {
+	publicAccess := "None"
+	switch accessType {
+	case storageclient.ContainerAccessTypeBlob:
+		publicAccess = "Blob"
+	case storageclient.ContainerAccessTypeContainer:
+		publicAccess = "Container"
+	}
+
+	pathParameters := storageAccountPathParameters(resourceGroupName, accountName)
+	pathParameters["containerName"] = containerName
+	_, err := client.Send("PUT", CONTAINER_PATH, pathParameters, storageQueryParameters(),
+		blobContainer{Properties: blobContainerProperties{PublicAccess: publicAccess}}, nil,
+		http.StatusOK, http.StatusCreated)
+	if e, ok := err.(ServiceError); ok && e.StatusCode == http.StatusConflict {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ListBlobContainers returns the containers of the account through the
+// resource manager, which works when shared key access to the account is
+// disabled.
+func (client ArmClient) ListBlobContainers(resourceGroupName, accountName string) ([]blobContainer, error) {
+	var containers []blobContainer
+	path, pathParameters, query := STORAGE_ACCOUNT_PATH+"/blobServices/default/containers", storageAccountPathParameters(resourceGroupName, accountName), storageQueryParameters()
+	for {
+		var list blobContainerList
+		_, err := client.Send("GET", path, pathParameters, query, nil, &list, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+		containers = append(containers, list.Value...)
+
+		if list.NextLink == "" {
+			return containers, nil
+		}
+		path, query, err = nextPage(list.NextLink)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// containerAccessType returns the public access level of a container as the
+// blob service names it.
+func containerAccessType(publicAccess string) storageclient.ContainerAccessType {
+	switch publicAccess {
+	case "Blob":
+		return storageclient.ContainerAccessTypeBlob
+	case "Container":
+		return storageclient.ContainerAccessTypeContainer
+	}
+	return storageclient.ContainerAccessTypePrivate
+}
+
+type signedIdentifiers struct {
+	XMLName     xml.Name           `xml:"SignedIdentifiers"`
+	Identifiers []signedIdentifier `xml:"SignedIdentifier"`
+}
+
+type signedIdentifier struct {
+	Id           string       `xml:"Id"`
+	AccessPolicy accessPolicy `xml:"AccessPolicy"`
+}
+
+type accessPolicy struct {
+	Start      string `xml:"Start,omitempty"`
+	Expiry     string `xml:"Expiry,omitempty"`
+	Permission string `xml:"Permission,omitempty"`
+}
+
+// blobClient sends requests to the blob service of a storage account, signed
+// with the account key.
+type blobClient struct {
+	account string
+	key     []byte
+	baseUrl string
+	now     func() time.Time
+}
+
+func newBlobClient(account, key, baseUrl string) (*blobClient, error) {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("the key of storage account %s is not base64: %v", account, err)
+	}
+	return &blobClient{account: account, key: decoded, baseUrl: baseUrl, now: time.Now}, nil
+}
+
+func (b *blobClient) send(method, path string, query url.Values, headers map[string]string, body []byte) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, b.baseUrl+path+"?"+query.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("x-ms-date", b.now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", BLOB_API_VERSION)
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Authorization", "SharedKey "+b.account+":"+b.signature(req))
+
+	resp, err := blobHttpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp, respBody, fmt.Errorf("%s %s of storage account %s failed with status %d: %s", method, path, b.account, resp.StatusCode, respBody)
+	}
+	return resp, respBody, nil
+}
+
+// signature computes the Shared Key signature of blob service versions since
+// 2015-02-21.
+func (b *blobClient) signature(req *http.Request) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	var msHeaders []string
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower+":"+strings.TrimSpace(req.Header.Get(name)))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	resource := "/" + b.account + req.URL.Path
+	query := req.URL.Query()
+	var names []string
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := query[name]
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, replaced by x-ms-date
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		strings.Join(msHeaders, "\n"),
+		resource,
+	}, "\n")
+
+	mac := hmac.New(sha256.New, b.key)
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func containerAclQuery() url.Values {
+	return url.Values{"restype": {"container"}, "comp": {"acl"}}
+}
+
+// getContainerAcl returns the public access level and the stored access
+// policies of the container.
+func (b *blobClient) getContainerAcl(containerName string) (storageclient.ContainerAccessType, []signedIdentifier, error) {
+	resp, body, err := b.send("GET", "/"+containerName, containerAclQuery(), nil, nil)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var identifiers signedIdentifiers
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := xml.Unmarshal(body, &identifiers); err != nil {
+			return "", nil, fmt.Errorf("the access policies of container %s cannot be read: %v", containerName, err)
+		}
+	}
+	return storageclient.ContainerAccessType(resp.Header.Get("x-ms-blob-public-access")), identifiers.Identifiers, nil
+}
+
+// setContainerAcl replaces the stored access policies of the container. The
+// public access level is passed along, as Azure resets it otherwise.
+func (b *blobClient) setContainerAcl(containerName string, accessType storageclient.ContainerAccessType, identifiers []signedIdentifier) error {
+	body, err := xml.Marshal(signedIdentifiers{Identifiers: identifiers})
+	if err != nil {
+		return err
+	}
+
+	headers := map[string]string{"Content-Type": "application/xml"}
+	if accessType != "" {
+		headers["x-ms-blob-public-access"] = string(accessType)
+	}
+	_, _, err = b.send("PUT", "/"+containerName, containerAclQuery(), headers, append([]byte(xml.Header), body...))
+	return err
+}
+
+func (b *blobClient) lockContainer(containerName string) func() {
+	return containerAclLocks.lock(b.account + "/" + containerName)
+}
+
+// addPolicy adds an empty stored access policy to the container, unless it
+// has one with the ID already.
+func (b *blobClient) addPolicy(containerName, id string) error {
+	unlock := b.lockContainer(containerName)
+	defer unlock()
+
+	accessType, identifiers, err := b.getContainerAcl(containerName)
+	if err != nil {
+		return err
+	}
+	for _, identifier := range identifiers {
+		if identifier.Id == id {
+			return nil
+		}
+	}
+	if len(identifiers) >= MAX_CONTAINER_POLICIES {
+		return fmt.Errorf("container %s already has %d access policies, the limit of Azure", containerName, len(identifiers))
+	}
+
+	return b.setContainerAcl(containerName, accessType, append(identifiers, signedIdentifier{Id: id}))
+}
+
+// removePolicy removes the stored access policy with the ID from the
+// container.
+func (b *blobClient) removePolicy(containerName, id string) error {
+	unlock := b.lockContainer(containerName)
+	defer unlock()
+
+	accessType, identifiers, err := b.getContainerAcl(containerName)
+	if err != nil {
+		return err
+	}
+
+	var kept []signedIdentifier
+	for _, identifier := range identifiers {
+		if identifier.Id != id {
+			kept = append(kept, identifier)
+		}
+	}
+	if len(kept) == len(identifiers) {
+		return nil
+	}
+	return b.setContainerAcl(containerName, accessType, kept)
+}
+
+// RecordBinding adds a stored access policy named after the binding to the
+// container of the instance.
+func (c *AzureClient) RecordBinding(resourceGroupName, storageAccountName, containerName, bindingId string) error {
+	blob, err := c.blobClient(resourceGroupName, storageAccountName)
+	if err != nil {
+		return err
+	}
+	return blob.addPolicy(containerName, bindingId)
+}
+
+// ForgetBinding removes the stored access policy of the binding.
+func (c *AzureClient) ForgetBinding(resourceGroupName, storageAccountName, containerName, bindingId string) error {
+	blob, err := c.blobClient(resourceGroupName, storageAccountName)
+	if err != nil {
+		return err
+	}
+	return blob.removePolicy(containerName, bindingId)
+}
+
+// ListContainers returns the containers of the storage account, with their
+// stored access policies if asked for. The policies are read from the blob
+// service with the account keys, so the caller only asks for them where the
+// account allows shared key access and the broker reaches its blob service.
+func (c *AzureClient) ListContainers(resourceGroupName, storageAccountName string, policies bool) ([]Container, error) {
+	listed, err := c.ArmClient.ListBlobContainers(resourceGroupName, storageAccountName)
+	if err != nil {
+		return nil, err
+	}
+
+	var blob *blobClient
+	if policies {
+		blob, err = c.blobClient(resourceGroupName, storageAccountName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var containers []Container
+	for _, item := range listed {
+		container := Container{Name: item.Name, AccessType: containerAccessType(item.Properties.PublicAccess)}
+		if blob != nil {
+			_, identifiers, err := blob.getContainerAcl(item.Name)
+			if err != nil {
+				return nil, err
+			}
+			for _, identifier := range identifiers {
+				container.Policies = append(container.Policies, identifier.Id)
+			}
+		}
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
+
+func (c *AzureClient) blobClient(resourceGroupName, storageAccountName string) (*blobClient, error) {
+	keys, err := c.StorageAccountsClient.ListKeys(resourceGroupName, storageAccountName)
+	if err != nil {
+		return nil, wrapResponseError(keys.Response, err)
+	}
+	return newBlobClient(storageAccountName, keys.Key1, c.blobServiceUrl(storageAccountName))
+}
+
+func (c *AzureClient) blobServiceUrl(storageAccountName string) string {
+	return "https://" + storageAccountName + ".blob." + c.Environment.StorageEndpointSuffix
+}
+
+func (c *AzureClient) createContainer(resourceGroupName, storageAccountName, containerName string, containerAccessType storageclient.ContainerAccessType) error {
+	created, err := c.ArmClient.CreateBlobContainer(resourceGroupName, storageAccountName, containerName, containerAccessType)
+	if err != nil {
+		fmt.Println("Creating storage container failed")
+		return err
+	}
+	if !created {
+		fmt.Println("Storage container already existed")
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package azure_client
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// aclStandIn keeps the access policies and public access level of one
+// container like the blob service does.
+func aclStandIn(t *testing.T) *httptest.Server {
+	var acl []byte
+	var access string
+	var mutex sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey account:") || r.Header.Get("x-ms-version") != BLOB_API_VERSION || r.URL.Query().Get("comp") != "acl" {
+			t.Errorf("request %s %s was not signed for the container ACL: %v\n", r.Method, r.URL, r.Header)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if r.Method == "PUT" {
+			acl, _ = ioutil.ReadAll(r.Body)
+			access = r.Header.Get("x-ms-blob-public-access")
+			return
+		}
+		if access != "" {
+			w.Header().Set("x-ms-blob-public-access", access)
+		}
+		w.Write(acl)
+	}))
+}
+
+func TestContainerAcl(t *testing.T) {
+	server := aclStandIn(t)
+	defer server.Close()
+
+	blob, err := newBlobClient("account", base64.StdEncoding.EncodeToString([]byte("key")), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = blob.setContainerAcl("data", "blob", []signedIdentifier{{Id: "binding-1"}, {Id: "binding-2"}})
+	if err != nil {
+		t.Fatalf("setting the ACL failed with %v\n", err)
+	}
+
+	accessType, identifiers, err := blob.getContainerAcl("data")
+	if err != nil {
+		t.Fatalf("getting the ACL failed with %v\n", err)
+	}
+	if accessType != "blob" || !reflect.DeepEqual(identifiers, []signedIdentifier{{Id: "binding-1"}, {Id: "binding-2"}}) {
+		t.Errorf("ACL was %q %+v\n", accessType, identifiers)
+	}
+}
+
+func TestConcurrentPolicies(t *testing.T) {
+	server := aclStandIn(t)
+	defer server.Close()
+
+	blob, err := newBlobClient("account", base64.StdEncoding.EncodeToString([]byte("key")), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{"binding-1", "binding-2", "binding-3", "binding-4", "binding-5"}
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := blob.addPolicy("data", id); err != nil {
+				t.Errorf("adding policy %s failed with %v\n", id, err)
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	_, identifiers, err := blob.getContainerAcl("data")
+	if err != nil {
+		t.Fatalf("getting the ACL failed with %v\n", err)
+	}
+	if len(identifiers) != len(ids) {
+		t.Errorf("ACL kept %d of %d policies: %+v\n", len(identifiers), len(ids), identifiers)
+	}
+
+	for _, id := range ids[:3] {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := blob.removePolicy("data", id); err != nil {
+				t.Errorf("removing policy %s failed with %v\n", id, err)
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	_, identifiers, err = blob.getContainerAcl("data")
+	if err != nil {
+		t.Fatalf("getting the ACL failed with %v\n", err)
+	}
+	kept := map[string]bool{}
+	for _, identifier := range identifiers {
+		kept[identifier.Id] = true
+	}
+	if !reflect.DeepEqual(kept, map[string]bool{"binding-4": true, "binding-5": true}) {
+		t.Errorf("ACL was %+v after removing three policies\n", identifiers)
+	}
+}
+
+func TestBlobSignature(t *testing.T) {
+	blob, _ := newBlobClient("account", base64.StdEncoding.EncodeToString([]byte("key")), "https://account.blob.core.windows.net")
+
+	first, _ := http.NewRequest("GET", "https://account.blob.core.windows.net/data?restype=container&comp=acl", nil)
+	first.Header.Set("x-ms-date", "Mon, 01 Jan 2018 00:00:00 GMT")
+	second, _ := http.NewRequest("GET", "https://account.blob.core.windows.net/data?comp=acl&restype=container", nil)
+	second.Header.Set("X-Ms-Date", "Mon, 01 Jan 2018 00:00:00 GMT")
+	other, _ := http.NewRequest("GET", "https://account.blob.core.windows.net/logs?restype=container&comp=acl", nil)
+	other.Header.Set("x-ms-date", "Mon, 01 Jan 2018 00:00:00 GMT")
+
+	if blob.signature(first) != blob.signature(second) {
+		t.Errorf("the order of the query and the case of the headers changed the signature\n")
+	}
+	if blob.signature(first) == blob.signature(other) {
+		t.Errorf("requests for different containers have the same signature\n")
+	}
+}
@@ -0,0 +1,155 @@
+package azure_client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bingosummer/azure_storage_service_broker/config"
+)
+
+const (
+	METADATA_API_VERSION = "2015-01-01"
+	METADATA_TIMEOUT     = 30 * time.Second
+)
+
+// Environment holds the endpoints of an Azure cloud.
+type Environment struct {
+	Name string
+
+	// Without a trailing slash, like the base URIs of the SDK clients
+	ResourceManagerEndpoint string
+	// The Azure AD or AD FS instance which issues tokens
+	ActiveDirectoryEndpoint string
+	// The resource tokens for Azure Resource Manager are requested for
+	TokenAudience string
+	// The DNS suffix of storage accounts, as in <account>.blob.<suffix>
+	StorageEndpointSuffix string
+}
+
+var environments = map[string]Environment{
+	"AzurePublicCloud": {
+		Name:                    "AzurePublicCloud",
+		ResourceManagerEndpoint: "https://management.azure.com",
+		ActiveDirectoryEndpoint: "https://login.microsoftonline.com/",
+		TokenAudience:           "https://management.azure.com/",
+		StorageEndpointSuffix:   "core.windows.net",
+	},
+	"AzureChinaCloud": {
+		Name:                    "AzureChinaCloud",
+		ResourceManagerEndpoint: "https://management.chinacloudapi.cn",
+		ActiveDirectoryEndpoint: "https://login.chinacloudapi.cn/",
+		TokenAudience:           "https://management.core.chinacloudapi.cn/",
+		StorageEndpointSuffix:   "core.chinacloudapi.cn",
+	},
+	"AzureUSGovernmentCloud": {
+		Name:                    "AzureUSGovernmentCloud",
+		ResourceManagerEndpoint: "https://management.usgovcloudapi.net",
+		ActiveDirectoryEndpoint: "https://login.microsoftonline.us/",
+		TokenAudience:           "https://management.core.usgovcloudapi.net/",
+		StorageEndpointSuffix:   "core.usgovcloudapi.net",
+	},
+	"AzureGermanCloud": {
+		Name:                    "AzureGermanCloud",
+		ResourceManagerEndpoint: "https://management.microsoftazure.de",
+		ActiveDirectoryEndpoint: "https://login.microsoftonline.de/",
+		TokenAudience:           "https://management.core.cloudapi.de/",
+		StorageEndpointSuffix:   "core.cloudapi.de",
+	},
+}
+
+// LookupEnvironment returns the endpoints of the configured cloud. The
+// endpoints of Azure Stack are discovered from the metadata of its Azure
+// Resource Manager.
+func LookupEnvironment(c config.AzureConfig) (Environment, error) {
+	var env Environment
+
+	if c.Environment == config.AZURE_STACK_CLOUD {
+		var err error
+		env, err = discoverEnvironment(c.ResourceManagerEndpoint)
+		if err != nil {
+			return env, err
+		}
+	} else {
+		var ok bool
+		env, ok = environments[c.Environment]
+		if !ok {
+			return env, fmt.Errorf("unknown Azure environment %q", c.Environment)
+		}
+	}
+
+	if c.StorageEndpointSuffix != "" {
+		env.StorageEndpointSuffix = c.StorageEndpointSuffix
+	}
+	return env, nil
+}
+
+type armMetadata struct {
+	Authentication struct {
+		LoginEndpoint string   `json:"loginEndpoint"`
+		Audiences     []string `json:"audiences"`
+	} `json:"authentication"`
+}
+
+func discoverEnvironment(resourceManagerEndpoint string) (Environment, error) {
+	endpoint := strings.TrimRight(resourceManagerEndpoint, "/")
+	env := Environment{Name: config.AZURE_STACK_CLOUD, ResourceManagerEndpoint: endpoint}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return env, fmt.Errorf("Azure Stack resource manager endpoint %q is not a URL", resourceManagerEndpoint)
+	}
+
+	metadataUrl := endpoint + "/metadata/endpoints?api-version=" + METADATA_API_VERSION
+	client := http.Client{Timeout: METADATA_TIMEOUT}
+	resp, err := client.Get(metadataUrl)
+	if err != nil {
+		return env, fmt.Errorf("discovering the Azure Stack endpoints from %s failed: %v", metadataUrl, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return env, fmt.Errorf("discovering the Azure Stack endpoints from %s failed with status %s", metadataUrl, resp.Status)
+	}
+
+	var metadata armMetadata
+	err = json.NewDecoder(resp.Body).Decode(&metadata)
+	if err != nil {
+		return env, fmt.Errorf("the Azure Stack metadata at %s is invalid: %v", metadataUrl, err)
+	}
+	if metadata.Authentication.LoginEndpoint == "" || len(metadata.Authentication.Audiences) == 0 {
+		return env, fmt.Errorf("the Azure Stack metadata at %s has no login endpoint or audience", metadataUrl)
+	}
+
+	env.ActiveDirectoryEndpoint = metadata.Authentication.LoginEndpoint
+	env.TokenAudience = metadata.Authentication.Audiences[0]
+
+	env.StorageEndpointSuffix = stackStorageEndpointSuffix(u.Host)
+
+	return env, nil
+}
+
+// stackStorageEndpointSuffix derives the storage DNS suffix from the host of
+// Azure Resource Manager: management.<region>.<domain> serves storage as
+// <account>.blob.<region>.<domain>.
+func stackStorageEndpointSuffix(resourceManagerHost string) string {
+	host := strings.Split(resourceManagerHost, ":")[0]
+	if i := strings.Index(host, "."); i >= 0 {
+		return host[i+1:]
+	}
+	return host
+}
+
+// tokenEndpoint returns the OAuth token endpoint of the tenant. AD FS, which
+// Azure Stack may use, has a single tenant and its login endpoint ends with
+// /adfs.
+func (env Environment) tokenEndpoint(tenantId string) string {
+	login := strings.TrimRight(env.ActiveDirectoryEndpoint, "/")
+	if strings.HasSuffix(login, "/adfs") {
+		return login + "/oauth2/token"
+	}
+	return login + "/" + tenantId + "/oauth2/token"
+}
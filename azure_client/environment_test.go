@@ -0,0 +1,91 @@
+package azure_client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bingosummer/azure_storage_service_broker/config"
+)
+
+func TestLookupEnvironment(t *testing.T) {
+	metadata := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metadata/endpoints" || r.URL.Query().Get("api-version") != METADATA_API_VERSION {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"authentication": {"loginEndpoint": "https://adfs.local.azurestack.external/adfs/", "audiences": ["https://management.adfs.azurestack.local/1234"]}}`)
+	})
+	server := httptest.NewServer(metadata)
+	defer server.Close()
+	// The ARM host of Azure Stack is a name, management.<region>.<domain>
+	localUrl := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	for i, test := range []struct {
+		conf          config.AzureConfig
+		expected      Environment
+		tokenEndpoint string
+		fails         bool
+	}{
+		{config.AzureConfig{Environment: "AzureChinaCloud"}, environments["AzureChinaCloud"], "https://login.chinacloudapi.cn/tenant-id/oauth2/token", false},
+		{config.AzureConfig{Environment: "AzurePublicCloud", StorageEndpointSuffix: "core.example.com"}, Environment{
+			Name:                    "AzurePublicCloud",
+			ResourceManagerEndpoint: "https://management.azure.com",
+			ActiveDirectoryEndpoint: "https://login.microsoftonline.com/",
+			TokenAudience:           "https://management.azure.com/",
+			StorageEndpointSuffix:   "core.example.com",
+		}, "https://login.microsoftonline.com/tenant-id/oauth2/token", false},
+		{config.AzureConfig{Environment: config.AZURE_STACK_CLOUD, ResourceManagerEndpoint: server.URL + "/", StorageEndpointSuffix: "local.azurestack.external"}, Environment{
+			Name:                    config.AZURE_STACK_CLOUD,
+			ResourceManagerEndpoint: server.URL,
+			ActiveDirectoryEndpoint: "https://adfs.local.azurestack.external/adfs/",
+			TokenAudience:           "https://management.adfs.azurestack.local/1234",
+			StorageEndpointSuffix:   "local.azurestack.external",
+		}, "https://adfs.local.azurestack.external/adfs/oauth2/token", false},
+		// Without a configured suffix it is derived from the host of the endpoint
+		{config.AzureConfig{Environment: config.AZURE_STACK_CLOUD, ResourceManagerEndpoint: localUrl}, Environment{
+			Name:                    config.AZURE_STACK_CLOUD,
+			ResourceManagerEndpoint: localUrl,
+			ActiveDirectoryEndpoint: "https://adfs.local.azurestack.external/adfs/",
+			TokenAudience:           "https://management.adfs.azurestack.local/1234",
+			StorageEndpointSuffix:   "localhost",
+		}, "https://adfs.local.azurestack.external/adfs/oauth2/token", false},
+		{config.AzureConfig{Environment: config.AZURE_STACK_CLOUD, ResourceManagerEndpoint: server.URL + "/missing"}, Environment{}, "", true},
+		{config.AzureConfig{Environment: "AzureMoonCloud"}, Environment{}, "", true},
+	} {
+		env, err := LookupEnvironment(test.conf)
+		if test.fails {
+			if err == nil {
+				t.Errorf("Test %d: looking up %s succeeded but expected an error\n", i, test.conf.Environment)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: looking up %s failed with %v\n", i, test.conf.Environment, err)
+			continue
+		}
+		if env != test.expected {
+			t.Errorf("Test %d: environment was %+v but expected %+v\n", i, env, test.expected)
+		}
+		if e := env.tokenEndpoint("tenant-id"); e != test.tokenEndpoint {
+			t.Errorf("Test %d: token endpoint was %s but expected %s\n", i, e, test.tokenEndpoint)
+		}
+	}
+}
+
+func TestStackStorageEndpointSuffix(t *testing.T) {
+	for i, test := range []struct {
+		host     string
+		expected string
+	}{
+		{"management.local.azurestack.external", "local.azurestack.external"},
+		{"management.region.contoso.com:443", "region.contoso.com"},
+		{"localhost", "localhost"},
+	} {
+		if suffix := stackStorageEndpointSuffix(test.host); suffix != test.expected {
+			t.Errorf("Test %d: suffix of %s was %s but expected %s\n", i, test.host, suffix, test.expected)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package azure_client
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/arm/storage"
+	storageclient "github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// NameUnavailableError is returned when Azure refuses a storage account name.
+type NameUnavailableError struct {
+	Name    string
+	Reason  storage.Reason
+	Message string
+}
+
+func (e NameUnavailableError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("The storage account name %s is unavailable", e.Name)
+	}
+	return fmt.Sprintf("The storage account name %s is unavailable: %s", e.Name, e.Message)
+}
+
+// wrapResponseError attaches the HTTP status of a failed SDK call to its
+// error, because the errors of the vendored SDK carry only a message.
+func wrapResponseError(response autorest.Response, err error) error {
+	if err == nil || response.Response == nil || response.StatusCode == 0 {
+		return err
+	}
+
+	return ServiceError{
+		StatusCode: response.StatusCode,
+		Code:       http.StatusText(response.StatusCode),
+		Message:    err.Error(),
+		RetryAfter: response.Header.Get("Retry-After"),
+	}
+}
+
+// wrapStorageError converts an error of the storage data plane to a
+// ServiceError.
+func wrapStorageError(err error) error {
+	if e, ok := err.(storageclient.AzureStorageServiceError); ok {
+		return ServiceError{
+			StatusCode: e.StatusCode,
+			Code:       e.Code,
+			Message:    e.Message,
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,56 @@
+package azure_client
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/bingosummer/azure_storage_service_broker/config"
+)
+
+const (
+	LOCATIONS_PATH        = "/subscriptions/{subscriptionId}/locations"
+	LOCATIONS_API_VERSION = "2016-06-01"
+)
+
+type Location struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type locationList struct {
+	Value []Location `json:"value"`
+}
+
+func (client ArmClient) ListLocations() ([]Location, error) {
+	var locations locationList
+	_, err := client.Send("GET", LOCATIONS_PATH,
+		nil,
+		map[string]interface{}{"api-version": LOCATIONS_API_VERSION},
+		nil, &locations,
+		http.StatusOK)
+	return locations.Value, err
+}
+
+// Locations returns the names of the regions available to the subscription.
+// They are read once per client, and so once per configuration reload.
+func (c *AzureClient) Locations() ([]string, error) {
+	c.locationsMutex.Lock()
+	defer c.locationsMutex.Unlock()
+
+	if c.locations != nil {
+		return c.locations, nil
+	}
+
+	locations, err := c.ArmClient.ListLocations()
+	if err != nil {
+		fmt.Printf("Getting the locations of subscription %s failed with error:\n%v\n", c.ArmClient.SubscriptionId, err)
+		return nil, err
+	}
+
+	names := make([]string, len(locations))
+	for i, location := range locations {
+		names[i] = config.NormalizeLocation(location.Name)
+	}
+	c.locations = names
+	return names, nil
+}
@@ -0,0 +1,30 @@
+package azure_client
+
+import "sync"
+
+// keyedLocks hands out a mutex per key, such as a resource group or a
+// container. The locks live in package variables rather than in the
+// clients, since the clients are recreated on each configuration reload
+// while requests of the old ones may still be running.
+type keyedLocks struct {
+	mutex sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func newKeyedLocks() *keyedLocks {
+	return &keyedLocks{locks: make(map[string]*sync.Mutex)}
+}
+
+// lock locks the mutex of the key and returns the function which unlocks it.
+func (l *keyedLocks) lock(key string) func() {
+	l.mutex.Lock()
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		l.locks[key] = lock
+	}
+	l.mutex.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
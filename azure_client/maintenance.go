@@ -0,0 +1,68 @@
+package azure_client
+
+import (
+	"fmt"
+
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+// maintenanceStep is a configuration change which instances receive when
+// they are provisioned at, or upgraded to, its maintenance_info version.
+type maintenanceStep struct {
+	Version     string
+	Description string
+	Apply       func(properties *StorageAccountProperties)
+}
+
+// maintenanceSteps are ordered by version. Plans in the catalog advertise
+// the version of the last step they include.
+var maintenanceSteps = []maintenanceStep{
+	{
+		Version:     "1.0.0",
+		Description: "Initial configuration",
+		Apply:       func(properties *StorageAccountProperties) {},
+	},
+	{
+		Version:     "1.1.0",
+		Description: "Allow only HTTPS traffic",
+		Apply: func(properties *StorageAccountProperties) {
+			enabled := true
+			properties.EnableHttpsTrafficOnly = &enabled
+		},
+	},
+	{
+		Version:     "1.2.0",
+		Description: "Require TLS 1.2 or newer",
+		Apply: func(properties *StorageAccountProperties) {
+			properties.MinimumTlsVersion = "TLS1_2"
+		},
+	},
+}
+
+// maintenanceProperties applies the steps newer than fromVersion up to and
+// including toVersion.
+func maintenanceProperties(fromVersion, toVersion string) (StorageAccountProperties, error) {
+	var properties StorageAccountProperties
+
+	order, err := model.CompareVersions(fromVersion, toVersion)
+	if err != nil {
+		return properties, err
+	}
+	if order > 0 {
+		return properties, fmt.Errorf("maintenance_info version %s cannot be downgraded to %s", fromVersion, toVersion)
+	}
+
+	for _, step := range maintenanceSteps {
+		newer, _ := model.CompareVersions(step.Version, fromVersion)
+		included, _ := model.CompareVersions(step.Version, toVersion)
+		if newer > 0 && included <= 0 {
+			step.Apply(&properties)
+		}
+	}
+
+	return properties, nil
+}
+
+func planMaintenanceVersion(plan *model.ServicePlan) string {
+	return plan.MaintenanceInfo.MaintenanceVersion()
+}
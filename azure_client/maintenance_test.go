@@ -0,0 +1,64 @@
+package azure_client
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+func TestMaintenanceProperties(t *testing.T) {
+	for i, test := range []struct {
+		from                   string
+		to                     string
+		expectedHttpsOnly      bool
+		expectedMinimumVersion string
+		expectedError          bool
+	}{
+		{"", "", false, "", false},
+		{"", "1.0.0", false, "", false},
+		{"", "1.2.0", true, "TLS1_2", false},
+		{"1.0.0", "1.1.0", true, "", false},
+		{"1.1.0", "1.2.0", false, "TLS1_2", false},
+		{"1.2.0", "1.2.0", false, "", false},
+		{"1.2.0", "1.0.0", false, "", true},
+		{"1.0", "1.2.0", false, "", true},
+	} {
+		properties, err := maintenanceProperties(test.from, test.to)
+		if (err != nil) != test.expectedError {
+			t.Errorf("Test %d: error was %v but expected error %v\n", i, err, test.expectedError)
+			continue
+		}
+
+		httpsOnly := properties.EnableHttpsTrafficOnly != nil && *properties.EnableHttpsTrafficOnly
+		if httpsOnly != test.expectedHttpsOnly {
+			t.Errorf("Test %d: HTTPS only was %v but expected %v\n", i, httpsOnly, test.expectedHttpsOnly)
+		}
+		if properties.MinimumTlsVersion != test.expectedMinimumVersion {
+			t.Errorf("Test %d: minimum TLS version was %q but expected %q\n", i, properties.MinimumTlsVersion, test.expectedMinimumVersion)
+		}
+	}
+}
+
+func TestUpgradeConfiguration(t *testing.T) {
+	httpsOnly := false
+	for i, test := range []struct {
+		desired  *model.AccountConfiguration
+		from     string
+		to       string
+		expected *model.AccountConfiguration
+	}{
+		{&model.AccountConfiguration{Sku: "Standard_LRS"}, "1.2.0", "1.2.0", &model.AccountConfiguration{Sku: "Standard_LRS"}},
+		{&model.AccountConfiguration{Sku: "Standard_LRS", HttpsOnly: &httpsOnly}, "1.0.0", "1.2.0", &model.AccountConfiguration{Sku: "Standard_LRS", HttpsOnly: &[]bool{true}[0], MinimumTlsVersion: "TLS1_2"}},
+		{nil, "1.1.0", "1.2.0", &model.AccountConfiguration{MinimumTlsVersion: "TLS1_2"}},
+	} {
+		configuration, err := UpgradeConfiguration(test.desired, test.from, test.to)
+		if err != nil {
+			t.Errorf("Test %d: unexpected error %v\n", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(configuration, test.expected) {
+			t.Errorf("Test %d: configuration was %+v but expected %+v\n", i, configuration, test.expected)
+		}
+	}
+}
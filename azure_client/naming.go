@@ -0,0 +1,253 @@
+package azure_client
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/bingosummer/azure_storage_service_broker/config"
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+const (
+	RANDOM_SUFFIX_LENGTH = 6
+	INSTANCE_HASH_LENGTH = 16
+
+	// Caps the platform names a template includes, so that they do not crowd
+	// out the unique part of a name
+	MAX_VARIABLE_LENGTH = 24
+
+	// How often a storage account name is generated before giving up
+	MAX_NAME_ATTEMPTS = 5
+
+	randomCharacters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	randomMarker     = "\x00"
+)
+
+// The resource group templates of the strategies which share groups between
+// instances, for Cloud Foundry and Kubernetes. GUIDs are used rather than
+// names, as spaces and organizations may be renamed.
+var sharedResourceGroupTemplates = map[string][2]string{
+	config.RESOURCE_GROUP_PER_SPACE: {"cloud-foundry-space-{space_guid}", "kubernetes-{cluster}-{namespace}"},
+	config.RESOURCE_GROUP_PER_ORG:   {"cloud-foundry-org-{org_guid}", "kubernetes-{cluster}"},
+}
+
+var variablePattern = regexp.MustCompile(`\{[a-z_]*\}`)
+
+// nameRule describes the names Azure accepts for a kind of resource.
+type nameRule struct {
+	Resource  string
+	MaxLength int
+	Pattern   *regexp.Regexp
+
+	// Replaces or drops the characters Azure does not accept
+	clean func(name string) string
+	// Removes the characters a name must not start or end with
+	trim func(name string) string
+}
+
+var (
+	resourceGroupRule = nameRule{
+		Resource:  "resource group",
+		MaxLength: 90,
+		Pattern:   regexp.MustCompile(`^[-\w.()]{1,90}$`),
+		clean:     replaceCharacters(regexp.MustCompile(`[^-\w.()]`), "-"),
+		trim:      func(name string) string { return strings.TrimRight(name, ".") },
+	}
+	storageAccountRule = nameRule{
+		Resource:  "storage account",
+		MaxLength: 24,
+		Pattern:   regexp.MustCompile(`^[a-z0-9]{3,24}$`),
+		clean:     lowerAndReplaceCharacters(regexp.MustCompile(`[^a-z0-9]`), ""),
+		trim:      func(name string) string { return name },
+	}
+	containerRule = nameRule{
+		Resource:  "container",
+		MaxLength: 63,
+		Pattern:   regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`),
+		clean:     lowerAndReplaceCharacters(regexp.MustCompile(`[^a-z0-9-]+|--+`), "-"),
+		trim:      func(name string) string { return strings.Trim(name, "-") },
+	}
+)
+
+// Namer generates the names of Azure resources from the templates in the
+// configuration. Templates may use the variables {platform}, {instance_id},
+// {instance_hash}, {org}, {space}, {org_guid}, {space_guid}, {namespace},
+// {cluster} and {random}.
+type Namer struct {
+	templates config.NamingConfig
+	random    func(length int) string
+}
+
+// NewNamer checks that the templates only use known variables and produce
+// valid names.
+func NewNamer(templates config.NamingConfig) (*Namer, error) {
+	namer := &Namer{templates: templates, random: randomString}
+
+	if !strings.Contains(templates.StorageAccount, "{instance_id}") &&
+		!strings.Contains(templates.StorageAccount, "{instance_hash}") &&
+		!strings.Contains(templates.StorageAccount, "{random}") {
+		return nil, fmt.Errorf("storage account name template %q must contain {instance_id}, {instance_hash} or {random}, as storage account names are globally unique", templates.StorageAccount)
+	}
+
+	samples := []*model.ServiceInstance{
+		{Id: "00000000-0000-0000-0000-000000000000", OrganizationGuid: "org-guid", SpaceGuid: "space-guid"},
+		{Id: "00000000-0000-0000-0000-000000000000", Context: &model.Context{Platform: model.PLATFORM_KUBERNETES, Namespace: "default", ClusterId: "cluster-id"}},
+	}
+	for _, sample := range samples {
+		if _, err := namer.ResourceGroupName(sample); err != nil {
+			return nil, err
+		}
+		if _, err := namer.StorageAccountName(sample, 0); err != nil {
+			return nil, err
+		}
+		if _, err := namer.ContainerName(sample); err != nil {
+			return nil, err
+		}
+	}
+
+	return namer, nil
+}
+
+// ResourceGroupName returns the group of the instance under the configured
+// strategy.
+func (n *Namer) ResourceGroupName(instance *model.ServiceInstance) (string, error) {
+	templates := [2]string{n.templates.ResourceGroup, n.templates.KubernetesResourceGroup}
+	switch strategy := n.templates.ResourceGroupStrategy; strategy {
+	case config.RESOURCE_GROUP_FIXED:
+		templates = [2]string{n.templates.FixedResourceGroup, n.templates.FixedResourceGroup}
+	case config.RESOURCE_GROUP_PER_SPACE, config.RESOURCE_GROUP_PER_ORG:
+		templates = sharedResourceGroupTemplates[strategy]
+	}
+
+	if instance.Platform() == model.PLATFORM_KUBERNETES {
+		return n.render(templates[1], resourceGroupRule, instance, 0)
+	}
+	return n.render(templates[0], resourceGroupRule, instance, 0)
+}
+
+// StorageAccountName returns the name for the given attempt. Attempts after
+// the first get a fresh random suffix, as storage account names are global
+// and may already be taken.
+func (n *Namer) StorageAccountName(instance *model.ServiceInstance, attempt int) (string, error) {
+	return n.render(n.templates.StorageAccount, storageAccountRule, instance, attempt)
+}
+
+func (n *Namer) ContainerName(instance *model.ServiceInstance) (string, error) {
+	return n.render(n.templates.Container, containerRule, instance, 0)
+}
+
+func (n *Namer) render(template string, rule nameRule, instance *model.ServiceInstance, attempt int) (string, error) {
+	if attempt > 0 && !strings.Contains(template, "{random}") {
+		template += "{random}"
+	}
+
+	variables := templateVariables(instance)
+	var unknown []string
+	expanded := variablePattern.ReplaceAllStringFunc(template, func(variable string) string {
+		name := variable[1 : len(variable)-1]
+		if name == "random" {
+			return randomMarker
+		}
+
+		value, ok := variables[name]
+		if !ok {
+			unknown = append(unknown, variable)
+		}
+		return value
+	})
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("%s name template %q uses unknown variables %s", rule.Resource, template, strings.Join(unknown, ", "))
+	}
+
+	// The random suffixes are always kept, the rest is shortened to fit
+	parts := strings.Split(expanded, randomMarker)
+	excess := -rule.MaxLength + (len(parts)-1)*RANDOM_SUFFIX_LENGTH
+	for i := range parts {
+		parts[i] = rule.clean(parts[i])
+		excess += len(parts[i])
+	}
+	for i := 0; i < len(parts) && excess > 0; i++ {
+		cut := excess
+		if cut > len(parts[i]) {
+			cut = len(parts[i])
+		}
+		parts[i] = parts[i][:len(parts[i])-cut]
+		excess -= cut
+	}
+
+	name := parts[0]
+	for _, part := range parts[1:] {
+		name += n.random(RANDOM_SUFFIX_LENGTH) + part
+	}
+	name = rule.trim(rule.clean(name))
+
+	if !rule.Pattern.MatchString(name) {
+		return "", fmt.Errorf("%s name %q generated from template %q is not valid in Azure", rule.Resource, name, template)
+	}
+	return name, nil
+}
+
+func templateVariables(instance *model.ServiceInstance) map[string]string {
+	hash := sha256.Sum256([]byte(instance.Id))
+
+	variables := map[string]string{
+		"platform":      instance.Platform(),
+		"instance_id":   instance.Id,
+		"instance_hash": hex.EncodeToString(hash[:])[:INSTANCE_HASH_LENGTH],
+		"org":           instance.OrganizationGuid,
+		"space":         instance.SpaceGuid,
+		"org_guid":      instance.OrganizationGuid,
+		"space_guid":    instance.SpaceGuid,
+		"namespace":     "",
+		"cluster":       "",
+	}
+
+	if c := instance.Context; c != nil {
+		for name, value := range map[string]string{
+			"org":       c.OrganizationName,
+			"space":     c.SpaceName,
+			"namespace": c.Namespace,
+			"cluster":   c.ClusterId,
+		} {
+			if value != "" {
+				variables[name] = value
+			}
+		}
+	}
+
+	for _, name := range []string{"org", "space", "namespace", "cluster"} {
+		if len(variables[name]) > MAX_VARIABLE_LENGTH {
+			variables[name] = variables[name][:MAX_VARIABLE_LENGTH]
+		}
+	}
+
+	return variables
+}
+
+func replaceCharacters(invalid *regexp.Regexp, replacement string) func(string) string {
+	return func(name string) string {
+		return invalid.ReplaceAllString(name, replacement)
+	}
+}
+
+func lowerAndReplaceCharacters(invalid *regexp.Regexp, replacement string) func(string) string {
+	return func(name string) string {
+		return invalid.ReplaceAllString(strings.ToLower(name), replacement)
+	}
+}
+
+func randomString(length int) string {
+	bytes := make([]byte, length)
+	if _, err := rand.Read(bytes); err != nil {
+		panic(err)
+	}
+
+	for i, b := range bytes {
+		bytes[i] = randomCharacters[int(b)%len(randomCharacters)]
+	}
+	return string(bytes)
+}
@@ -0,0 +1,146 @@
+package azure_client
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bingosummer/azure_storage_service_broker/config"
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+var defaultNaming = config.NamingConfig{
+	ResourceGroup:           "cloud-foundry-{instance_id}",
+	KubernetesResourceGroup: "kubernetes-{namespace}-{instance_id}",
+	StorageAccount:          "cf{instance_hash}",
+	Container:               "cloud-foundry-{instance_id}",
+}
+
+func newTestNamer(t *testing.T, naming config.NamingConfig) *Namer {
+	namer, err := NewNamer(naming)
+	if err != nil {
+		t.Fatalf("creating the namer failed: %v\n", err)
+	}
+	namer.random = func(length int) string { return strings.Repeat("r", length) }
+	return namer
+}
+
+func TestNamerResourceGroupName(t *testing.T) {
+	namer := newTestNamer(t, defaultNaming)
+
+	for i, test := range []struct {
+		instance *model.ServiceInstance
+		expected string
+	}{
+		{&model.ServiceInstance{Id: instanceId}, "cloud-foundry-" + instanceId},
+		{&model.ServiceInstance{Id: instanceId, Context: &model.Context{Platform: model.PLATFORM_KUBERNETES, Namespace: "default"}}, "kubernetes-default-" + instanceId},
+		{&model.ServiceInstance{Id: instanceId, Context: &model.Context{Platform: model.PLATFORM_KUBERNETES, Namespace: strings.Repeat("n", 63)}}, "kubernetes-" + strings.Repeat("n", MAX_VARIABLE_LENGTH) + "-" + instanceId},
+	} {
+		name, err := namer.ResourceGroupName(test.instance)
+		if err != nil || name != test.expected {
+			t.Errorf("Test %d: name was %q with error %v but expected %q\n", i, name, err, test.expected)
+		}
+	}
+}
+
+func TestNamerResourceGroupStrategies(t *testing.T) {
+	cf := &model.ServiceInstance{Id: instanceId, OrganizationGuid: "org-guid", SpaceGuid: "space-guid", Context: &model.Context{OrganizationName: "My Org"}}
+	k8s := &model.ServiceInstance{Id: instanceId, Context: &model.Context{Platform: model.PLATFORM_KUBERNETES, Namespace: "default", ClusterId: "cluster"}}
+
+	for i, test := range []struct {
+		strategy string
+		instance *model.ServiceInstance
+		expected string
+	}{
+		{config.RESOURCE_GROUP_PER_INSTANCE, cf, "cloud-foundry-" + instanceId},
+		{config.RESOURCE_GROUP_PER_SPACE, cf, "cloud-foundry-space-space-guid"},
+		{config.RESOURCE_GROUP_PER_SPACE, k8s, "kubernetes-cluster-default"},
+		{config.RESOURCE_GROUP_PER_ORG, cf, "cloud-foundry-org-org-guid"},
+		{config.RESOURCE_GROUP_PER_ORG, k8s, "kubernetes-cluster"},
+		{config.RESOURCE_GROUP_FIXED, cf, "storage-broker"},
+		{config.RESOURCE_GROUP_FIXED, k8s, "storage-broker"},
+	} {
+		naming := defaultNaming
+		naming.ResourceGroupStrategy = test.strategy
+		naming.FixedResourceGroup = "storage-broker"
+
+		name, err := newTestNamer(t, naming).ResourceGroupName(test.instance)
+		if err != nil || name != test.expected {
+			t.Errorf("Test %d: name was %q with error %v but expected %q\n", i, name, err, test.expected)
+		}
+	}
+}
+
+func TestNamerStorageAccountName(t *testing.T) {
+	for i, test := range []struct {
+		template string
+		instance *model.ServiceInstance
+		attempt  int
+		expected string
+	}{
+		{"cf{instance_hash}", &model.ServiceInstance{Id: instanceId}, 0, "cfd51cba7c50336ddd"},
+		{"cf{instance_hash}", &model.ServiceInstance{Id: instanceId}, 1, "cfd51cba7c50336dddrrrrrr"},
+		{"cf{instance_id}", &model.ServiceInstance{Id: "short"}, 0, "cfshort"},
+		{"cf{instance_id}", &model.ServiceInstance{Id: instanceId}, 0, "cf2eac2d52bfc94d0faf28c0"},
+		{"{org}{space}{random}", &model.ServiceInstance{Id: instanceId, Context: &model.Context{OrganizationName: "My-Org", SpaceName: "Dev Space"}}, 0, "myorgdevspacerrrrrr"},
+		{"{org}{random}x", &model.ServiceInstance{Id: instanceId, Context: &model.Context{OrganizationName: strings.Repeat("o", 30)}}, 0, strings.Repeat("o", 17) + "rrrrrrx"},
+	} {
+		namer := newTestNamer(t, config.NamingConfig{
+			ResourceGroup:           defaultNaming.ResourceGroup,
+			KubernetesResourceGroup: defaultNaming.KubernetesResourceGroup,
+			StorageAccount:          test.template,
+			Container:               defaultNaming.Container,
+		})
+
+		name, err := namer.StorageAccountName(test.instance, test.attempt)
+		if err != nil || name != test.expected {
+			t.Errorf("Test %d: name was %q with error %v but expected %q\n", i, name, err, test.expected)
+		}
+	}
+}
+
+func TestNamerContainerName(t *testing.T) {
+	for i, test := range []struct {
+		template string
+		instance *model.ServiceInstance
+		expected string
+	}{
+		{"cloud-foundry-{instance_id}", &model.ServiceInstance{Id: instanceId}, "cloud-foundry-" + instanceId},
+		{"{space}--{instance_hash}", &model.ServiceInstance{Id: instanceId, Context: &model.Context{SpaceName: "_Dev Space_"}}, "dev-space-d51cba7c50336ddd"},
+	} {
+		namer := newTestNamer(t, config.NamingConfig{
+			ResourceGroup:           defaultNaming.ResourceGroup,
+			KubernetesResourceGroup: defaultNaming.KubernetesResourceGroup,
+			StorageAccount:          defaultNaming.StorageAccount,
+			Container:               test.template,
+		})
+
+		name, err := namer.ContainerName(test.instance)
+		if err != nil || name != test.expected {
+			t.Errorf("Test %d: name was %q with error %v but expected %q\n", i, name, err, test.expected)
+		}
+	}
+}
+
+func TestNewNamer(t *testing.T) {
+	for i, test := range []struct {
+		storageAccount string
+		container      string
+		expectedError  bool
+	}{
+		{"cf{instance_hash}", "cloud-foundry-{instance_id}", false},
+		{"cf{random}", "{instance_id}", false},
+		{"cfstatic", "cloud-foundry-{instance_id}", true},
+		{"cf{instance_hash}{unknown}", "cloud-foundry-{instance_id}", true},
+		{"cf{instance_hash}", "{org}", true},
+	} {
+		_, err := NewNamer(config.NamingConfig{
+			ResourceGroup:           defaultNaming.ResourceGroup,
+			KubernetesResourceGroup: defaultNaming.KubernetesResourceGroup,
+			StorageAccount:          test.storageAccount,
+			Container:               test.container,
+		})
+		if (err != nil) != test.expectedError {
+			t.Errorf("Test %d: error was %v but expected error %v\n", i, err, test.expectedError)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package azure_client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bingosummer/azure_storage_service_broker/config"
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+const (
+	// The parameter users set the network ACL of the storage account with
+	NETWORK_RULES_PARAMETER = "network_rules"
+
+	NETWORK_ACTION_ALLOW = "Allow"
+	NETWORK_ACTION_DENY  = "Deny"
+
+	// Azure services such as logging and metrics keep access to accounts
+	// which deny by default
+	NETWORK_BYPASS = "AzureServices"
+)
+
+// NetworkRuleSet is the network ACL of a storage account as described by
+// STORAGE_API_VERSION.
+type NetworkRuleSet struct {
+	Bypass              string               `json:"bypass,omitempty"`
+	DefaultAction       string               `json:"defaultAction"`
+	IpRules             []IpRule             `json:"ipRules"`
+	VirtualNetworkRules []VirtualNetworkRule `json:"virtualNetworkRules"`
+}
+
+type IpRule struct {
+	Value  string `json:"value"`
+	Action string `json:"action,omitempty"`
+}
+
+type VirtualNetworkRule struct {
+	Id     string `json:"id"`
+	Action string `json:"action,omitempty"`
+}
+
+// InstanceNetworkRules returns the network rules in the network_rules
+// parameter, or nil without it. Rules with an IP allow-list or subnets deny
+// other traffic unless they say otherwise, and rules which deny admit the
+// egress IPs of the platform.
+func InstanceNetworkRules(parameters interface{}, egressIps []string) (*model.NetworkRules, error) {
+	param, _ := parameters.(map[string]interface{})
+	raw, ok := param[NETWORK_RULES_PARAMETER]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	object, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("network_rules must be an object")
+	}
+
+	ipRules, err := stringList(object, "ip_rules")
+	if err != nil {
+		return nil, err
+	}
+	subnetIds, err := stringList(object, "subnet_ids")
+	if err != nil {
+		return nil, err
+	}
+
+	rules := &model.NetworkRules{DefaultAction: NETWORK_ACTION_ALLOW}
+	if len(ipRules) > 0 || len(subnetIds) > 0 {
+		rules.DefaultAction = NETWORK_ACTION_DENY
+	}
+	if v, ok := object["default_action"]; ok {
+		action, _ := v.(string)
+		if action != NETWORK_ACTION_ALLOW && action != NETWORK_ACTION_DENY {
+			return nil, fmt.Errorf("network_rules.default_action must be %s or %s", NETWORK_ACTION_ALLOW, NETWORK_ACTION_DENY)
+		}
+		rules.DefaultAction = action
+	}
+
+	if rules.DefaultAction == NETWORK_ACTION_DENY {
+		ipRules = append(ipRules, egressIps...)
+	}
+	seen := make(map[string]bool)
+	for _, rule := range ipRules {
+		normalized, err := config.NormalizeIpRule(rule)
+		if err != nil {
+			return nil, errors.New("network_rules.ip_rules: " + err.Error())
+		}
+		if !seen[normalized] {
+			seen[normalized] = true
+			rules.IpRules = append(rules.IpRules, normalized)
+		}
+	}
+	if len(rules.IpRules) > config.MAX_IP_RULES {
+		return nil, fmt.Errorf("network_rules.ip_rules must not have more than %d entries, including the %d of the platform", config.MAX_IP_RULES, len(egressIps))
+	}
+
+	for _, id := range subnetIds {
+		if !config.IsSubnetId(id) {
+			return nil, fmt.Errorf("network_rules.subnet_ids: %q is not the resource ID of a subnet", id)
+		}
+		if !seen[strings.ToLower(id)] {
+			seen[strings.ToLower(id)] = true
+			rules.SubnetIds = append(rules.SubnetIds, id)
+		}
+	}
+	if len(rules.SubnetIds) > config.MAX_VIRTUAL_NETWORK_RULES {
+		return nil, fmt.Errorf("network_rules.subnet_ids must not have more than %d entries", config.MAX_VIRTUAL_NETWORK_RULES)
+	}
+
+	return rules, nil
+}
+
+// NetworkRulesSchema is the JSON schema of the network_rules parameter, which
+// the catalog adds to the plans allowing it. Numbers are float64, as JSON
+// decodes them.
+var NetworkRulesSchema = map[string]interface{}{
+	"type":                 "object",
+	"description":          "The network ACL of the storage account. An IP allow-list or subnets deny other traffic by default.",
+	"additionalProperties": false,
+	"properties": map[string]interface{}{
+		"default_action": map[string]interface{}{
+			"type":        "string",
+			"description": "The action for traffic which no rule admits.",
+			"enum":        []interface{}{NETWORK_ACTION_ALLOW, NETWORK_ACTION_DENY},
+		},
+		"ip_rules": map[string]interface{}{
+			"type":        "array",
+			"description": "Public IPv4 addresses and CIDR ranges which may reach the account.",
+			"maxItems":    float64(config.MAX_IP_RULES),
+			"items":       map[string]interface{}{"type": "string"},
+		},
+		"subnet_ids": map[string]interface{}{
+			"type":        "array",
+			"description": "Resource IDs of VNet subnets with the Microsoft.Storage service endpoint which may reach the account.",
+			"maxItems":    float64(config.MAX_VIRTUAL_NETWORK_RULES),
+			"items":       map[string]interface{}{"type": "string"},
+		},
+	},
+}
+
+// networkRuleSet describes the rules in the form of Azure.
+func networkRuleSet(rules *model.NetworkRules) *NetworkRuleSet {
+	ruleSet := &NetworkRuleSet{
+		Bypass:              NETWORK_BYPASS,
+		DefaultAction:       rules.DefaultAction,
+		IpRules:             []IpRule{},
+		VirtualNetworkRules: []VirtualNetworkRule{},
+	}
+	for _, rule := range rules.IpRules {
+		ruleSet.IpRules = append(ruleSet.IpRules, IpRule{Value: rule, Action: NETWORK_ACTION_ALLOW})
+	}
+	for _, id := range rules.SubnetIds {
+		ruleSet.VirtualNetworkRules = append(ruleSet.VirtualNetworkRules, VirtualNetworkRule{Id: id, Action: NETWORK_ACTION_ALLOW})
+	}
+	return ruleSet
+}
+
+// networkRulesOf describes a network ACL of Azure in the form of the broker,
+// or returns nil without one.
+func networkRulesOf(ruleSet *NetworkRuleSet) *model.NetworkRules {
+	if ruleSet == nil {
+		return nil
+	}
+	rules := &model.NetworkRules{DefaultAction: ruleSet.DefaultAction}
+	for _, rule := range ruleSet.IpRules {
+		rules.IpRules = append(rules.IpRules, rule.Value)
+	}
+	for _, rule := range ruleSet.VirtualNetworkRules {
+		rules.SubnetIds = append(rules.SubnetIds, rule.Id)
+	}
+	return rules
+}
+
+// stringList returns the list of strings under the key of the object.
+func stringList(object map[string]interface{}, key string) ([]string, error) {
+	raw, ok := object[key]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	items, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("network_rules.%s must be a list of strings", key)
+	}
+
+	var list []string
+	for _, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("network_rules.%s must be a list of strings", key)
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
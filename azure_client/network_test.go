@@ -0,0 +1,47 @@
+package azure_client
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+func TestInstanceNetworkRules(t *testing.T) {
+	subnet := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/vnet/subnets/apps"
+	egressIps := []string{"198.51.100.0/24"}
+
+	for i, test := range []struct {
+		rules         interface{}
+		expected      *model.NetworkRules
+		expectedError bool
+	}{
+		{nil, nil, false},
+		{
+			map[string]interface{}{"ip_rules": []interface{}{"203.0.113.7/32", "203.0.113.7"}, "subnet_ids": []interface{}{subnet}},
+			&model.NetworkRules{DefaultAction: "Deny", IpRules: []string{"203.0.113.7", "198.51.100.0/24"}, SubnetIds: []string{subnet}},
+			false,
+		},
+		{map[string]interface{}{"default_action": "Deny"}, &model.NetworkRules{DefaultAction: "Deny", IpRules: []string{"198.51.100.0/24"}}, false},
+		{map[string]interface{}{"default_action": "Allow", "ip_rules": []interface{}{"203.0.113.7"}}, &model.NetworkRules{DefaultAction: "Allow", IpRules: []string{"203.0.113.7"}}, false},
+		{map[string]interface{}{"default_action": "Block"}, nil, true},
+		{map[string]interface{}{"ip_rules": []interface{}{"10.0.0.1"}}, nil, true},
+		{map[string]interface{}{"ip_rules": "203.0.113.7"}, nil, true},
+		{map[string]interface{}{"subnet_ids": []interface{}{"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/vnet"}}, nil, true},
+		{"all", nil, true},
+	} {
+		var parameters interface{}
+		if test.rules != nil {
+			parameters = map[string]interface{}{"network_rules": test.rules}
+		}
+
+		rules, err := InstanceNetworkRules(parameters, egressIps)
+		if (err != nil) != test.expectedError {
+			t.Errorf("Test %d: error was %v but expected error %v\n", i, err, test.expectedError)
+			continue
+		}
+		if !reflect.DeepEqual(rules, test.expected) {
+			t.Errorf("Test %d: rules were %+v but expected %+v\n", i, rules, test.expected)
+		}
+	}
+}
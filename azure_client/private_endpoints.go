@@ -0,0 +1,324 @@
+package azure_client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+const (
+	NETWORK_API_VERSION = "2021-05-01"
+	// publicNetworkAccess needs a newer version than STORAGE_API_VERSION,
+	// which Azure Stack lacks, as it lacks private endpoints
+	PRIVATE_LINK_STORAGE_API_VERSION = "2021-09-01"
+
+	PRIVATE_ENDPOINTS_PATH      = "/subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/Microsoft.Network/privateEndpoints"
+	PRIVATE_ENDPOINT_PATH       = PRIVATE_ENDPOINTS_PATH + "/{privateEndpointName}"
+	PRIVATE_DNS_ZONE_GROUP_PATH = PRIVATE_ENDPOINT_PATH + "/privateDnsZoneGroups/default"
+
+	// The parameter which chooses a private endpoint over the plan
+	PRIVATE_ENDPOINT_PARAMETER = "private_endpoint"
+
+	// The sub-resource of the storage account the endpoint connects to
+	BLOB_GROUP_ID = "blob"
+)
+
+type privateEndpoint struct {
+	Name       string                    `json:"name,omitempty"`
+	Location   string                    `json:"location,omitempty"`
+	Tags       map[string]string         `json:"tags,omitempty"`
+	Properties privateEndpointProperties `json:"properties"`
+}
+
+type privateEndpointProperties struct {
+	ProvisioningState             string                         `json:"provisioningState,omitempty"`
+	Subnet                        resourceReference              `json:"subnet"`
+	PrivateLinkServiceConnections []privateLinkServiceConnection `json:"privateLinkServiceConnections"`
+}
+
+type privateEndpointList struct {
+	Value    []privateEndpoint `json:"value"`
+	NextLink string            `json:"nextLink"`
+}
+
+type resourceReference struct {
+	Id string `json:"id"`
+}
+
+type privateLinkServiceConnection struct {
+	Name       string                                 `json:"name"`
+	Properties privateLinkServiceConnectionProperties `json:"properties"`
+}
+
+type privateLinkServiceConnectionProperties struct {
+	PrivateLinkServiceId string   `json:"privateLinkServiceId"`
+	GroupIds             []string `json:"groupIds"`
+}
+
+type privateDnsZoneGroup struct {
+	Properties privateDnsZoneGroupProperties `json:"properties"`
+}
+
+type privateDnsZoneGroupProperties struct {
+	ProvisioningState     string                 `json:"provisioningState,omitempty"`
+	PrivateDnsZoneConfigs []privateDnsZoneConfig `json:"privateDnsZoneConfigs"`
+}
+
+type privateDnsZoneConfig struct {
+	Name       string                         `json:"name"`
+	Properties privateDnsZoneConfigProperties `json:"properties"`
+}
+
+type privateDnsZoneConfigProperties struct {
+	PrivateDnsZoneId string `json:"privateDnsZoneId"`
+}
+
+type virtualNetwork struct {
+	Location string `json:"location"`
+}
+
+// UsesPrivateEndpoint reports whether the blob service of an instance is
+// reached through a private endpoint: as the private_endpoint parameter
+// says, else as the plan says.
+func UsesPrivateEndpoint(plan *model.ServicePlan, parameters interface{}) (bool, error) {
+	param, _ := parameters.(map[string]interface{})
+	if raw, ok := param[PRIVATE_ENDPOINT_PARAMETER]; ok && raw != nil {
+		value, ok := raw.(bool)
+		if !ok {
+			return false, fmt.Errorf("%s must be true or false", PRIVATE_ENDPOINT_PARAMETER)
+		}
+		return value, nil
+	}
+	return plan.Metadata.PrivateEndpoint, nil
+}
+
+// ProvisionPrivateEndpoint takes the next step towards the private endpoint
+// of the instance, whose storage account must exist: it creates the
+// endpoint in the configured subnet, registers it in the private DNS zone
+// and disables public network access. It reports whether the endpoint is
+// ready, and then records its FQDN on the instance.
+func (c *AzureClient) ProvisionPrivateEndpoint(instance *model.ServiceInstance) (bool, error) {
+	resourceGroupName, name := instance.ResourceGroupName, instance.PrivateEndpoint.Name
+	if c.privateEndpointSubnetId == "" {
+		return false, errors.New("private endpoints are not configured")
+	}
+	pathParameters := privateEndpointPathParameters(resourceGroupName, name)
+
+	var endpoint privateEndpoint
+	_, err := c.ArmClient.Send("GET", PRIVATE_ENDPOINT_PATH, pathParameters, networkQueryParameters(), nil, &endpoint, http.StatusOK)
+	if isNotFound(err) {
+		return false, c.createPrivateEndpoint(instance)
+	}
+	if err != nil {
+		return false, err
+	}
+	if ready, err := provisioned("private endpoint "+name, endpoint.Properties.ProvisioningState); !ready {
+		return false, err
+	}
+
+	var group privateDnsZoneGroup
+	_, err = c.ArmClient.Send("GET", PRIVATE_DNS_ZONE_GROUP_PATH, pathParameters, networkQueryParameters(), nil, &group, http.StatusOK)
+	if isNotFound(err) {
+		group = privateDnsZoneGroup{Properties: privateDnsZoneGroupProperties{
+			PrivateDnsZoneConfigs: []privateDnsZoneConfig{{Name: BLOB_GROUP_ID, Properties: privateDnsZoneConfigProperties{PrivateDnsZoneId: c.privateDnsZoneId}}},
+		}}
+		_, err = c.ArmClient.Send("PUT", PRIVATE_DNS_ZONE_GROUP_PATH, pathParameters, networkQueryParameters(), group, nil, http.StatusOK, http.StatusCreated)
+		if err == nil {
+			fmt.Printf("Registering private endpoint %s.%s in DNS zone %s initiated\n", resourceGroupName, name, c.privateDnsZoneId)
+		}
+		return false, err
+	}
+	if err != nil {
+		return false, err
+	}
+	if ready, err := provisioned("DNS registration of private endpoint "+name, group.Properties.ProvisioningState); !ready {
+		return false, err
+	}
+
+	_, err = c.ArmClient.Send("PATCH", STORAGE_ACCOUNT_PATH,
+		storageAccountPathParameters(resourceGroupName, instance.StorageAccountName),
+		map[string]interface{}{"api-version": PRIVATE_LINK_STORAGE_API_VERSION},
+		map[string]interface{}{"properties": map[string]interface{}{"publicNetworkAccess": "Disabled"}}, nil,
+		http.StatusOK)
+	if err != nil {
+		fmt.Printf("Disabling public network access of %s.%s failed with error:\n%v\n", resourceGroupName, instance.StorageAccountName, err)
+		return false, err
+	}
+
+	instance.PrivateEndpoint.Fqdn = instance.StorageAccountName + "." + lastSegment(c.privateDnsZoneId)
+	fmt.Printf("Private endpoint %s.%s is ready as %s\n", resourceGroupName, name, instance.PrivateEndpoint.Fqdn)
+	return true, nil
+}
+
+// createPrivateEndpoint creates the endpoint in the region of the VNet of
+// the configured subnet.
+func (c *AzureClient) createPrivateEndpoint(instance *model.ServiceInstance) error {
+	var vnet virtualNetwork
+	_, err := c.ArmClient.Send("GET", virtualNetworkOf(c.privateEndpointSubnetId), nil, networkQueryParameters(), nil, &vnet, http.StatusOK)
+	if err != nil {
+		fmt.Printf("Reading the VNet of subnet %s failed with error:\n%v\n", c.privateEndpointSubnetId, err)
+		return err
+	}
+
+	name := instance.PrivateEndpoint.Name
+	tags := c.brokerTags()
+	tags["instance_id"] = instance.Id
+	endpoint := privateEndpoint{
+		Location: vnet.Location,
+		Tags:     tags,
+		Properties: privateEndpointProperties{
+			Subnet: resourceReference{Id: c.privateEndpointSubnetId},
+			PrivateLinkServiceConnections: []privateLinkServiceConnection{{
+				Name: name,
+				Properties: privateLinkServiceConnectionProperties{
+					PrivateLinkServiceId: c.storageAccountId(instance.ResourceGroupName, instance.StorageAccountName),
+					GroupIds:             []string{BLOB_GROUP_ID},
+				},
+			}},
+		},
+	}
+
+	_, err = c.ArmClient.Send("PUT", PRIVATE_ENDPOINT_PATH, privateEndpointPathParameters(instance.ResourceGroupName, name), networkQueryParameters(), endpoint, nil, http.StatusOK, http.StatusCreated)
+	if err != nil {
+		fmt.Printf("Creating private endpoint %s.%s failed with error:\n%v\n", instance.ResourceGroupName, name, err)
+		return err
+	}
+
+	fmt.Printf("Creation initiated %s.%s\n", instance.ResourceGroupName, name)
+	return nil
+}
+
+// DeletePrivateEndpoint takes the next step towards deleting the private
+// endpoint together with its DNS registration: it starts the deletion unless
+// one is in progress. It reports whether the endpoint is gone, as the storage
+// account can only be deleted then.
+func (c *AzureClient) DeletePrivateEndpoint(resourceGroupName, privateEndpointName string) (bool, error) {
+	pathParameters := privateEndpointPathParameters(resourceGroupName, privateEndpointName)
+
+	var endpoint privateEndpoint
+	_, err := c.ArmClient.Send("GET", PRIVATE_ENDPOINT_PATH, pathParameters, networkQueryParameters(), nil, &endpoint, http.StatusOK)
+	if isNotFound(err) {
+		fmt.Printf("Deleting of %s.%s succeeded\n", resourceGroupName, privateEndpointName)
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if endpoint.Properties.ProvisioningState == "Deleting" {
+		return false, nil
+	}
+
+	_, err = c.ArmClient.Send("DELETE", PRIVATE_ENDPOINT_PATH, pathParameters, networkQueryParameters(), nil, nil,
+		http.StatusOK, http.StatusAccepted, http.StatusNoContent)
+	if err != nil {
+		fmt.Printf("Deleting of %s.%s failed with error:\n%v\n", resourceGroupName, privateEndpointName, err)
+		return false, err
+	}
+
+	fmt.Printf("Deletion initiated %s.%s\n", resourceGroupName, privateEndpointName)
+	return false, nil
+}
+
+// FindPrivateEndpoint returns the private endpoint tagged with the ID of the
+// instance in the resource group of its storage account, or nil without one.
+// The FQDN is set if the endpoint is registered in the private DNS zone and
+// public network access to the account is disabled, as after provisioning.
+func (c *AzureClient) FindPrivateEndpoint(instance *model.ServiceInstance) (*model.PrivateEndpoint, error) {
+	var found *privateEndpoint
+	path, pathParameters, query := PRIVATE_ENDPOINTS_PATH, map[string]interface{}{"resourceGroupName": instance.ResourceGroupName}, networkQueryParameters()
+	for found == nil {
+		var list privateEndpointList
+		_, err := c.ArmClient.Send("GET", path, pathParameters, query, nil, &list, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Value {
+			if list.Value[i].Tags["instance_id"] == instance.Id && list.Value[i].Tags["broker_id"] == c.brokerId {
+				found = &list.Value[i]
+				break
+			}
+		}
+
+		if found == nil && list.NextLink == "" {
+			return nil, nil
+		}
+		path, query, err = nextPage(list.NextLink)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	endpoint := &model.PrivateEndpoint{Name: found.Name}
+	if found.Properties.ProvisioningState != "Succeeded" || c.privateDnsZoneId == "" {
+		return endpoint, nil
+	}
+
+	var group privateDnsZoneGroup
+	_, err := c.ArmClient.Send("GET", PRIVATE_DNS_ZONE_GROUP_PATH, privateEndpointPathParameters(instance.ResourceGroupName, found.Name), networkQueryParameters(), nil, &group, http.StatusOK)
+	if isNotFound(err) {
+		return endpoint, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var account StorageAccount
+	_, err = c.ArmClient.Send("GET", STORAGE_ACCOUNT_PATH,
+		storageAccountPathParameters(instance.ResourceGroupName, instance.StorageAccountName),
+		map[string]interface{}{"api-version": PRIVATE_LINK_STORAGE_API_VERSION}, nil, &account,
+		http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	if group.Properties.ProvisioningState == "Succeeded" && account.Properties.PublicNetworkAccess == "Disabled" {
+		endpoint.Fqdn = instance.StorageAccountName + "." + lastSegment(c.privateDnsZoneId)
+	}
+	return endpoint, nil
+}
+
+func (c *AzureClient) storageAccountId(resourceGroupName, storageAccountName string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Storage/storageAccounts/%s", c.ArmClient.SubscriptionId, resourceGroupName, storageAccountName)
+}
+
+// provisioned reports whether a network resource finished provisioning, and
+// fails if it cannot.
+func provisioned(resource, state string) (bool, error) {
+	switch state {
+	case "Succeeded":
+		return true, nil
+	case "Failed", "Canceled":
+		return false, fmt.Errorf("provisioning %s ended in state %s", resource, state)
+	}
+	return false, nil
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(ServiceError)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// virtualNetworkOf returns the resource ID of the VNet of a subnet.
+func virtualNetworkOf(subnetId string) string {
+	return subnetId[:strings.LastIndex(strings.ToLower(subnetId), "/subnets/")]
+}
+
+func lastSegment(resourceId string) string {
+	return resourceId[strings.LastIndex(resourceId, "/")+1:]
+}
+
+func privateEndpointPathParameters(resourceGroupName, privateEndpointName string) map[string]interface{} {
+	return map[string]interface{}{
+		"resourceGroupName":   resourceGroupName,
+		"privateEndpointName": privateEndpointName,
+	}
+}
+
+func networkQueryParameters() map[string]interface{} {
+	return map[string]interface{}{
+		"api-version": NETWORK_API_VERSION,
+	}
+}
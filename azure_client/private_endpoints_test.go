@@ -0,0 +1,180 @@
+package azure_client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+// armStandIn keeps the resources PUT to it, in the provisioning state of
+// state, until they are deleted, lists the private endpoints and serves the
+// VNet of the private endpoint subnet.
+func armStandIn(t *testing.T, state *string, patched *bool) *httptest.Server {
+	resources := make(map[string]map[string]interface{})
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.ToLower(r.URL.Path)
+		switch {
+		case r.Method == "PATCH" && strings.HasSuffix(path, "/storageaccounts/account"):
+			if r.URL.Query().Get("api-version") != PRIVATE_LINK_STORAGE_API_VERSION {
+				t.Errorf("public network access was disabled with api-version %s\n", r.URL.Query().Get("api-version"))
+			}
+			*patched = true
+			w.Write([]byte("{}"))
+		case r.Method == "GET" && strings.HasSuffix(path, "/storageaccounts/account"):
+			access := "Enabled"
+			if *patched {
+				access = "Disabled"
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"properties": map[string]interface{}{"publicNetworkAccess": access}})
+		case r.Method == "GET" && strings.HasSuffix(path, "/privateendpoints"):
+			list := []map[string]interface{}{}
+			for resourcePath, resource := range resources {
+				if strings.HasPrefix(resourcePath, path+"/") && !strings.Contains(resourcePath[len(path)+1:], "/") {
+					resource["name"] = resourcePath[len(path)+1:]
+					resource["properties"].(map[string]interface{})["provisioningState"] = *state
+					list = append(list, resource)
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"value": list})
+		case r.Method == "DELETE":
+			for resourcePath := range resources {
+				if resourcePath == path || strings.HasPrefix(resourcePath, path+"/") {
+					delete(resources, resourcePath)
+				}
+			}
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == "GET" && strings.HasSuffix(path, "/virtualnetworks/vnet"):
+			w.Write([]byte(`{"location": "westeurope"}`))
+		case r.Method == "PUT":
+			var resource map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&resource)
+			if strings.HasSuffix(path, "/privateendpoints/account-blob") && resource["location"] != "westeurope" {
+				t.Errorf("private endpoint was created in %v\n", resource["location"])
+			}
+			resources[path] = resource
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("{}"))
+		case r.Method == "GET" && resources[path] != nil:
+			resource := resources[path]
+			resource["properties"].(map[string]interface{})["provisioningState"] = *state
+			json.NewEncoder(w).Encode(resource)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code": "NotFound", "message": "not found"}`))
+		}
+	}))
+}
+
+func TestProvisionPrivateEndpoint(t *testing.T) {
+	state, patched := "Updating", false
+	server := armStandIn(t, &state, &patched)
+	defer server.Close()
+
+	arm := NewArmClientWithBaseUri(server.URL, "sub")
+	c := &AzureClient{
+		ArmClient:               &arm,
+		brokerId:                "broker",
+		privateEndpointSubnetId: "/subscriptions/sub/resourceGroups/network/providers/Microsoft.Network/virtualNetworks/vnet/subnets/endpoints",
+		privateDnsZoneId:        "/subscriptions/sub/resourceGroups/network/providers/Microsoft.Network/privateDnsZones/privatelink.blob.core.windows.net",
+	}
+	instance := &model.ServiceInstance{
+		Id:                 "instance-id",
+		ResourceGroupName:  "rg",
+		StorageAccountName: "account",
+		PrivateEndpoint:    &model.PrivateEndpoint{Name: "account-blob"},
+	}
+
+	for i, test := range []struct {
+		state    string
+		expected bool
+	}{
+		// Creates the endpoint, which then provisions
+		{"Updating", false},
+		{"Updating", false},
+		// Registers the endpoint in the DNS zone, which then provisions
+		{"Succeeded", false},
+		{"Succeeded", true},
+	} {
+		state = test.state
+		ready, err := c.ProvisionPrivateEndpoint(instance)
+		if err != nil {
+			t.Fatalf("Test %d: unexpected error %v\n", i, err)
+		}
+		if ready != test.expected {
+			t.Errorf("Test %d: ready was %v but expected %v\n", i, ready, test.expected)
+		}
+	}
+
+	if !patched || instance.PrivateEndpoint.Fqdn != "account.privatelink.blob.core.windows.net" {
+		t.Errorf("public network access disabled %v, FQDN %q\n", patched, instance.PrivateEndpoint.Fqdn)
+	}
+
+	state = "Failed"
+	instance.PrivateEndpoint = &model.PrivateEndpoint{Name: "account-blob"}
+	if _, err := c.ProvisionPrivateEndpoint(instance); err == nil {
+		t.Errorf("a failed endpoint was not reported\n")
+	}
+}
+
+func TestFindAndDeletePrivateEndpoint(t *testing.T) {
+	state, patched := "Succeeded", false
+	server := armStandIn(t, &state, &patched)
+	defer server.Close()
+
+	arm := NewArmClientWithBaseUri(server.URL, "sub")
+	c := &AzureClient{
+		ArmClient:               &arm,
+		brokerId:                "broker",
+		privateEndpointSubnetId: "/subscriptions/sub/resourceGroups/network/providers/Microsoft.Network/virtualNetworks/vnet/subnets/endpoints",
+		privateDnsZoneId:        "/subscriptions/sub/resourceGroups/network/providers/Microsoft.Network/privateDnsZones/privatelink.blob.core.windows.net",
+	}
+	instance := &model.ServiceInstance{
+		Id:                 "instance-id",
+		ResourceGroupName:  "rg",
+		StorageAccountName: "account",
+		PrivateEndpoint:    &model.PrivateEndpoint{Name: "account-blob"},
+	}
+	for ready := false; !ready; {
+		var err error
+		ready, err = c.ProvisionPrivateEndpoint(instance)
+		if err != nil {
+			t.Fatalf("provisioning the private endpoint failed with %v\n", err)
+		}
+	}
+
+	recovered := &model.ServiceInstance{Id: "instance-id", ResourceGroupName: "rg", StorageAccountName: "account"}
+	for i, test := range []struct {
+		instanceId string
+		expected   *model.PrivateEndpoint
+	}{
+		{"instance-id", instance.PrivateEndpoint},
+		{"other-id", nil},
+	} {
+		recovered.Id = test.instanceId
+		endpoint, err := c.FindPrivateEndpoint(recovered)
+		if err != nil {
+			t.Fatalf("Test %d: unexpected error %v\n", i, err)
+		}
+		if !reflect.DeepEqual(endpoint, test.expected) {
+			t.Errorf("Test %d: found private endpoint %+v but expected %+v\n", i, endpoint, test.expected)
+		}
+	}
+
+	for i, expected := range []bool{false, true} {
+		gone, err := c.DeletePrivateEndpoint("rg", "account-blob")
+		if err != nil {
+			t.Fatalf("Test %d: unexpected error %v\n", i, err)
+		}
+		if gone != expected {
+			t.Errorf("Test %d: the private endpoint was gone %v but expected %v\n", i, gone, expected)
+		}
+	}
+	if endpoint, err := c.FindPrivateEndpoint(instance); endpoint != nil || err != nil {
+		t.Errorf("a deleted private endpoint was found as %+v, %v\n", endpoint, err)
+	}
+}
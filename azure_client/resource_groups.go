@@ -0,0 +1,156 @@
+package azure_client
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/arm/resources"
+
+	"github.com/bingosummer/azure_storage_service_broker/config"
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+const (
+	// Marks the resource groups the broker created, and so may delete
+	OWNER_TAG_NAME  = "managed-by"
+	OWNER_TAG_VALUE = "azure-storage-service-broker"
+)
+
+// resourceGroupLocks serializes provisioning into a shared resource group
+// with deleting the group once it is empty.
+var resourceGroupLocks = newKeyedLocks()
+
+func (c *AzureClient) lockResourceGroup(resourceGroupName string) func() {
+	return resourceGroupLocks.lock(c.ArmClient.SubscriptionId + "/" + resourceGroupName)
+}
+
+// ensureResourceGroup creates the resource group unless it exists. Existing
+// groups are used as they are.
+func (c *AzureClient) ensureResourceGroup(resourceGroupName, location string, tags map[string]string) error {
+	group, err := c.ResourceManagementClient.Get(resourceGroupName)
+	if err == nil {
+		fmt.Printf("Using the existing resource group %s\n", resourceGroupName)
+		return nil
+	}
+	if group.Response.Response == nil || group.StatusCode != http.StatusNotFound {
+		fmt.Printf("Getting resource group %s failed\n", resourceGroupName)
+		return wrapResponseError(group.Response, err)
+	}
+
+	rg := resources.ResourceGroup{Location: location, Tags: map[string]string{OWNER_TAG_NAME: OWNER_TAG_VALUE}}
+	for name, value := range tags {
+		rg.Tags[name] = value
+	}
+
+	resourceGroup, err := c.ResourceManagementClient.CreateOrUpdate(resourceGroupName, rg)
+	if err != nil {
+		statusCode := resourceGroup.Response.StatusCode
+		if statusCode != http.StatusAccepted && statusCode != http.StatusCreated {
+			fmt.Printf("Creating resource group %s failed\n", resourceGroupName)
+			return wrapResponseError(resourceGroup.Response, err)
+		}
+	}
+
+	fmt.Printf("Creation initiated %s\n", resourceGroupName)
+	return nil
+}
+
+// AdoptResourceGroup tags the resource group of the instance as created by
+// the broker when the naming strategy names it, so that it is deleted once
+// empty like the groups created since the tag. Fixed groups, which the
+// operator may have created, and groups tagged by others are left alone. It
+// reports whether the group needs the tag, and only adds it unless dryRun.
+func (c *AzureClient) AdoptResourceGroup(instance *model.ServiceInstance, dryRun bool) (bool, error) {
+	if c.Namer.templates.ResourceGroupStrategy == config.RESOURCE_GROUP_FIXED {
+		return false, nil
+	}
+	name, err := c.Namer.ResourceGroupName(instance)
+	if err != nil || !strings.EqualFold(name, instance.ResourceGroupName) {
+		return false, err
+	}
+
+	unlock := c.lockResourceGroup(instance.ResourceGroupName)
+	defer unlock()
+
+	group, err := c.ResourceManagementClient.Get(instance.ResourceGroupName)
+	if err != nil {
+		return false, wrapResponseError(group.Response, err)
+	}
+	if _, ok := group.Tags[OWNER_TAG_NAME]; ok {
+		return false, nil
+	}
+	if dryRun {
+		return true, nil
+	}
+
+	tags := map[string]string{OWNER_TAG_NAME: OWNER_TAG_VALUE}
+	for name, value := range group.Tags {
+		tags[name] = value
+	}
+	result, err := c.ResourceManagementClient.Patch(instance.ResourceGroupName, resources.ResourceGroup{Location: group.Location, Tags: tags})
+	if err != nil {
+		fmt.Printf("Tagging resource group %s failed\n", instance.ResourceGroupName)
+		return false, wrapResponseError(result.Response, err)
+	}
+
+	fmt.Printf("Tagged resource group %s as created by the broker\n", instance.ResourceGroupName)
+	return true, nil
+}
+
+// deleteResourceGroupIfEmpty deletes the resource group if the broker created
+// it and no resources are left in it.
+func (c *AzureClient) deleteResourceGroupIfEmpty(resourceGroupName string) error {
+	group, err := c.ResourceManagementClient.Get(resourceGroupName)
+	if err != nil {
+		if group.Response.Response != nil && group.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		return wrapResponseError(group.Response, err)
+	}
+	if group.Tags[OWNER_TAG_NAME] != OWNER_TAG_VALUE {
+		fmt.Printf("Keeping resource group %s, which the broker did not create\n", resourceGroupName)
+		return nil
+	}
+
+	list, err := c.ResourceManagementClient.ListResources(resourceGroupName, "", 1)
+	if err != nil {
+		return wrapResponseError(list.Response, err)
+	}
+	if len(list.Value) > 0 {
+		fmt.Printf("Keeping resource group %s, which still holds resources\n", resourceGroupName)
+		return nil
+	}
+
+	r, err := c.ResourceManagementClient.Delete(resourceGroupName)
+	if err != nil && r.Response != nil && r.StatusCode != http.StatusAccepted {
+		return wrapResponseError(r, err)
+	}
+	fmt.Printf("Deletion initiated %s\n", resourceGroupName)
+	return nil
+}
+
+// resourceGroupTags describes the instances a resource group holds under the
+// naming strategy: the tags of the instance for a group of its own, where on
+// the platform the instances of a shared group live, and only the broker for
+// a fixed group, which serves everyone.
+func (c *AzureClient) resourceGroupTags(instance *model.ServiceInstance, instanceTags map[string]string) map[string]string {
+	tags := c.brokerTags()
+	switch c.Namer.templates.ResourceGroupStrategy {
+	case config.RESOURCE_GROUP_FIXED:
+		return tags
+	case config.RESOURCE_GROUP_PER_SPACE, config.RESOURCE_GROUP_PER_ORG:
+	default:
+		return instanceTags
+	}
+
+	for name, value := range platformTags(instance) {
+		tags[name] = value
+	}
+	if c.Namer.templates.ResourceGroupStrategy == config.RESOURCE_GROUP_PER_ORG {
+		delete(tags, "space_guid")
+		delete(tags, "space_name")
+		delete(tags, "namespace")
+	}
+	return truncateTags(tags)
+}
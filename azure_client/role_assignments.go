@@ -0,0 +1,156 @@
+package azure_client
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"strings"
+
+	storageclient "github.com/Azure/azure-sdk-for-go/storage"
+)
+
+const (
+	AUTHORIZATION_API_VERSION = "2022-04-01"
+
+	// Storage Blob Data Contributor, the built-in role which reads, writes
+	// and deletes blobs
+	STORAGE_BLOB_DATA_CONTRIBUTOR_ROLE_ID = "ba92f5b4-2d11-453d-a403-e96b0029c9fe"
+
+	// The binding parameter which names the Azure AD identity of the
+	// application, by its object ID
+	PRINCIPAL_ID_PARAMETER = "principal_id"
+
+	// Marks the role assignments of bindings, followed by the binding ID
+	ROLE_ASSIGNMENT_DESCRIPTION_PREFIX = "service binding "
+)
+
+// PrincipalIdSchema is the JSON schema of the principal_id parameter, which
+// the catalog adds to the binding schemas of the plans allowing it.
+var PrincipalIdSchema = map[string]interface{}{
+	"type":        "string",
+	"description": "The object ID of the Azure AD identity of the application, which is granted access to the container instead of receiving the account keys.",
+	"pattern":     "^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$",
+}
+
+// ContainerGrant is the role assignment through which the Azure AD identity
+// of a binding accesses its container.
+type ContainerGrant struct {
+	BindingId     string
+	ContainerName string
+	PrincipalId   string
+}
+
+type roleAssignment struct {
+	Name       string                   `json:"name,omitempty"`
+	Properties roleAssignmentProperties `json:"properties"`
+}
+
+type roleAssignmentProperties struct {
+	RoleDefinitionId string `json:"roleDefinitionId"`
+	PrincipalId      string `json:"principalId"`
+	Scope            string `json:"scope,omitempty"`
+	Description      string `json:"description,omitempty"`
+}
+
+type roleAssignmentList struct {
+	Value    []roleAssignment `json:"value"`
+	NextLink string           `json:"nextLink"`
+}
+
+// BindingPrincipal returns the principal_id parameter of a binding, or ""
+// if the binding receives the account keys.
+func BindingPrincipal(parameters interface{}) string {
+	param, _ := parameters.(map[string]interface{})
+	principalId, _ := param[PRINCIPAL_ID_PARAMETER].(string)
+	return principalId
+}
+
+// GrantContainerAccess creates the container if needed and assigns the
+// principal of the binding the Storage Blob Data Contributor role on it.
+// The assignment is named after the binding, so a retry finds it again.
+func (c *AzureClient) GrantContainerAccess(resourceGroupName, storageAccountName, containerName string, containerAccessType storageclient.ContainerAccessType, bindingId, principalId string) error {
+	err := c.createContainer(resourceGroupName, storageAccountName, containerName, containerAccessType)
+	if err != nil {
+		fmt.Printf("Creating storage container %s.%s.%s failed with error:\n%v\n", resourceGroupName, storageAccountName, containerName, err)
+		return err
+	}
+
+	assignment := roleAssignment{Properties: roleAssignmentProperties{
+		RoleDefinitionId: fmt.Sprintf("/subscriptions/%s/providers/Microsoft.Authorization/roleDefinitions/%s", c.ArmClient.SubscriptionId, STORAGE_BLOB_DATA_CONTRIBUTOR_ROLE_ID),
+		PrincipalId:      principalId,
+		Description:      ROLE_ASSIGNMENT_DESCRIPTION_PREFIX + bindingId,
+	}}
+	_, err = c.ArmClient.Send("PUT", c.roleAssignmentPath(resourceGroupName, storageAccountName, containerName, bindingId), nil, authorizationQueryParameters(), assignment, nil, http.StatusOK, http.StatusCreated)
+	if err != nil {
+		fmt.Printf("Granting principal %s access to container %s.%s.%s failed with error:\n%v\n", principalId, resourceGroupName, storageAccountName, containerName, err)
+		return err
+	}
+
+	fmt.Printf("Granted principal %s access to container %s.%s.%s\n", principalId, resourceGroupName, storageAccountName, containerName)
+	return nil
+}
+
+// RevokeContainerAccess deletes the role assignment of the binding.
+func (c *AzureClient) RevokeContainerAccess(resourceGroupName, storageAccountName, containerName, bindingId string) error {
+	_, err := c.ArmClient.Send("DELETE", c.roleAssignmentPath(resourceGroupName, storageAccountName, containerName, bindingId), nil, authorizationQueryParameters(), nil, nil, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		fmt.Printf("Revoking the access of service binding %s to container %s.%s.%s failed with error:\n%v\n", bindingId, resourceGroupName, storageAccountName, containerName, err)
+	}
+	return err
+}
+
+// ContainerGrants returns the role assignments of bindings on the containers
+// of the storage account.
+func (c *AzureClient) ContainerGrants(resourceGroupName, storageAccountName string) ([]ContainerGrant, error) {
+	containersScope := strings.ToLower(c.storageAccountId(resourceGroupName, storageAccountName) + "/blobServices/default/containers/")
+
+	var grants []ContainerGrant
+	path, query := c.storageAccountId(resourceGroupName, storageAccountName)+"/providers/Microsoft.Authorization/roleAssignments", authorizationQueryParameters()
+	for {
+		var list roleAssignmentList
+		_, err := c.ArmClient.Send("GET", path, nil, query, nil, &list, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, assignment := range list.Value {
+			properties := assignment.Properties
+			if !strings.HasPrefix(properties.Description, ROLE_ASSIGNMENT_DESCRIPTION_PREFIX) || !strings.HasPrefix(strings.ToLower(properties.Scope), containersScope) {
+				continue
+			}
+			grants = append(grants, ContainerGrant{
+				BindingId:     strings.TrimPrefix(properties.Description, ROLE_ASSIGNMENT_DESCRIPTION_PREFIX),
+				ContainerName: lastSegment(properties.Scope),
+				PrincipalId:   properties.PrincipalId,
+			})
+		}
+
+		if list.NextLink == "" {
+			return grants, nil
+		}
+		path, query, err = nextPage(list.NextLink)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *AzureClient) roleAssignmentPath(resourceGroupName, storageAccountName, containerName, bindingId string) string {
+	return fmt.Sprintf("%s/blobServices/default/containers/%s/providers/Microsoft.Authorization/roleAssignments/%s",
+		c.storageAccountId(resourceGroupName, storageAccountName), containerName, roleAssignmentName(bindingId))
+}
+
+// roleAssignmentName derives the GUID Azure requires as the name of a role
+// assignment from the binding ID, as a name-based UUID.
+func roleAssignmentName(bindingId string) string {
+	sum := sha1.Sum([]byte(bindingId))
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+func authorizationQueryParameters() map[string]interface{} {
+	return map[string]interface{}{
+		"api-version": AUTHORIZATION_API_VERSION,
+	}
+}
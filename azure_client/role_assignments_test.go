@@ -0,0 +1,58 @@
+package azure_client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestContainerGrants(t *testing.T) {
+	var assignments []roleAssignment
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "PUT" && strings.Contains(r.URL.Path, "/roleAssignments/"):
+			var assignment roleAssignment
+			json.NewDecoder(r.Body).Decode(&assignment)
+			assignment.Name = lastSegment(r.URL.Path)
+			assignment.Properties.Scope = r.URL.Path[:strings.Index(r.URL.Path, "/providers/Microsoft.Authorization")]
+			assignments = append(assignments, assignment)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("{}"))
+		case r.Method == "PUT":
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("{}"))
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/roleAssignments"):
+			// The assignments above the account are listed too
+			all := append([]roleAssignment{{Properties: roleAssignmentProperties{Scope: "/subscriptions/sub", Description: ROLE_ASSIGNMENT_DESCRIPTION_PREFIX + "other"}}}, assignments...)
+			json.NewEncoder(w).Encode(roleAssignmentList{Value: all})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code": "NotFound", "message": "not found"}`))
+		}
+	}))
+	defer server.Close()
+
+	arm := NewArmClientWithBaseUri(server.URL, "sub")
+	c := &AzureClient{ArmClient: &arm}
+
+	err := c.GrantContainerAccess("rg", "account", "data", "", "binding-1", "principal-id")
+	if err != nil {
+		t.Fatalf("granting access failed with %v\n", err)
+	}
+	if len(assignments) != 1 || !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-5[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(assignments[0].Name) ||
+		assignments[0].Name != roleAssignmentName("binding-1") || !strings.HasSuffix(assignments[0].Properties.RoleDefinitionId, STORAGE_BLOB_DATA_CONTRIBUTOR_ROLE_ID) {
+		t.Errorf("role assignments were %+v\n", assignments)
+	}
+
+	grants, err := c.ContainerGrants("rg", "account")
+	if err != nil {
+		t.Fatalf("listing the grants failed with %v\n", err)
+	}
+	if expected := []ContainerGrant{{BindingId: "binding-1", ContainerName: "data", PrincipalId: "principal-id"}}; !reflect.DeepEqual(grants, expected) {
+		t.Errorf("grants were %+v but expected %+v\n", grants, expected)
+	}
+}
@@ -0,0 +1,103 @@
+package azure_client
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+const (
+	HTTPS_ONLY_PARAMETER               = "https_only"
+	MINIMUM_TLS_VERSION_PARAMETER      = "minimum_tls_version"
+	ALLOW_BLOB_PUBLIC_ACCESS_PARAMETER = "allow_blob_public_access"
+	ALLOW_SHARED_KEY_ACCESS_PARAMETER  = "allow_shared_key_access"
+)
+
+// MinimumTlsVersions are the values Azure accepts for the minimum TLS version.
+var MinimumTlsVersions = []string{"TLS1_0", "TLS1_1", "TLS1_2"}
+
+// SecuritySettings are the security settings of a storage account. Nil and
+// empty settings are left as they are.
+type SecuritySettings struct {
+	HttpsOnly             *bool
+	MinimumTlsVersion     string
+	AllowBlobPublicAccess *bool
+	AllowSharedKeyAccess  *bool
+}
+
+// InstanceSecurity returns the security settings of the plan defaults,
+// overridden by the parameters. Without defaults only the parameters count,
+// as in an update which keeps the plan.
+func InstanceSecurity(defaults *model.ServicePlanMetadata, parameters interface{}) (SecuritySettings, error) {
+	var settings SecuritySettings
+	if defaults != nil {
+		settings = SecuritySettings{
+			HttpsOnly:             defaults.HttpsOnly,
+			MinimumTlsVersion:     defaults.MinimumTlsVersion,
+			AllowBlobPublicAccess: defaults.AllowBlobPublicAccess,
+			AllowSharedKeyAccess:  defaults.AllowSharedKeyAccess,
+		}
+	}
+
+	param, _ := parameters.(map[string]interface{})
+	for _, setting := range []struct {
+		name   string
+		target **bool
+	}{
+		{HTTPS_ONLY_PARAMETER, &settings.HttpsOnly},
+		{ALLOW_BLOB_PUBLIC_ACCESS_PARAMETER, &settings.AllowBlobPublicAccess},
+		{ALLOW_SHARED_KEY_ACCESS_PARAMETER, &settings.AllowSharedKeyAccess},
+	} {
+		raw, ok := param[setting.name]
+		if !ok || raw == nil {
+			continue
+		}
+		value, ok := raw.(bool)
+		if !ok {
+			return SecuritySettings{}, fmt.Errorf("%s must be true or false", setting.name)
+		}
+		*setting.target = &value
+	}
+
+	if raw, ok := param[MINIMUM_TLS_VERSION_PARAMETER]; ok && raw != nil {
+		value, _ := raw.(string)
+		if !isMinimumTlsVersion(value) {
+			return SecuritySettings{}, fmt.Errorf("%s must be one of %s", MINIMUM_TLS_VERSION_PARAMETER, strings.Join(MinimumTlsVersions, ", "))
+		}
+		settings.MinimumTlsVersion = value
+	}
+
+	return settings, nil
+}
+
+// BlocksPublicAccess reports whether the settings disable public access to
+// blobs, which makes public containers private.
+func (s SecuritySettings) BlocksPublicAccess() bool {
+	return s.AllowBlobPublicAccess != nil && !*s.AllowBlobPublicAccess
+}
+
+// apply sets the settings on the properties of a storage account.
+func (s SecuritySettings) apply(properties *StorageAccountProperties) {
+	if s.HttpsOnly != nil {
+		properties.EnableHttpsTrafficOnly = s.HttpsOnly
+	}
+	if s.MinimumTlsVersion != "" {
+		properties.MinimumTlsVersion = s.MinimumTlsVersion
+	}
+	if s.AllowBlobPublicAccess != nil {
+		properties.AllowBlobPublicAccess = s.AllowBlobPublicAccess
+	}
+	if s.AllowSharedKeyAccess != nil {
+		properties.AllowSharedKeyAccess = s.AllowSharedKeyAccess
+	}
+}
+
+func isMinimumTlsVersion(version string) bool {
+	for _, v := range MinimumTlsVersions {
+		if version == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package azure_client
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+func TestInstanceSecurity(t *testing.T) {
+	enabled, disabled := true, false
+	defaults := &model.ServicePlanMetadata{HttpsOnly: &enabled, MinimumTlsVersion: "TLS1_2", AllowBlobPublicAccess: &disabled}
+
+	for i, test := range []struct {
+		defaults      *model.ServicePlanMetadata
+		parameters    interface{}
+		expected      SecuritySettings
+		expectedError bool
+	}{
+		{nil, nil, SecuritySettings{}, false},
+		{defaults, nil, SecuritySettings{HttpsOnly: &enabled, MinimumTlsVersion: "TLS1_2", AllowBlobPublicAccess: &disabled}, false},
+		{
+			defaults,
+			map[string]interface{}{"minimum_tls_version": "TLS1_1", "allow_blob_public_access": true, "allow_shared_key_access": false},
+			SecuritySettings{HttpsOnly: &enabled, MinimumTlsVersion: "TLS1_1", AllowBlobPublicAccess: &enabled, AllowSharedKeyAccess: &disabled},
+			false,
+		},
+		{nil, map[string]interface{}{"https_only": false}, SecuritySettings{HttpsOnly: &disabled}, false},
+		{nil, map[string]interface{}{"https_only": "false"}, SecuritySettings{}, true},
+		{defaults, map[string]interface{}{"minimum_tls_version": "TLS1_3"}, SecuritySettings{}, true},
+	} {
+		settings, err := InstanceSecurity(test.defaults, test.parameters)
+		if (err != nil) != test.expectedError {
+			t.Errorf("Test %d: error was %v but expected error %v\n", i, err, test.expectedError)
+			continue
+		}
+		if !reflect.DeepEqual(settings, test.expected) {
+			t.Errorf("Test %d: settings were %+v but expected %+v\n", i, settings, test.expected)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package azure_client
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/Azure/azure-sdk-for-go/arm/storage"
+)
+
+const (
+	STORAGE_API_VERSION  = "2019-06-01"
+	STORAGE_ACCOUNT_PATH = "/subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/Microsoft.Storage/storageAccounts/{accountName}"
+
+	STORAGE_ACCOUNTS_PATH = "/subscriptions/{subscriptionId}/providers/Microsoft.Storage/storageAccounts"
+)
+
+type Sku struct {
+	Name string `json:"name"`
+	Tier string `json:"tier,omitempty"`
+}
+
+type StorageAccountProperties struct {
+	ProvisioningState      storage.ProvisioningState `json:"provisioningState,omitempty"`
+	AccessTier             string                    `json:"accessTier,omitempty"`
+	EnableHttpsTrafficOnly *bool                     `json:"supportsHttpsTrafficOnly,omitempty"`
+	MinimumTlsVersion      string                    `json:"minimumTlsVersion,omitempty"`
+	AllowBlobPublicAccess  *bool                     `json:"allowBlobPublicAccess,omitempty"`
+	AllowSharedKeyAccess   *bool                     `json:"allowSharedKeyAccess,omitempty"`
+	NetworkRuleSet         *NetworkRuleSet           `json:"networkAcls,omitempty"`
+	PrimaryEndpoints       map[string]string         `json:"primaryEndpoints,omitempty"`
+	CreationTime           string                    `json:"creationTime,omitempty"`
+	// Only returned by PRIVATE_LINK_STORAGE_API_VERSION
+	PublicNetworkAccess string `json:"publicNetworkAccess,omitempty"`
+}
+
+// StorageAccount is a storage account as described by STORAGE_API_VERSION,
+// which adds SKU, kind and access tier to the vendored model.
+type StorageAccount struct {
+	Id         string                   `json:"id,omitempty"`
+	Name       string                   `json:"name,omitempty"`
+	Location   string                   `json:"location,omitempty"`
+	Kind       string                   `json:"kind,omitempty"`
+	Sku        *Sku                     `json:"sku,omitempty"`
+	Tags       map[string]string        `json:"tags,omitempty"`
+	Properties StorageAccountProperties `json:"properties,omitempty"`
+}
+
+type storageAccountList struct {
+	Value    []StorageAccount `json:"value"`
+	NextLink string           `json:"nextLink"`
+}
+
+type StorageAccountUpdateParameters struct {
+	Sku        *Sku                     `json:"sku,omitempty"`
+	Kind       string                   `json:"kind,omitempty"`
+	Tags       map[string]string        `json:"tags,omitempty"`
+	Properties StorageAccountProperties `json:"properties,omitempty"`
+}
+
+func (client ArmClient) CreateStorageAccount(resourceGroupName, accountName string, parameters StorageAccount) error {
+	_, err := client.Send("PUT", STORAGE_ACCOUNT_PATH,
+		storageAccountPathParameters(resourceGroupName, accountName),
+		storageQueryParameters(),
+		parameters, nil,
+		http.StatusOK, http.StatusAccepted)
+	return err
+}
+
+func (client ArmClient) GetStorageAccount(resourceGroupName, accountName string) (StorageAccount, error) {
+	var account StorageAccount
+	_, err := client.Send("GET", STORAGE_ACCOUNT_PATH,
+		storageAccountPathParameters(resourceGroupName, accountName),
+		storageQueryParameters(),
+		nil, &account,
+		http.StatusOK)
+	return account, err
+}
+
+func (client ArmClient) UpdateStorageAccount(resourceGroupName, accountName string, parameters StorageAccountUpdateParameters) error {
+	_, err := client.Send("PATCH", STORAGE_ACCOUNT_PATH,
+		storageAccountPathParameters(resourceGroupName, accountName),
+		storageQueryParameters(),
+		parameters, nil,
+		http.StatusOK)
+	return err
+}
+
+// ListStorageAccounts returns every storage account of the subscription,
+// following the pages of the response.
+func (client ArmClient) ListStorageAccounts() ([]StorageAccount, error) {
+	var accounts []StorageAccount
+	path, query := STORAGE_ACCOUNTS_PATH, storageQueryParameters()
+	for {
+		var list storageAccountList
+		_, err := client.Send("GET", path, nil, query, nil, &list, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, list.Value...)
+
+		if list.NextLink == "" {
+			return accounts, nil
+		}
+		path, query, err = nextPage(list.NextLink)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// nextPage returns the path and query of the next page of a list.
+func nextPage(nextLink string) (string, map[string]interface{}, error) {
+	next, err := url.Parse(nextLink)
+	if err != nil {
+		return "", nil, err
+	}
+	query := make(map[string]interface{})
+	for name := range next.Query() {
+		query[name] = next.Query().Get(name)
+	}
+	return next.Path, query, nil
+}
+
+func storageAccountPathParameters(resourceGroupName, accountName string) map[string]interface{} {
+	return map[string]interface{}{
+		"resourceGroupName": resourceGroupName,
+		"accountName":       accountName,
+	}
+}
+
+func storageQueryParameters() map[string]interface{} {
+	return map[string]interface{}{
+		"api-version": STORAGE_API_VERSION,
+	}
+}
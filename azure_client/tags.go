@@ -0,0 +1,155 @@
+package azure_client
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/bingosummer/azure_storage_service_broker/config"
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+const (
+	// The limit of Azure on the tags of one resource
+	MAX_TAGS = 50
+
+	// The parameter users pass their own tags in
+	TAGS_PARAMETER = "tags"
+)
+
+// TagsSchema is the JSON schema of the tags parameter, which the catalog adds
+// to the plans allowing it. Numbers are float64, as JSON decodes them.
+var TagsSchema = map[string]interface{}{
+	"type":        "object",
+	"description": "Your own tags on the storage account, as tag names and string values.",
+	"additionalProperties": map[string]interface{}{
+		"type":      "string",
+		"maxLength": float64(config.MAX_TAG_VALUE_LENGTH),
+	},
+}
+
+// StandardTagNames are the tags the broker sets on the resources it creates,
+// which neither operators nor users can set.
+var StandardTagNames = []string{
+	OWNER_TAG_NAME, "broker_id", "instance_id", "plan_id", "plan_name", "platform",
+	"organization_guid", "organization_name", "space_guid", "space_name",
+	"namespace", "cluster_id", "created_by",
+}
+
+// UserTags returns the tags in the tags parameter, checked against the rules
+// of Azure, the standard tags and the tags of the operator.
+func UserTags(parameters interface{}, operatorTags map[string]string) (map[string]string, error) {
+	param, _ := parameters.(map[string]interface{})
+	raw, ok := param[TAGS_PARAMETER]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	object, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("tags must be an object of tag names and values")
+	}
+
+	var names []string
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tags := make(map[string]string)
+	for _, name := range names {
+		value, ok := object[name].(string)
+		if !ok {
+			return nil, fmt.Errorf("the value of tag %s must be a string", name)
+		}
+		if IsStandardTag(name) {
+			return nil, fmt.Errorf("tag %s is set by the broker", name)
+		}
+		if _, ok := operatorTags[name]; ok {
+			return nil, fmt.Errorf("tag %s is set by the operator", name)
+		}
+		if err := config.ValidateTag(name, value); err != nil {
+			return nil, err
+		}
+		tags[name] = value
+	}
+
+	if limit := MAX_TAGS - len(StandardTagNames) - len(operatorTags); len(tags) > limit {
+		return nil, fmt.Errorf("at most %d tags can be set", limit)
+	}
+	return tags, nil
+}
+
+// IsStandardTag reports whether the broker sets the tag itself.
+func IsStandardTag(name string) bool {
+	for _, standard := range StandardTagNames {
+		if name == standard {
+			return true
+		}
+	}
+	return false
+}
+
+// brokerTags are the tags of every resource the broker creates.
+func (c *AzureClient) brokerTags() map[string]string {
+	tags := map[string]string{"broker_id": c.brokerId}
+	for name, value := range c.operatorTags {
+		if !IsStandardTag(name) {
+			tags[name] = value
+		}
+	}
+	return tags
+}
+
+// instanceTags are the tags of the storage account of an instance: the
+// standard and operator tags, and the tags the user asked for.
+func (c *AzureClient) instanceTags(instance *model.ServiceInstance, plan *model.ServicePlan, userTags map[string]string) map[string]string {
+	tags := make(map[string]string)
+	for name, value := range userTags {
+		tags[name] = value
+	}
+	for name, value := range c.brokerTags() {
+		tags[name] = value
+	}
+	for name, value := range platformTags(instance) {
+		tags[name] = value
+	}
+
+	tags["instance_id"] = instance.Id
+	tags["plan_id"] = plan.Id
+	tags["plan_name"] = plan.Name
+	if user := instance.OriginatingIdentity.User(); user != "" {
+		tags["created_by"] = user
+	}
+
+	return truncateTags(tags)
+}
+
+// truncateTags shortens values, such as long names, which Azure would reject.
+// Azure counts characters, so values are cut between them.
+func truncateTags(tags map[string]string) map[string]string {
+	for name, value := range tags {
+		if runes := []rune(value); len(runes) > config.MAX_TAG_VALUE_LENGTH {
+			tags[name] = string(runes[:config.MAX_TAG_VALUE_LENGTH])
+		}
+	}
+	return tags
+}
+
+// TagInstance tags the storage account of the instance anew, as for new
+// organization or space names, and changes nothing else.
+func (c *AzureClient) TagInstance(instance *model.ServiceInstance, plan *model.ServicePlan) error {
+	userTags, err := UserTags(instance.Parameters, c.operatorTags)
+	if err != nil {
+		return err
+	}
+
+	up := StorageAccountUpdateParameters{Tags: c.instanceTags(instance, plan, userTags)}
+	err = c.ArmClient.UpdateStorageAccount(instance.ResourceGroupName, instance.StorageAccountName, up)
+	if err != nil {
+		fmt.Printf("Tagging %s.%s failed with error:\n%v\n", instance.ResourceGroupName, instance.StorageAccountName, err)
+		return err
+	}
+
+	fmt.Printf("Tagging of %s.%s succeeded\n", instance.ResourceGroupName, instance.StorageAccountName)
+	return nil
+}
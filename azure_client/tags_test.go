@@ -0,0 +1,78 @@
+package azure_client
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+func TestUserTags(t *testing.T) {
+	tooMany := make(map[string]interface{})
+	for i := 0; i < MAX_TAGS; i++ {
+		tooMany[fmt.Sprintf("tag%d", i)] = "value"
+	}
+
+	for i, test := range []struct {
+		parameters interface{}
+		expected   map[string]string
+		err        string
+	}{
+		{nil, nil, ""},
+		{map[string]interface{}{"sku": "Standard_LRS"}, nil, ""},
+		{map[string]interface{}{"tags": map[string]interface{}{"project": "apollo"}}, map[string]string{"project": "apollo"}, ""},
+		{map[string]interface{}{"tags": "project=apollo"}, nil, "tags must be an object"},
+		{map[string]interface{}{"tags": map[string]interface{}{"project": 1.0}}, nil, "must be a string"},
+		{map[string]interface{}{"tags": map[string]interface{}{"instance_id": "mine"}}, nil, "set by the broker"},
+		{map[string]interface{}{"tags": map[string]interface{}{"cost_center": "mine"}}, nil, "set by the operator"},
+		{map[string]interface{}{"tags": map[string]interface{}{"a/b": "value"}}, nil, "must not contain"},
+		{map[string]interface{}{"tags": map[string]interface{}{"Microsoft.Owner": "value"}}, nil, "reserves"},
+		{map[string]interface{}{"tags": tooMany}, nil, "at most"},
+		// Azure counts characters rather than bytes
+		{map[string]interface{}{"tags": map[string]interface{}{"owner": strings.Repeat("ü", 256)}}, map[string]string{"owner": strings.Repeat("ü", 256)}, ""},
+		{map[string]interface{}{"tags": map[string]interface{}{"owner": strings.Repeat("ü", 257)}}, nil, "longer than"},
+	} {
+		tags, err := UserTags(test.parameters, map[string]string{"cost_center": "42"})
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("Test %d: error was %v but expected %q\n", i, err, test.err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(tags, test.expected) && len(tags)+len(test.expected) > 0 {
+			t.Errorf("Test %d: tags were %v but expected %v\n", i, tags, test.expected)
+		}
+	}
+}
+
+func TestInstanceTags(t *testing.T) {
+	c := &AzureClient{brokerId: "broker", operatorTags: map[string]string{"cost_center": "42", "platform": "ignored"}}
+	instance := &model.ServiceInstance{
+		Id:                  instanceId,
+		OrganizationGuid:    "org-guid",
+		SpaceGuid:           "space-guid",
+		Context:             &model.Context{OrganizationName: strings.Repeat("ü", 300), SpaceName: strings.Repeat("s", 300)},
+		OriginatingIdentity: &model.OriginatingIdentity{Platform: "cloudfoundry", Value: map[string]interface{}{"user_id": "user-guid"}},
+	}
+	plan := &model.ServicePlan{Id: "plan-guid", Name: "standard"}
+
+	tags := c.instanceTags(instance, plan, map[string]string{"project": "apollo"})
+
+	expected := map[string]string{
+		"broker_id":         "broker",
+		"cost_center":       "42",
+		"project":           "apollo",
+		"instance_id":       instanceId,
+		"plan_id":           "plan-guid",
+		"plan_name":         "standard",
+		"platform":          "cloudfoundry",
+		"organization_guid": "org-guid",
+		"organization_name": strings.Repeat("ü", 256),
+		"space_guid":        "space-guid",
+		"space_name":        strings.Repeat("s", 256),
+		"created_by":        "user-guid",
+	}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Errorf("tags were %v but expected %v\n", tags, expected)
+	}
+}
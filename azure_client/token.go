@@ -0,0 +1,156 @@
+package azure_client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+
+	"github.com/bingosummer/azure_storage_service_broker/config"
+)
+
+const (
+	TOKEN_REFRESH_WITHIN = 5 * time.Minute
+	TOKEN_TIMEOUT        = 30 * time.Second
+)
+
+// TokenSource fetches new tokens with one authentication method.
+type TokenSource interface {
+	Method() string
+	Token() (azure.Token, error)
+}
+
+// NewTokenSource returns the token source of the configured authentication
+// method. The tokens are for the environment's Azure Resource Manager.
+func NewTokenSource(env Environment, c config.AzureConfig) (TokenSource, error) {
+	client := &http.Client{Timeout: TOKEN_TIMEOUT}
+
+	switch c.AuthMethod {
+	case config.AUTH_CLIENT_SECRET, "":
+		return &clientSecretSource{client: client, endpoint: env.tokenEndpoint(c.TenantId), resource: env.TokenAudience, clientId: c.ClientId, clientSecret: c.ClientSecret}, nil
+	case config.AUTH_CLIENT_CERTIFICATE:
+		certificate, err := loadClientCertificate(c.ClientCertificatePath)
+		if err != nil {
+			return nil, fmt.Errorf("%s authentication failed: %v", c.AuthMethod, err)
+		}
+		return &clientCertificateSource{client: client, endpoint: env.tokenEndpoint(c.TenantId), resource: env.TokenAudience, clientId: c.ClientId, certificate: certificate}, nil
+	case config.AUTH_MANAGED_IDENTITY:
+		endpoint := c.ImdsEndpoint
+		if endpoint == "" {
+			endpoint = IMDS_TOKEN_ENDPOINT
+		}
+		return &managedIdentitySource{client: client, endpoint: endpoint, resource: env.TokenAudience, clientId: c.ClientId}, nil
+	case config.AUTH_WORKLOAD_IDENTITY:
+		return &workloadIdentitySource{client: client, endpoint: env.tokenEndpoint(c.TenantId), resource: env.TokenAudience, clientId: c.ClientId, tokenFile: c.FederatedTokenFile}, nil
+	}
+	return nil, fmt.Errorf("unknown Azure authentication method %q", c.AuthMethod)
+}
+
+// RefreshingToken authorizes requests with the tokens of a source, fetching
+// a new one before the current one expires. The vendored
+// azure.ServicePrincipalToken only knows client secrets in the public cloud.
+type RefreshingToken struct {
+	mutex  sync.Mutex
+	token  azure.Token
+	source TokenSource
+}
+
+func NewRefreshingToken(source TokenSource) *RefreshingToken {
+	return &RefreshingToken{source: source}
+}
+
+func (t *RefreshingToken) WithAuthorization() autorest.PrepareDecorator {
+	return func(p autorest.Preparer) autorest.Preparer {
+		return autorest.PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			accessToken, err := t.accessToken()
+			if err != nil {
+				return r, err
+			}
+			return autorest.WithBearerAuthorization(accessToken)(p).Prepare(r)
+		})
+	}
+}
+
+func (t *RefreshingToken) accessToken() (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.token.WillExpireIn(TOKEN_REFRESH_WITHIN) {
+		token, err := t.source.Token()
+		if err != nil {
+			return "", fmt.Errorf("%s authentication failed: %v", t.source.Method(), err)
+		}
+		t.token = token
+	}
+	return t.token.AccessToken, nil
+}
+
+// requestToken posts an OAuth form and decodes the token in the response.
+func requestToken(client *http.Client, request *http.Request) (azure.Token, error) {
+	var token azure.Token
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return token, fmt.Errorf("requesting a token from %s failed: %v", request.URL.Host, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return token, fmt.Errorf("requesting a token from %s failed with status %s: %s %s", request.URL.Host, resp.Status, e.Error, e.Description)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return token, fmt.Errorf("the token from %s is invalid: %v", request.URL.Host, err)
+	}
+	if token.AccessToken == "" {
+		return token, fmt.Errorf("the response from %s has no access token", request.URL.Host)
+	}
+	return token, nil
+}
+
+func postForm(endpoint string, form url.Values) (*http.Request, error) {
+	request, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return request, nil
+}
+
+// clientSecretSource authenticates as a service principal with a secret.
+type clientSecretSource struct {
+	client       *http.Client
+	endpoint     string
+	resource     string
+	clientId     string
+	clientSecret string
+}
+
+func (s *clientSecretSource) Method() string {
+	return config.AUTH_CLIENT_SECRET
+}
+
+func (s *clientSecretSource) Token() (azure.Token, error) {
+	request, err := postForm(s.endpoint, url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {s.clientId},
+		"client_secret": {s.clientSecret},
+		"resource":      {s.resource},
+	})
+	if err != nil {
+		return azure.Token{}, err
+	}
+	return requestToken(s.client, request)
+}
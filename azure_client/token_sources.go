@@ -0,0 +1,208 @@
+package azure_client
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+
+	"github.com/bingosummer/azure_storage_service_broker/config"
+)
+
+const (
+	IMDS_TOKEN_ENDPOINT = "http://169.254.169.254/metadata/identity/oauth2/token"
+	IMDS_API_VERSION    = "2018-02-01"
+
+	CLIENT_ASSERTION_TYPE     = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	CLIENT_ASSERTION_LIFETIME = 10 * time.Minute
+)
+
+// clientCertificate is a certificate registered with a service principal and
+// its private key.
+type clientCertificate struct {
+	certificate *x509.Certificate
+	key         *rsa.PrivateKey
+}
+
+func loadClientCertificate(path string) (*clientCertificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading the client certificate failed: %v", err)
+	}
+
+	var c clientCertificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "CERTIFICATE":
+			if c.certificate == nil {
+				c.certificate, err = x509.ParseCertificate(block.Bytes)
+			}
+		case "RSA PRIVATE KEY":
+			c.key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			var key interface{}
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+			if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+				c.key = rsaKey
+			} else if err == nil {
+				err = fmt.Errorf("the private key is not an RSA key")
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("the client certificate %s is invalid: %v", path, err)
+		}
+	}
+
+	if c.certificate == nil || c.key == nil {
+		return nil, fmt.Errorf("the client certificate %s must contain a certificate and an unencrypted RSA private key", path)
+	}
+	return &c, nil
+}
+
+// assertion returns a JWT for the audience signed with the private key, which
+// Azure AD accepts instead of a client secret.
+func (c *clientCertificate) assertion(clientId, audience string) (string, error) {
+	thumbprint := sha1.Sum(c.certificate.Raw)
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"x5t": base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+	})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": audience,
+		"iss": clientId,
+		"sub": clientId,
+		"jti": hex.EncodeToString(jti),
+		"nbf": now.Unix(),
+		"exp": now.Add(CLIENT_ASSERTION_LIFETIME).Unix(),
+	})
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("signing the client assertion failed: %v", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// clientCertificateSource authenticates as a service principal with a
+// certificate.
+type clientCertificateSource struct {
+	client      *http.Client
+	endpoint    string
+	resource    string
+	clientId    string
+	certificate *clientCertificate
+}
+
+func (s *clientCertificateSource) Method() string {
+	return config.AUTH_CLIENT_CERTIFICATE
+}
+
+func (s *clientCertificateSource) Token() (azure.Token, error) {
+	assertion, err := s.certificate.assertion(s.clientId, s.endpoint)
+	if err != nil {
+		return azure.Token{}, err
+	}
+
+	request, err := postForm(s.endpoint, url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {s.clientId},
+		"client_assertion_type": {CLIENT_ASSERTION_TYPE},
+		"client_assertion":      {assertion},
+		"resource":              {s.resource},
+	})
+	if err != nil {
+		return azure.Token{}, err
+	}
+	return requestToken(s.client, request)
+}
+
+// managedIdentitySource authenticates as the managed identity of the VM or
+// container the broker runs on, through the instance metadata service.
+type managedIdentitySource struct {
+	client   *http.Client
+	endpoint string
+	resource string
+	clientId string
+}
+
+func (s *managedIdentitySource) Method() string {
+	return config.AUTH_MANAGED_IDENTITY
+}
+
+func (s *managedIdentitySource) Token() (azure.Token, error) {
+	query := url.Values{
+		"api-version": {IMDS_API_VERSION},
+		"resource":    {s.resource},
+	}
+	if s.clientId != "" {
+		query.Set("client_id", s.clientId)
+	}
+
+	request, err := http.NewRequest("GET", s.endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return azure.Token{}, err
+	}
+	request.Header.Set("Metadata", "true")
+	return requestToken(s.client, request)
+}
+
+// workloadIdentitySource exchanges the service account token which the
+// platform keeps in a file for a token of the federated application.
+type workloadIdentitySource struct {
+	client    *http.Client
+	endpoint  string
+	resource  string
+	clientId  string
+	tokenFile string
+}
+
+func (s *workloadIdentitySource) Method() string {
+	return config.AUTH_WORKLOAD_IDENTITY
+}
+
+func (s *workloadIdentitySource) Token() (azure.Token, error) {
+	// The platform rotates the file, so it is read for every token
+	data, err := ioutil.ReadFile(s.tokenFile)
+	if err != nil {
+		return azure.Token{}, fmt.Errorf("reading the federated token failed: %v", err)
+	}
+	assertion := strings.TrimSpace(string(data))
+	if assertion == "" {
+		return azure.Token{}, fmt.Errorf("the federated token file %s is empty", s.tokenFile)
+	}
+
+	request, err := postForm(s.endpoint, url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {s.clientId},
+		"client_assertion_type": {CLIENT_ASSERTION_TYPE},
+		"client_assertion":      {assertion},
+		"resource":              {s.resource},
+	})
+	if err != nil {
+		return azure.Token{}, err
+	}
+	return requestToken(s.client, request)
+}
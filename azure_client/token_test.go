@@ -0,0 +1,173 @@
+package azure_client
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bingosummer/azure_storage_service_broker/config"
+)
+
+// tokenStandIn plays Azure AD and the instance metadata service. It issues a
+// token named after the credential it was given.
+func tokenStandIn(key *rsa.PrivateKey) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var credential string
+		switch {
+		case r.URL.Path == "/metadata/identity/oauth2/token":
+			if r.Header.Get("Metadata") != "true" || r.URL.Query().Get("resource") != "https://management.azure.com/" {
+				http.Error(w, `{"error": "invalid_request"}`, http.StatusBadRequest)
+				return
+			}
+			credential = "identity-" + r.URL.Query().Get("client_id")
+		case r.URL.Path == "/tenant-id/oauth2/token":
+			r.ParseForm()
+			if r.PostForm.Get("client_id") != "client-id" || r.PostForm.Get("resource") != "https://management.azure.com/" {
+				http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+				return
+			}
+			credential = r.PostForm.Get("client_secret")
+			if assertion := r.PostForm.Get("client_assertion"); assertion != "" {
+				credential = assertion
+				if parts := strings.Split(assertion, "."); len(parts) == 3 {
+					signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+					digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+					if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature) == nil {
+						credential = "signed-assertion"
+					}
+				}
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token": "token-for-%s", "expires_on": "%d", "token_type": "Bearer"}`, credential, time.Now().Add(time.Hour).Unix())
+	})
+}
+
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTokenSources(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "broker"}, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certificate := writeTestFile(t, dir, "client.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))+
+		string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})))
+	keyOnly := writeTestFile(t, dir, "key.pem", string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})))
+	federated := writeTestFile(t, dir, "federated", "service-account-token\n")
+
+	server := httptest.NewServer(tokenStandIn(key))
+	defer server.Close()
+
+	env := environments["AzurePublicCloud"]
+	env.ActiveDirectoryEndpoint = server.URL + "/"
+	base := config.AzureConfig{TenantId: "tenant-id", ClientId: "client-id", ImdsEndpoint: server.URL + "/metadata/identity/oauth2/token"}
+
+	for i, test := range []struct {
+		update   func(c *config.AzureConfig)
+		expected string
+		failure  string
+	}{
+		{func(c *config.AzureConfig) { c.AuthMethod, c.ClientSecret = config.AUTH_CLIENT_SECRET, "secret" }, "token-for-secret", ""},
+		{func(c *config.AzureConfig) { c.AuthMethod, c.ClientId = config.AUTH_CLIENT_SECRET, "other-id" }, "", "client_secret authentication failed"},
+		{func(c *config.AzureConfig) {
+			c.AuthMethod, c.ClientCertificatePath = config.AUTH_CLIENT_CERTIFICATE, certificate
+		}, "token-for-signed-assertion", ""},
+		{func(c *config.AzureConfig) {
+			c.AuthMethod, c.ClientCertificatePath = config.AUTH_CLIENT_CERTIFICATE, keyOnly
+		}, "", "client_certificate authentication failed"},
+		{func(c *config.AzureConfig) { c.AuthMethod, c.ClientId = config.AUTH_MANAGED_IDENTITY, "" }, "token-for-identity-", ""},
+		{func(c *config.AzureConfig) { c.AuthMethod = config.AUTH_MANAGED_IDENTITY }, "token-for-identity-client-id", ""},
+		{func(c *config.AzureConfig) {
+			c.AuthMethod, c.ImdsEndpoint = config.AUTH_MANAGED_IDENTITY, server.URL+"/missing"
+		}, "", "managed_identity authentication failed"},
+		{func(c *config.AzureConfig) {
+			c.AuthMethod, c.FederatedTokenFile = config.AUTH_WORKLOAD_IDENTITY, federated
+		}, "token-for-service-account-token", ""},
+		{func(c *config.AzureConfig) {
+			c.AuthMethod, c.FederatedTokenFile = config.AUTH_WORKLOAD_IDENTITY, filepath.Join(dir, "missing")
+		}, "", "workload_identity authentication failed"},
+	} {
+		c := base
+		test.update(&c)
+
+		var accessToken string
+		source, err := NewTokenSource(env, c)
+		if err == nil {
+			accessToken, err = NewRefreshingToken(source).accessToken()
+		}
+
+		if test.failure != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.failure) {
+				t.Errorf("Test %d: error was %v but expected %q\n", i, err, test.failure)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: getting a token failed with %v\n", i, err)
+			continue
+		}
+		if accessToken != test.expected {
+			t.Errorf("Test %d: access token was %q but expected %q\n", i, accessToken, test.expected)
+		}
+	}
+}
+
+func TestRefreshingTokenAuthorization(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintf(w, `{"access_token": "token-%d", "expires_on": "%d"}`, requests, time.Now().Add(time.Hour).Unix())
+	}))
+	defer server.Close()
+
+	token := NewRefreshingToken(&managedIdentitySource{client: http.DefaultClient, endpoint: server.URL, resource: "resource"})
+	for i := 0; i < 2; i++ {
+		r, err := token.WithAuthorization()(nilPreparer{}).Prepare(&http.Request{Header: http.Header{}})
+		if err != nil {
+			t.Fatalf("authorizing failed with %v\n", err)
+		}
+		if h := r.Header.Get("Authorization"); h != "Bearer token-1" {
+			t.Errorf("Test %d: authorization was %q but expected the cached token\n", i, h)
+		}
+	}
+}
+
+type nilPreparer struct{}
+
+func (nilPreparer) Prepare(r *http.Request) (*http.Request, error) {
+	return r, nil
+}
@@ -0,0 +1,53 @@
+package azure_client
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const (
+	STORAGE_USAGES_PATH = "/subscriptions/{subscriptionId}/providers/Microsoft.Storage/locations/{location}/usages"
+
+	// The usage which counts the storage accounts of a region
+	STORAGE_ACCOUNTS_USAGE = "StorageAccounts"
+)
+
+// Usage is the consumption of a subscription quota in a region.
+type Usage struct {
+	Name struct {
+		Value string `json:"value"`
+	} `json:"name"`
+	CurrentValue int `json:"currentValue"`
+	Limit        int `json:"limit"`
+}
+
+type usageList struct {
+	Value []Usage `json:"value"`
+}
+
+func (client ArmClient) ListStorageUsages(location string) ([]Usage, error) {
+	var usages usageList
+	_, err := client.Send("GET", STORAGE_USAGES_PATH,
+		map[string]interface{}{"location": location},
+		storageQueryParameters(),
+		nil, &usages,
+		http.StatusOK)
+	return usages.Value, err
+}
+
+// StorageAccountUsage returns how many storage accounts the subscription has
+// in the location and how many it may have.
+func (c *AzureClient) StorageAccountUsage(location string) (int, int, error) {
+	usages, err := c.ArmClient.ListStorageUsages(location)
+	if err != nil {
+		fmt.Printf("Getting the storage usage of %s failed with error:\n%v\n", location, err)
+		return 0, 0, err
+	}
+
+	for _, usage := range usages {
+		if usage.Name.Value == STORAGE_ACCOUNTS_USAGE {
+			return usage.CurrentValue, usage.Limit, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("the storage usage of %s does not count storage accounts", location)
+}
@@ -0,0 +1,143 @@
+package broker_error
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	ac "github.com/bingosummer/azure_storage_service_broker/azure_client"
+	"github.com/bingosummer/azure_storage_service_broker/utils"
+)
+
+const (
+	// The description of internal errors, whose detail is only logged
+	INTERNAL_ERROR_DESCRIPTION = "The broker failed to serve the request, its log has the details"
+
+	// How many seconds the platform is asked to wait when Azure throttles
+	// the broker without saying for how long
+	DEFAULT_RETRY_AFTER = "30"
+)
+
+// BrokerError is a failure which is reported to the platform as an OSB error
+// response.
+type BrokerError struct {
+	StatusCode  int
+	ErrorCode   string
+	Description string
+	// Seconds to wait before retrying, sent as the Retry-After header
+	RetryAfter string
+}
+
+func (e *BrokerError) Error() string {
+	if e.ErrorCode == "" {
+		return fmt.Sprintf("%d: %s", e.StatusCode, e.Description)
+	}
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.ErrorCode, e.Description)
+}
+
+func New(statusCode int, errorCode, description string) *BrokerError {
+	return &BrokerError{
+		StatusCode:  statusCode,
+		ErrorCode:   errorCode,
+		Description: description,
+	}
+}
+
+func BadRequest(description string) *BrokerError {
+	return New(http.StatusBadRequest, "", description)
+}
+
+func InvalidParameters(err error) *BrokerError {
+	return New(http.StatusBadRequest, "InvalidParameters", err.Error())
+}
+
+func Unauthorized(err error) *BrokerError {
+	return New(http.StatusUnauthorized, "", err.Error())
+}
+
+func NotFound(description string) *BrokerError {
+	return New(http.StatusNotFound, "", description)
+}
+
+func AsyncRequired() *BrokerError {
+	return New(http.StatusUnprocessableEntity, "AsyncRequired", "This service plan requires client support for asynchronous service operations.")
+}
+
+func MaintenanceInfoConflict(description string) *BrokerError {
+	return New(http.StatusUnprocessableEntity, "MaintenanceInfoConflict", description)
+}
+
+// ConcurrencyError rejects a request while another operation changes the
+// same resource.
+func ConcurrencyError(description string) *BrokerError {
+	return New(http.StatusUnprocessableEntity, "ConcurrencyError", description)
+}
+
+func RegionNotAllowed(description string) *BrokerError {
+	return New(http.StatusBadRequest, "RegionNotAllowed", description)
+}
+
+func QuotaExceeded(description string) *BrokerError {
+	return New(http.StatusUnprocessableEntity, "QuotaExceeded", description)
+}
+
+// Unavailable asks the platform to retry the request after a while.
+func Unavailable(description, retryAfter string) *BrokerError {
+	if retryAfter == "" {
+		retryAfter = DEFAULT_RETRY_AFTER
+	}
+	brokerError := New(http.StatusServiceUnavailable, "", description)
+	brokerError.RetryAfter = retryAfter
+	return brokerError
+}
+
+// Internal reports an unexpected failure. Its detail may expose the internals
+// of the broker, so it is logged, and the platform gets a generic description.
+func Internal(err error) *BrokerError {
+	fmt.Printf("Internal error: %v\n", err)
+	return New(http.StatusInternalServerError, "", INTERNAL_ERROR_DESCRIPTION)
+}
+
+// FromAzureError maps an error returned by the azure_client package to the
+// HTTP status and OSB error body which describe it best.
+func FromAzureError(err error) *BrokerError {
+	switch e := err.(type) {
+	case *BrokerError:
+		return e
+	case ac.NameUnavailableError:
+		return New(http.StatusConflict, "NameUnavailable", e.Error())
+	case ac.ServiceError:
+		switch {
+		case e.StatusCode == http.StatusTooManyRequests:
+			return Unavailable("Azure is throttling the requests of the broker: "+e.Message, e.RetryAfter)
+		case strings.Contains(e.Code, "Quota"):
+			return QuotaExceeded("The Azure subscription has no capacity left: " + e.Message)
+		case e.Code == "AuthorizationFailed" || e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+			return New(http.StatusInternalServerError, "AuthorizationFailed", "The broker is not authorized to perform the operation in Azure: "+e.Message)
+		case e.StatusCode == http.StatusNotFound:
+			return New(http.StatusNotFound, "NotFound", e.Message)
+		case e.StatusCode == http.StatusConflict:
+			return New(http.StatusConflict, e.Code, e.Message)
+		case e.StatusCode >= 400 && e.StatusCode < 500:
+			return New(http.StatusBadRequest, e.Code, e.Message)
+		}
+	}
+
+	return Internal(err)
+}
+
+// IsNotFound reports whether the error means that the Azure resource does not
+// exist.
+func IsNotFound(err error) bool {
+	return FromAzureError(err).StatusCode == http.StatusNotFound
+}
+
+// Write sends the error as an OSB error response.
+func Write(w http.ResponseWriter, err error) {
+	brokerError := FromAzureError(err)
+	fmt.Printf("Error: %v\n", brokerError)
+	if brokerError.RetryAfter != "" {
+		w.Header().Set("Retry-After", brokerError.RetryAfter)
+	}
+	utils.WriteErrorResponse(w, brokerError.StatusCode, brokerError.ErrorCode, brokerError.Description)
+}
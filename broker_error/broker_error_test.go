@@ -0,0 +1,83 @@
+package broker_error
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ac "github.com/bingosummer/azure_storage_service_broker/azure_client"
+)
+
+func TestFromAzureError(t *testing.T) {
+	for i, test := range []struct {
+		err                error
+		expectedStatusCode int
+		expectedErrorCode  string
+	}{
+		{ac.NameUnavailableError{Name: "cf0123"}, http.StatusConflict, "NameUnavailable"},
+		{ac.ServiceError{StatusCode: 409, Code: "StorageAccountCountQuotaExceeded"}, http.StatusUnprocessableEntity, "QuotaExceeded"},
+		{ac.ServiceError{StatusCode: 429, Code: "TooManyRequests"}, http.StatusServiceUnavailable, ""},
+		{ac.ServiceError{StatusCode: 403, Code: "AuthorizationFailed"}, http.StatusInternalServerError, "AuthorizationFailed"},
+		{ac.ServiceError{StatusCode: 401, Code: "InvalidAuthenticationToken"}, http.StatusInternalServerError, "AuthorizationFailed"},
+		{ac.ServiceError{StatusCode: 404, Code: "ResourceNotFound"}, http.StatusNotFound, "NotFound"},
+		{ac.ServiceError{StatusCode: 400, Code: "LocationNotAvailableForResourceType"}, http.StatusBadRequest, "LocationNotAvailableForResourceType"},
+		{ac.ServiceError{StatusCode: 503, Code: "ServiceUnavailable"}, http.StatusInternalServerError, ""},
+		{errors.New("boom"), http.StatusInternalServerError, ""},
+		{BadRequest("bad"), http.StatusBadRequest, ""},
+	} {
+		brokerError := FromAzureError(test.err)
+
+		if brokerError.StatusCode != test.expectedStatusCode {
+			t.Errorf("Test %d: status code was %d but expected %d\n", i, brokerError.StatusCode, test.expectedStatusCode)
+		}
+		if brokerError.ErrorCode != test.expectedErrorCode {
+			t.Errorf("Test %d: error code was %q but expected %q\n", i, brokerError.ErrorCode, test.expectedErrorCode)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	w := httptest.NewRecorder()
+	Write(w, ac.ServiceError{StatusCode: 404, Code: "ResourceNotFound", Message: "not found"})
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status code was %d but expected %d\n", w.Code, http.StatusNotFound)
+	}
+
+	body := w.Body.String()
+	if !strings.Contains(body, `"error":"NotFound"`) || !strings.Contains(body, `"description":"not found"`) {
+		t.Errorf("unexpected body %s\n", body)
+	}
+}
+
+func TestWriteThrottled(t *testing.T) {
+	for i, test := range []struct {
+		err        error
+		retryAfter string
+	}{
+		{ac.ServiceError{StatusCode: 429, Code: "TooManyRequests", RetryAfter: "17"}, "17"},
+		{ac.ServiceError{StatusCode: 429, Code: "TooManyRequests"}, DEFAULT_RETRY_AFTER},
+		{ac.ServiceError{StatusCode: 409, Code: "StorageAccountCountQuotaExceeded"}, ""},
+	} {
+		w := httptest.NewRecorder()
+		Write(w, test.err)
+
+		if retryAfter := w.Header().Get("Retry-After"); retryAfter != test.retryAfter {
+			t.Errorf("Test %d: Retry-After was %q but expected %q\n", i, retryAfter, test.retryAfter)
+		}
+	}
+}
+
+func TestWriteInternal(t *testing.T) {
+	w := httptest.NewRecorder()
+	Write(w, errors.New("reading /var/vcap/store/secret failed"))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status code was %d but expected %d\n", w.Code, http.StatusInternalServerError)
+	}
+	if body := w.Body.String(); strings.Contains(body, "secret") || !strings.Contains(body, INTERNAL_ERROR_DESCRIPTION) {
+		t.Errorf("unexpected body %s\n", body)
+	}
+}
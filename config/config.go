@@ -2,35 +2,702 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/bingosummer/azure_storage_service_broker/utils"
 )
 
-type Config struct {
-	Port                     string `json:"port"`
-	DataPath                 string `json:"data_path"`
-	CatalogPath              string `json:"catalog_path"`
-	ServiceInstancesFileName string `json:"service_instances_file_name"`
-	ServiceBindingsFileName  string `json:"service_bindings_file_name"`
-}
+const (
+	DEFAULT_LOCATION = "westus"
+	DEFAULT_SKU      = "Standard_LRS"
+	DEFAULT_KIND     = "StorageV2"
+
+	DEFAULT_ENVIRONMENT = "AzurePublicCloud"
+	AZURE_STACK_CLOUD   = "AzureStackCloud"
+
+	// The name of the credential profile in the azure section, which serves
+	// plans and instances that name no other profile
+	DEFAULT_PROFILE = "default"
+
+	// How instances which name no credential profile are placed: always in
+	// the default profile, in the first profile with room left, or in the
+	// profile with the most room left
+	PLACEMENT_FIXED      = "fixed"
+	PLACEMENT_FILL_FIRST = "fill_first"
+	PLACEMENT_SPREAD     = "spread"
+
+	// Which instances share a resource group
+	RESOURCE_GROUP_PER_INSTANCE = "per_instance"
+	RESOURCE_GROUP_PER_SPACE    = "per_space"
+	RESOURCE_GROUP_PER_ORG      = "per_org"
+	RESOURCE_GROUP_FIXED        = "fixed"
+
+	// How the broker authenticates to Azure
+	AUTH_CLIENT_SECRET      = "client_secret"
+	AUTH_CLIENT_CERTIFICATE = "client_certificate"
+	AUTH_MANAGED_IDENTITY   = "managed_identity"
+	AUTH_WORKLOAD_IDENTITY  = "workload_identity"
+
+	// Identifies the resources of this broker in tags
+	DEFAULT_BROKER_ID = "azure-storage-service-broker"
+
+	// How often broker state is compared with Azure, and how long a storage
+	// account must have been orphaned before cleanup may delete it
+	DEFAULT_RECONCILE_INTERVAL  = "15m"
+	DEFAULT_ORPHAN_GRACE_PERIOD = "168h"
+
+	// A user-provided service with this name or tag configures the broker
+	// on Cloud Foundry
+	VCAP_SERVICE_NAME = "azure-storage-service-broker-config"
+)
 
 var (
-	currentConfiguration Config
+	validSkus  = []string{"Standard_LRS", "Standard_GRS", "Standard_RAGRS", "Standard_ZRS", "Premium_LRS"}
+	validKinds = []string{"Storage", "StorageV2", "BlobStorage", "BlockBlobStorage"}
+
+	validResourceGroupStrategies = []string{RESOURCE_GROUP_PER_INSTANCE, RESOURCE_GROUP_PER_SPACE, RESOURCE_GROUP_PER_ORG, RESOURCE_GROUP_FIXED}
+	validPlacementPolicies       = []string{PLACEMENT_FIXED, PLACEMENT_FILL_FIRST, PLACEMENT_SPREAD}
+	validAuthMethods             = []string{AUTH_CLIENT_SECRET, AUTH_CLIENT_CERTIFICATE, AUTH_MANAGED_IDENTITY, AUTH_WORKLOAD_IDENTITY}
+	validEnvironments            = []string{"AzurePublicCloud", "AzureChinaCloud", "AzureUSGovernmentCloud", "AzureGermanCloud", AZURE_STACK_CLOUD}
 )
 
-func LoadConfig(path string) (*Config, error) {
+type Config struct {
+	BrokerId                 string                 `json:"broker_id"`
+	Port                     string                 `json:"port"`
+	DataPath                 string                 `json:"data_path"`
+	CatalogPath              string                 `json:"catalog_path"`
+	ServiceInstancesFileName string                 `json:"service_instances_file_name"`
+	ServiceBindingsFileName  string                 `json:"service_bindings_file_name"`
+	Azure                    AzureConfig            `json:"azure"`
+	Profiles                 map[string]AzureConfig `json:"profiles"`
+	Auth                     AuthConfig             `json:"auth"`
+	Naming                   NamingConfig           `json:"naming"`
+	Placement                PlacementConfig        `json:"placement"`
+	Regions                  RegionsConfig          `json:"regions"`
+	Reconciler               ReconcilerConfig       `json:"reconciler"`
+	Network                  NetworkConfig          `json:"network"`
+	// Extra tags on every resource the broker creates
+	Tags     map[string]string `json:"tags"`
+	Defaults DefaultsConfig    `json:"defaults"`
+}
+
+// AzureConfig is the identity the broker manages Azure resources with.
+type AzureConfig struct {
+	SubscriptionId string `json:"subscription_id"`
+	TenantId       string `json:"tenant_id"`
+	ClientId       string `json:"client_id"`
+	ClientSecret   string `json:"client_secret"`
+
+	// One of the AUTH_* methods. The client ID selects a user-assigned
+	// managed identity and may be left out for the system-assigned one.
+	AuthMethod string `json:"auth_method"`
+	// A PEM file with the certificate and its unencrypted RSA private key
+	ClientCertificatePath string `json:"client_certificate_path"`
+	// The file the platform writes the federated service account token to
+	FederatedTokenFile string `json:"federated_token_file"`
+	// Overrides the instance metadata service, mostly for tests
+	ImdsEndpoint string `json:"imds_endpoint"`
+
+	// The cloud the subscription lives in. Azure Stack discovers its
+	// endpoints from the metadata of ResourceManagerEndpoint.
+	Environment             string `json:"environment"`
+	ResourceManagerEndpoint string `json:"resource_manager_endpoint"`
+	// Overrides the storage DNS suffix of the environment
+	StorageEndpointSuffix string `json:"storage_endpoint_suffix"`
+}
+
+// AuthConfig is the basic auth the platform calls the broker with.
+type AuthConfig struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// PlacementConfig chooses the credential profile of instances whose plan and
+// parameters name none.
+type PlacementConfig struct {
+	Policy string `json:"policy"`
+	// The profiles to place in, in order of preference. All profiles when
+	// empty.
+	Profiles []string `json:"profiles"`
+	// Caps the storage accounts per region and subscription below the Azure
+	// limit, 0 for the Azure limit alone
+	MaxAccountsPerRegion int `json:"max_accounts_per_region"`
+}
+
+// RegionsConfig restricts the regions storage accounts may be placed in.
+type RegionsConfig struct {
+	// All regions when empty
+	Allowed []string `json:"allowed"`
+	// Data residency: the regions of the instances of an organization, by
+	// organization GUID, or of a Kubernetes cluster, by cluster ID
+	Organizations map[string][]string `json:"organizations"`
+}
+
+// ReconcilerConfig controls the periodic comparison of broker state with
+// the storage accounts in Azure.
+type ReconcilerConfig struct {
+	// A Go duration such as 15m, 0 to turn the reconciler off
+	Interval string `json:"interval"`
+	// Deletes orphaned storage accounts once they are older than GracePeriod
+	Cleanup     bool   `json:"cleanup"`
+	GracePeriod string `json:"grace_period"`
+}
+
+// IntervalDuration returns the validated interval.
+func (r ReconcilerConfig) IntervalDuration() time.Duration {
+	interval, _ := time.ParseDuration(r.Interval)
+	return interval
+}
+
+// GracePeriodDuration returns the validated grace period.
+func (r ReconcilerConfig) GracePeriodDuration() time.Duration {
+	gracePeriod, _ := time.ParseDuration(r.GracePeriod)
+	return gracePeriod
+}
+
+// NetworkConfig describes the networks of the platform, which storage
+// accounts with network rules must admit.
+type NetworkConfig struct {
+	// The public IPs and CIDR ranges the applications of the platform reach
+	// Azure from, added to the IP rules of every storage account which
+	// denies access by default
+	EgressIps []string `json:"egress_ips"`
+
+	// The subnet private endpoints of storage accounts are placed in, and
+	// the private DNS zone of the blob service they are registered in, such
+	// as privatelink.blob.core.windows.net
+	PrivateEndpointSubnetId string `json:"private_endpoint_subnet_id"`
+	PrivateDnsZoneId        string `json:"private_dns_zone_id"`
+}
+
+// NormalizeLocation turns a region display name such as "West US" into the
+// name Azure Resource Manager uses.
+func NormalizeLocation(location string) string {
+	return strings.ToLower(strings.Replace(location, " ", "", -1))
+}
+
+// AllowsLocation reports whether an allow-list of regions contains the location. An
+// empty list allows every region.
+func AllowsLocation(allowed []string, location string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, region := range allowed {
+		if NormalizeLocation(region) == NormalizeLocation(location) {
+			return true
+		}
+	}
+	return false
+}
+
+// NamingConfig holds the templates Azure resource names are generated from.
+// See azure_client.Namer for the variables they may use.
+type NamingConfig struct {
+	ResourceGroup           string `json:"resource_group"`
+	KubernetesResourceGroup string `json:"kubernetes_resource_group"`
+	StorageAccount          string `json:"storage_account"`
+	Container               string `json:"container"`
+
+	// One of the RESOURCE_GROUP_* strategies. The resource group templates
+	// apply to per_instance, FixedResourceGroup to fixed.
+	ResourceGroupStrategy string `json:"resource_group_strategy"`
+	FixedResourceGroup    string `json:"fixed_resource_group"`
+}
+
+// DefaultsConfig applies to plans which do not declare their own location,
+// SKU or kind.
+type DefaultsConfig struct {
+	Location string `json:"location"`
+	Sku      string `json:"sku"`
+	Kind     string `json:"kind"`
+}
+
+// ValidationError lists every problem of a configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// Load reads the configuration file, which is YAML if its extension is .yml
+// or .yaml and JSON otherwise, overlays the settings found in VCAP_SERVICES
+// and in environment variables, and validates the result.
+func Load(path string) (*Config, error) {
+	var config Config
+
+	err := config.readFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.applyVcapServices(os.Getenv("VCAP_SERVICES"))
+	if err != nil {
+		return nil, err
+	}
+
+	config.applyEnvironment()
+	config.applyDefaults()
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func (c *Config) readFile(path string) error {
 	bytes, err := utils.ReadFile(path)
 	if err != nil {
-		return &currentConfiguration, err
+		return fmt.Errorf("reading the configuration file %s failed: %v", path, err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		var document interface{}
+		document, err = ParseYaml(string(bytes))
+		if err == nil {
+			err = remarshal(document, c)
+		}
+	default:
+		err = json.Unmarshal(bytes, c)
+	}
+	if err != nil {
+		return fmt.Errorf("parsing the configuration file %s failed: %v", path, err)
+	}
+
+	return nil
+}
+
+// applyVcapServices overlays the credentials of the user-provided service
+// named or tagged VCAP_SERVICE_NAME, which have the layout of the
+// configuration file.
+func (c *Config) applyVcapServices(vcapServices string) error {
+	if vcapServices == "" {
+		return nil
+	}
+
+	var services map[string][]struct {
+		Name        string                 `json:"name"`
+		Tags        []string               `json:"tags"`
+		Credentials map[string]interface{} `json:"credentials"`
+	}
+	err := json.Unmarshal([]byte(vcapServices), &services)
+	if err != nil {
+		return fmt.Errorf("parsing VCAP_SERVICES failed: %v", err)
+	}
+
+	for _, instances := range services {
+		for _, instance := range instances {
+			if instance.Name != VCAP_SERVICE_NAME && !contains(instance.Tags, VCAP_SERVICE_NAME) {
+				continue
+			}
+
+			err = remarshal(instance.Credentials, c)
+			if err != nil {
+				return fmt.Errorf("parsing the credentials of %s in VCAP_SERVICES failed: %v", instance.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// applyEnvironment overrides settings with environment variables. Later
+// names take precedence over the names the broker used to read.
+func (c *Config) applyEnvironment() {
+	for _, override := range []struct {
+		setting *string
+		names   []string
+	}{
+		{&c.Port, []string{"PORT"}},
+		{&c.BrokerId, []string{"BROKER_ID"}},
+		{&c.DataPath, []string{"BROKER_DATA_PATH"}},
+		{&c.CatalogPath, []string{"BROKER_CATALOG_PATH"}},
+		{&c.Azure.SubscriptionId, []string{"subscriptionID", "AZURE_SUBSCRIPTION_ID"}},
+		{&c.Azure.TenantId, []string{"tenantID", "AZURE_TENANT_ID"}},
+		{&c.Azure.ClientId, []string{"clientID", "AZURE_CLIENT_ID"}},
+		{&c.Azure.ClientSecret, []string{"clientSecret", "AZURE_CLIENT_SECRET"}},
+		{&c.Azure.AuthMethod, []string{"AZURE_AUTH_METHOD"}},
+		{&c.Azure.ClientCertificatePath, []string{"AZURE_CLIENT_CERTIFICATE_PATH"}},
+		{&c.Azure.FederatedTokenFile, []string{"AZURE_FEDERATED_TOKEN_FILE"}},
+		{&c.Azure.ImdsEndpoint, []string{"AZURE_IMDS_ENDPOINT"}},
+		{&c.Azure.Environment, []string{"AZURE_ENVIRONMENT"}},
+		{&c.Azure.ResourceManagerEndpoint, []string{"AZURE_RESOURCE_MANAGER_ENDPOINT"}},
+		{&c.Azure.StorageEndpointSuffix, []string{"AZURE_STORAGE_ENDPOINT_SUFFIX"}},
+		{&c.Auth.Username, []string{"authUsername", "BROKER_AUTH_USERNAME"}},
+		{&c.Auth.Password, []string{"authPassword", "BROKER_AUTH_PASSWORD"}},
+		{&c.Defaults.Location, []string{"BROKER_DEFAULT_LOCATION"}},
+		{&c.Defaults.Sku, []string{"BROKER_DEFAULT_SKU"}},
+		{&c.Defaults.Kind, []string{"BROKER_DEFAULT_KIND"}},
+		{&c.Placement.Policy, []string{"BROKER_PLACEMENT_POLICY"}},
+		{&c.Naming.ResourceGroupStrategy, []string{"BROKER_RESOURCE_GROUP_STRATEGY"}},
+		{&c.Naming.FixedResourceGroup, []string{"BROKER_FIXED_RESOURCE_GROUP"}},
+		{&c.Reconciler.Interval, []string{"BROKER_RECONCILE_INTERVAL"}},
+		{&c.Reconciler.GracePeriod, []string{"BROKER_ORPHAN_GRACE_PERIOD"}},
+	} {
+		for _, name := range override.names {
+			if v := os.Getenv(name); v != "" {
+				*override.setting = v
+			}
+		}
+	}
+}
+
+func (c *Config) applyDefaults() {
+	for _, d := range []struct {
+		setting *string
+		value   string
+	}{
+		{&c.BrokerId, DEFAULT_BROKER_ID},
+		{&c.Defaults.Location, DEFAULT_LOCATION},
+		{&c.Defaults.Sku, DEFAULT_SKU},
+		{&c.Defaults.Kind, DEFAULT_KIND},
+		{&c.Placement.Policy, PLACEMENT_FIXED},
+		{&c.Naming.ResourceGroupStrategy, RESOURCE_GROUP_PER_INSTANCE},
+		{&c.Reconciler.Interval, DEFAULT_RECONCILE_INTERVAL},
+		{&c.Reconciler.GracePeriod, DEFAULT_ORPHAN_GRACE_PERIOD},
+	} {
+		if *d.setting == "" {
+			*d.setting = d.value
+		}
+	}
+
+	c.Azure.applyDefaults()
+	for name, profile := range c.Profiles {
+		profile.applyDefaults()
+		c.Profiles[name] = profile
+	}
+	c.Naming.applyDefaults()
+}
+
+func (a *AzureConfig) applyDefaults() {
+	if a.AuthMethod == "" {
+		a.AuthMethod = AUTH_CLIENT_SECRET
+	}
+	if a.Environment == "" {
+		a.Environment = DEFAULT_ENVIRONMENT
+	}
+}
+
+// applyDefaults fills in the templates which the configuration leaves out.
+// The *_NAME_PREFIX environment variables replace the default prefixes.
+func (n *NamingConfig) applyDefaults() {
+	defaults := []struct {
+		template *string
+		env      string
+		prefix   string
+		suffix   string
+	}{
+		{&n.ResourceGroup, "RESOURCE_GROUP_NAME_PREFIX", "cloud-foundry-", "{instance_id}"},
+		{&n.KubernetesResourceGroup, "RESOURCE_GROUP_NAME_PREFIX", "kubernetes-", "{namespace}-{instance_id}"},
+		{&n.StorageAccount, "STORAGE_ACCOUNT_NAME_PREFIX", "cf", "{instance_hash}"},
+		{&n.Container, "CONTAINER_NAME_PREFIX", "cloud-foundry-", "{instance_id}"},
+	}
+
+	for _, d := range defaults {
+		if *d.template != "" {
+			continue
+		}
+
+		prefix := d.prefix
+		if v := os.Getenv(d.env); v != "" {
+			prefix = v
+		}
+		*d.template = prefix + d.suffix
+	}
+}
+
+// KeepRestartSettings resets the settings which cannot change while the
+// broker runs to their running values, and returns the names of those which
+// differed.
+func (c *Config) KeepRestartSettings(running *Config) []string {
+	var changed []string
+	for _, setting := range []struct {
+		name    string
+		value   *string
+		running string
+	}{
+		{"port", &c.Port, running.Port},
+		{"data_path", &c.DataPath, running.DataPath},
+		{"service_instances_file_name", &c.ServiceInstancesFileName, running.ServiceInstancesFileName},
+		{"service_bindings_file_name", &c.ServiceBindingsFileName, running.ServiceBindingsFileName},
+	} {
+		if *setting.value != setting.running {
+			changed = append(changed, setting.name)
+			*setting.value = setting.running
+		}
+	}
+	return changed
+}
+
+// validate returns the problems of one credential profile. Only the default
+// profile can be set through environment variables.
+func (a *AzureConfig) validate(prefix string, fromEnvironment bool) []string {
+	var problems []string
+	require := func(value, setting, env string) {
+		if value == "" {
+			if fromEnvironment {
+				problems = append(problems, prefix+"."+setting+" is required, set it in the configuration file or in "+env)
+			} else {
+				problems = append(problems, prefix+"."+setting+" is required")
+			}
+		}
+	}
+
+	require(a.SubscriptionId, "subscription_id", "AZURE_SUBSCRIPTION_ID")
+	switch a.AuthMethod {
+	case AUTH_CLIENT_SECRET:
+		require(a.TenantId, "tenant_id", "AZURE_TENANT_ID")
+		require(a.ClientId, "client_id", "AZURE_CLIENT_ID")
+		require(a.ClientSecret, "client_secret", "AZURE_CLIENT_SECRET")
+	case AUTH_CLIENT_CERTIFICATE:
+		require(a.TenantId, "tenant_id", "AZURE_TENANT_ID")
+		require(a.ClientId, "client_id", "AZURE_CLIENT_ID")
+		require(a.ClientCertificatePath, "client_certificate_path", "AZURE_CLIENT_CERTIFICATE_PATH")
+	case AUTH_MANAGED_IDENTITY:
+	case AUTH_WORKLOAD_IDENTITY:
+		require(a.TenantId, "tenant_id", "AZURE_TENANT_ID")
+		require(a.ClientId, "client_id", "AZURE_CLIENT_ID")
+		require(a.FederatedTokenFile, "federated_token_file", "AZURE_FEDERATED_TOKEN_FILE")
+	default:
+		problems = append(problems, fmt.Sprintf("%s.auth_method %q is not one of %s", prefix, a.AuthMethod, strings.Join(validAuthMethods, ", ")))
+	}
+	if !contains(validEnvironments, a.Environment) {
+		problems = append(problems, fmt.Sprintf("%s.environment %q is not one of %s", prefix, a.Environment, strings.Join(validEnvironments, ", ")))
+	}
+	if a.Environment == AZURE_STACK_CLOUD {
+		require(a.ResourceManagerEndpoint, "resource_manager_endpoint", "AZURE_RESOURCE_MANAGER_ENDPOINT")
+	}
+	return problems
+}
+
+// Profile returns the named credential profile.
+func (c *Config) Profile(name string) (AzureConfig, bool) {
+	if name == "" || name == DEFAULT_PROFILE {
+		return c.Azure, true
+	}
+	profile, ok := c.Profiles[name]
+	return profile, ok
+}
+
+// PlacementProfiles returns the profiles which instances may be placed in.
+func (c *Config) PlacementProfiles() []string {
+	if len(c.Placement.Profiles) > 0 {
+		return c.Placement.Profiles
+	}
+	return c.ProfileNames()
+}
+
+// ProfileNames returns the names of all credential profiles.
+func (c *Config) ProfileNames() []string {
+	names := []string{DEFAULT_PROFILE}
+	for name := range c.Profiles {
+		if name != DEFAULT_PROFILE {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// Validate reports every missing or invalid setting at once.
+func (c *Config) Validate() error {
+	var problems []string
+	require := func(value, setting, env string) {
+		if value == "" {
+			problems = append(problems, setting+" is required, set it in the configuration file or in "+env)
+		}
+	}
+
+	require(c.Port, "port", "PORT")
+	if c.Port != "" {
+		if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+			problems = append(problems, fmt.Sprintf("port %q is not a valid TCP port", c.Port))
+		}
 	}
+	require(c.DataPath, "data_path", "BROKER_DATA_PATH")
+	require(c.CatalogPath, "catalog_path", "BROKER_CATALOG_PATH")
+	require(c.ServiceInstancesFileName, "service_instances_file_name", "the configuration file only")
+	require(c.ServiceBindingsFileName, "service_bindings_file_name", "the configuration file only")
 
-	err = json.Unmarshal(bytes, &currentConfiguration)
+	problems = append(problems, c.Azure.validate("azure", true)...)
+	if _, ok := c.Profiles[DEFAULT_PROFILE]; ok {
+		problems = append(problems, "profiles."+DEFAULT_PROFILE+" is reserved for the azure section")
+	}
+	for _, name := range c.ProfileNames()[1:] {
+		profile := c.Profiles[name]
+		problems = append(problems, profile.validate("profiles."+name, false)...)
+	}
+
+	if !contains(validResourceGroupStrategies, c.Naming.ResourceGroupStrategy) {
+		problems = append(problems, fmt.Sprintf("naming.resource_group_strategy %q is not one of %s", c.Naming.ResourceGroupStrategy, strings.Join(validResourceGroupStrategies, ", ")))
+	}
+	if c.Naming.ResourceGroupStrategy == RESOURCE_GROUP_FIXED {
+		require(c.Naming.FixedResourceGroup, "naming.fixed_resource_group", "BROKER_FIXED_RESOURCE_GROUP")
+	}
+	if !contains(validPlacementPolicies, c.Placement.Policy) {
+		problems = append(problems, fmt.Sprintf("placement.policy %q is not one of %s", c.Placement.Policy, strings.Join(validPlacementPolicies, ", ")))
+	}
+	for _, name := range c.Placement.Profiles {
+		if _, ok := c.Profile(name); !ok {
+			problems = append(problems, fmt.Sprintf("placement.profiles names the unknown profile %q", name))
+		}
+	}
+	if c.Placement.MaxAccountsPerRegion < 0 {
+		problems = append(problems, "placement.max_accounts_per_region must not be negative")
+	}
+
+	if !AllowsLocation(c.Regions.Allowed, c.Defaults.Location) {
+		problems = append(problems, fmt.Sprintf("defaults.location %q is not one of regions.allowed", c.Defaults.Location))
+	}
+
+	for _, setting := range []struct {
+		name  string
+		value string
+	}{
+		{"reconciler.interval", c.Reconciler.Interval},
+		{"reconciler.grace_period", c.Reconciler.GracePeriod},
+	} {
+		if duration, err := time.ParseDuration(setting.value); setting.value != "" && (err != nil || duration < 0) {
+			problems = append(problems, fmt.Sprintf("%s %q is not a duration such as 15m or 168h", setting.name, setting.value))
+		}
+	}
+	if c.Reconciler.Cleanup && c.Reconciler.GracePeriodDuration() <= 0 {
+		problems = append(problems, "reconciler.grace_period must be positive when reconciler.cleanup is on")
+	}
+
+	for _, rule := range c.Network.EgressIps {
+		if _, err := NormalizeIpRule(rule); err != nil {
+			problems = append(problems, "network.egress_ips: "+err.Error())
+		}
+	}
+	if len(c.Network.EgressIps) > MAX_IP_RULES {
+		problems = append(problems, fmt.Sprintf("network.egress_ips must not have more than %d entries", MAX_IP_RULES))
+	}
+	if (c.Network.PrivateEndpointSubnetId == "") != (c.Network.PrivateDnsZoneId == "") {
+		problems = append(problems, "network.private_endpoint_subnet_id and network.private_dns_zone_id must be set together")
+	}
+	if c.Network.PrivateEndpointSubnetId != "" && !IsSubnetId(c.Network.PrivateEndpointSubnetId) {
+		problems = append(problems, fmt.Sprintf("network.private_endpoint_subnet_id %q is not the resource ID of a subnet", c.Network.PrivateEndpointSubnetId))
+	}
+	if c.Network.PrivateDnsZoneId != "" && !IsPrivateDnsZoneId(c.Network.PrivateDnsZoneId) {
+		problems = append(problems, fmt.Sprintf("network.private_dns_zone_id %q is not the resource ID of a private DNS zone", c.Network.PrivateDnsZoneId))
+	}
+
+	var tagNames []string
+	for name := range c.Tags {
+		tagNames = append(tagNames, name)
+	}
+	sort.Strings(tagNames)
+	for _, name := range tagNames {
+		if err := ValidateTag(name, c.Tags[name]); err != nil {
+			problems = append(problems, "tags: "+err.Error())
+		}
+	}
+
+	require(c.Auth.Username, "auth.username", "BROKER_AUTH_USERNAME")
+	require(c.Auth.Password, "auth.password", "BROKER_AUTH_PASSWORD")
+
+	if !contains(validSkus, c.Defaults.Sku) {
+		problems = append(problems, fmt.Sprintf("defaults.sku %q is not one of %s", c.Defaults.Sku, strings.Join(validSkus, ", ")))
+	}
+	if !contains(validKinds, c.Defaults.Kind) {
+		problems = append(problems, fmt.Sprintf("defaults.kind %q is not one of %s", c.Defaults.Kind, strings.Join(validKinds, ", ")))
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// remarshal copies a decoded document onto a struct through its JSON tags.
+// Numbers and booleans are taken as strings where the struct wants strings.
+func remarshal(document interface{}, target interface{}) error {
+	bytes, err := json.Marshal(stringify(document, reflect.TypeOf(target)))
 	if err != nil {
-		return &currentConfiguration, err
+		return err
 	}
-	return &currentConfiguration, nil
+	return json.Unmarshal(bytes, target)
 }
 
-func GetConfig() *Config {
-	return &currentConfiguration
+// stringify turns the numbers and booleans of a decoded document into
+// strings where the target has string fields, since YAML reads an unquoted
+// port: 8001 as a number.
+func stringify(document interface{}, target reflect.Type) interface{} {
+	for target.Kind() == reflect.Ptr {
+		target = target.Elem()
+	}
+
+	switch v := document.(type) {
+	case map[string]interface{}:
+		var fields map[string]reflect.Type
+		switch target.Kind() {
+		case reflect.Struct:
+			fields = jsonFields(target)
+		case reflect.Map:
+		default:
+			return document
+		}
+		mapping := make(map[string]interface{}, len(v))
+		for name, item := range v {
+			if target.Kind() == reflect.Map {
+				item = stringify(item, target.Elem())
+			} else if field, ok := fields[strings.ToLower(name)]; ok {
+				item = stringify(item, field)
+			}
+			mapping[name] = item
+		}
+		return mapping
+	case []interface{}:
+		if target.Kind() != reflect.Slice && target.Kind() != reflect.Array {
+			return document
+		}
+		sequence := make([]interface{}, len(v))
+		for i, item := range v {
+			sequence[i] = stringify(item, target.Elem())
+		}
+		return sequence
+	case bool, int, int64, uint64, float64:
+		if target.Kind() == reflect.String {
+			return fmt.Sprint(v)
+		}
+	}
+	return document
+}
+
+// jsonFields returns the types of the fields of a struct by their JSON
+// names, lowercased as JSON matches them case-insensitively.
+func jsonFields(target reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < target.NumField(); i++ {
+		field := target.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[strings.ToLower(name)] = field.Type
+	}
+	return fields
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,254 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const jsonConfig = `{
+	"port": "8001",
+	"data_path": "data",
+	"catalog_path": "data",
+	"service_instances_file_name": "ServiceInstances.json",
+	"service_bindings_file_name": "ServiceBindings.json",
+	"azure": {"subscription_id": "file-subscription-id", "tenant_id": "file-tenant-id", "client_id": "file-client-id", "client_secret": "file-client-secret"},
+	"auth": {"username": "file-username", "password": "file-password"}
+}`
+
+const yamlConfig = `
+port: "8001"
+data_path: data
+catalog_path: data
+service_instances_file_name: ServiceInstances.json
+service_bindings_file_name: ServiceBindings.json
+azure:
+  subscription_id: file-subscription-id
+  tenant_id: file-tenant-id
+  client_id: file-client-id
+  client_secret: file-client-secret
+auth:
+  username: file-username
+  password: file-password
+defaults:
+  location: eastus
+`
+
+var environmentVariables = []string{
+	"PORT", "VCAP_SERVICES", "subscriptionID", "AZURE_SUBSCRIPTION_ID", "clientSecret", "AZURE_CLIENT_SECRET",
+	"authUsername", "BROKER_AUTH_USERNAME", "BROKER_DEFAULT_SKU", "STORAGE_ACCOUNT_NAME_PREFIX",
+	"AZURE_ENVIRONMENT", "AZURE_AUTH_METHOD",
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	for i, test := range []struct {
+		fileName    string
+		content     string
+		environment map[string]string
+		check       func(c *Config) bool
+	}{
+		{"config.json", jsonConfig, nil, func(c *Config) bool {
+			return c.Azure.SubscriptionId == "file-subscription-id" && c.Defaults == DefaultsConfig{DEFAULT_LOCATION, DEFAULT_SKU, DEFAULT_KIND} && c.Naming.StorageAccount == "cf{instance_hash}"
+		}},
+		{"config.yml", yamlConfig, nil, func(c *Config) bool {
+			return c.Auth.Password == "file-password" && c.Defaults.Location == "eastus" && c.Port == "8001"
+		}},
+		{"config.yaml", strings.Replace(yamlConfig, `port: "8001"`, "port: 8001", 1), nil, func(c *Config) bool {
+			return c.Port == "8001"
+		}},
+		{"config.json", jsonConfig, map[string]string{"subscriptionID": "legacy-id", "PORT": "9000", "authUsername": "env-username", "STORAGE_ACCOUNT_NAME_PREFIX": "sb"}, func(c *Config) bool {
+			return c.Azure.SubscriptionId == "legacy-id" && c.Port == "9000" && c.Auth.Username == "env-username" && c.Naming.StorageAccount == "sb{instance_hash}"
+		}},
+		{"config.json", jsonConfig, map[string]string{"subscriptionID": "legacy-id", "AZURE_SUBSCRIPTION_ID": "new-id"}, func(c *Config) bool {
+			return c.Azure.SubscriptionId == "new-id"
+		}},
+		{"config.json", jsonConfig, nil, func(c *Config) bool {
+			return c.Azure.Environment == DEFAULT_ENVIRONMENT && c.Azure.AuthMethod == AUTH_CLIENT_SECRET && c.BrokerId == DEFAULT_BROKER_ID && c.Reconciler.IntervalDuration() == 15*time.Minute
+		}},
+		{"config.json", jsonConfig, map[string]string{"AZURE_ENVIRONMENT": "AzureChinaCloud"}, func(c *Config) bool {
+			return c.Azure.Environment == "AzureChinaCloud"
+		}},
+		{"config.json", `{"port": "8001", "data_path": "data", "catalog_path": "data", "service_instances_file_name": "i.json", "service_bindings_file_name": "b.json",
+			"azure": {"subscription_id": "file-subscription-id"}, "auth": {"username": "file-username", "password": "file-password"}}`,
+			map[string]string{"AZURE_AUTH_METHOD": "managed_identity"}, func(c *Config) bool {
+				return c.Azure.AuthMethod == AUTH_MANAGED_IDENTITY && c.Azure.ClientSecret == ""
+			}},
+		{"config.json", jsonConfig, map[string]string{
+			"VCAP_SERVICES":        `{"user-provided": [{"name": "other", "credentials": {"port": "1"}}, {"name": "broker-config", "tags": ["azure-storage-service-broker-config"], "credentials": {"azure": {"client_secret": "vcap-secret"}, "auth": {"username": "vcap-username"}}}]}`,
+			"BROKER_AUTH_USERNAME": "env-username",
+		}, func(c *Config) bool {
+			return c.Azure.ClientSecret == "vcap-secret" && c.Azure.ClientId == "file-client-id" && c.Auth.Username == "env-username" && c.Port == "8001"
+		}},
+	} {
+		for _, name := range environmentVariables {
+			os.Unsetenv(name)
+		}
+		for name, value := range test.environment {
+			os.Setenv(name, value)
+		}
+
+		c, err := Load(writeConfig(t, test.fileName, test.content))
+		if err != nil {
+			t.Errorf("Test %d: loading failed with %v\n", i, err)
+			continue
+		}
+		if !test.check(c) {
+			t.Errorf("Test %d: configuration was %+v\n", i, c)
+		}
+	}
+
+	for _, name := range environmentVariables {
+		os.Unsetenv(name)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c := Config{
+		Port:                     "http",
+		DataPath:                 "data",
+		CatalogPath:              "data",
+		ServiceInstancesFileName: "ServiceInstances.json",
+		ServiceBindingsFileName:  "ServiceBindings.json",
+		Azure:                    AzureConfig{SubscriptionId: "subscription-id", TenantId: "tenant-id", ClientId: "client-id", AuthMethod: AUTH_CLIENT_SECRET, Environment: AZURE_STACK_CLOUD},
+		Auth:                     AuthConfig{Username: "username", Password: "password"},
+		Defaults:                 DefaultsConfig{Location: "westus", Sku: "Standard_XYZ", Kind: "StorageV2"},
+		Naming:                   NamingConfig{ResourceGroupStrategy: RESOURCE_GROUP_FIXED},
+		Placement:                PlacementConfig{Policy: PLACEMENT_FILL_FIRST, Profiles: []string{"default", "emea"}},
+		Reconciler:               ReconcilerConfig{Interval: "often", Cleanup: true},
+		Network:                  NetworkConfig{EgressIps: []string{"203.0.113.0/24", "10.1.2.3"}, PrivateEndpointSubnetId: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/vnet"},
+		Tags:                     map[string]string{"cost_center": "42", "cost/center": "42"},
+	}
+
+	err := c.Validate()
+	e, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("error was %v but expected a ValidationError\n", err)
+	}
+
+	expected := []string{
+		`port "http" is not a valid TCP port`,
+		"azure.client_secret is required, set it in the configuration file or in AZURE_CLIENT_SECRET",
+		"azure.resource_manager_endpoint is required, set it in the configuration file or in AZURE_RESOURCE_MANAGER_ENDPOINT",
+		"naming.fixed_resource_group is required, set it in the configuration file or in BROKER_FIXED_RESOURCE_GROUP",
+		`placement.profiles names the unknown profile "emea"`,
+		`reconciler.interval "often" is not a duration such as 15m or 168h`,
+		"reconciler.grace_period must be positive when reconciler.cleanup is on",
+		`network.egress_ips: IP rule "10.1.2.3" lies in the private range 10.0.0.0/8, which Azure does not accept`,
+		"network.private_endpoint_subnet_id and network.private_dns_zone_id must be set together",
+		`network.private_endpoint_subnet_id "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/vnet" is not the resource ID of a subnet`,
+		`tags: tag name "cost/center" must not contain any of <>%&\?/`,
+		`defaults.sku "Standard_XYZ" is not one of ` + strings.Join(validSkus, ", "),
+	}
+	if !reflect.DeepEqual(e.Problems, expected) {
+		t.Errorf("problems were %q but expected %q\n", e.Problems, expected)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	c := Config{
+		Azure: AzureConfig{SubscriptionId: "default-id", TenantId: "tenant-id", ClientId: "client-id", ClientSecret: "secret"},
+		Profiles: map[string]AzureConfig{
+			"emea": {SubscriptionId: "emea-id", AuthMethod: AUTH_MANAGED_IDENTITY},
+			"apac": {SubscriptionId: "apac-id", TenantId: "tenant-id"},
+		},
+	}
+	c.applyDefaults()
+
+	if names := c.ProfileNames(); !reflect.DeepEqual(names, []string{DEFAULT_PROFILE, "apac", "emea"}) {
+		t.Errorf("profile names were %q\n", names)
+	}
+	if profile, ok := c.Profile(""); !ok || profile.SubscriptionId != "default-id" {
+		t.Errorf("the empty name selected %+v\n", profile)
+	}
+	if profile, ok := c.Profile("apac"); !ok || profile.AuthMethod != AUTH_CLIENT_SECRET || profile.Environment != DEFAULT_ENVIRONMENT {
+		t.Errorf("profile apac was %+v\n", profile)
+	}
+	if _, ok := c.Profile("us"); ok {
+		t.Errorf("profile us exists\n")
+	}
+
+	var problems []string
+	for _, name := range c.ProfileNames() {
+		profile, _ := c.Profile(name)
+		problems = append(problems, profile.validate(name, false)...)
+	}
+	expected := []string{"apac.client_id is required", "apac.client_secret is required"}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("problems were %q but expected %q\n", problems, expected)
+	}
+}
+
+func TestAllowsLocation(t *testing.T) {
+	for i, test := range []struct {
+		allowed  []string
+		location string
+		expected bool
+	}{
+		{nil, "westus", true},
+		{[]string{"westus", "eastus"}, "eastus", true},
+		{[]string{"West Europe"}, "westeurope", true},
+		{[]string{"westeurope"}, "West Europe", true},
+		{[]string{"westeurope"}, "westus", false},
+	} {
+		if allowed := AllowsLocation(test.allowed, test.location); allowed != test.expected {
+			t.Errorf("Test %d: %s was allowed %v but expected %v\n", i, test.location, allowed, test.expected)
+		}
+	}
+}
+
+func TestKeepRestartSettings(t *testing.T) {
+	running := &Config{Port: "8001", DataPath: "data", ServiceInstancesFileName: "instances.json", ServiceBindingsFileName: "bindings.json"}
+	reloaded := &Config{Port: "9000", DataPath: "data", ServiceInstancesFileName: "instances.json", ServiceBindingsFileName: "other.json", CatalogPath: "catalog"}
+
+	changed := reloaded.KeepRestartSettings(running)
+
+	if !reflect.DeepEqual(changed, []string{"port", "service_bindings_file_name"}) {
+		t.Errorf("changed settings were %v\n", changed)
+	}
+	if reloaded.Port != "8001" || reloaded.ServiceBindingsFileName != "bindings.json" || reloaded.CatalogPath != "catalog" {
+		t.Errorf("reloaded configuration was %+v\n", reloaded)
+	}
+}
+
+func TestNormalizeIpRule(t *testing.T) {
+	for i, test := range []struct {
+		rule          string
+		expected      string
+		expectedError bool
+	}{
+		{"203.0.113.7", "203.0.113.7", false},
+		{"203.0.113.7/32", "203.0.113.7", false},
+		{"203.0.113.0/24", "203.0.113.0/24", false},
+		{"203.0.113.7/24", "", true},
+		{"203.0.113.6/31", "", true},
+		{"192.168.1.0/24", "", true},
+		{"100.64.0.1", "", true},
+		{"2001:db8::1", "", true},
+		{"example.com", "", true},
+	} {
+		normalized, err := NormalizeIpRule(test.rule)
+		if (err != nil) != test.expectedError {
+			t.Errorf("Test %d: error was %v but expected error %v\n", i, err, test.expectedError)
+			continue
+		}
+		if normalized != test.expected {
+			t.Errorf("Test %d: rule was %q but expected %q\n", i, normalized, test.expected)
+		}
+	}
+}
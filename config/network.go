@@ -0,0 +1,69 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+const (
+	// The limits of Azure on the network rules of a storage account
+	MAX_IP_RULES              = 200
+	MAX_VIRTUAL_NETWORK_RULES = 200
+)
+
+var (
+	subnetIdPattern         = regexp.MustCompile(`(?i)^/subscriptions/[^/]+/resourceGroups/[^/]+/providers/Microsoft\.Network/virtualNetworks/[^/]+/subnets/[^/]+$`)
+	privateDnsZoneIdPattern = regexp.MustCompile(`(?i)^/subscriptions/[^/]+/resourceGroups/[^/]+/providers/Microsoft\.Network/privateDnsZones/[^/]+$`)
+)
+
+// IsSubnetId reports whether the ID is the resource ID of a VNet subnet.
+func IsSubnetId(id string) bool {
+	return subnetIdPattern.MatchString(id)
+}
+
+// IsPrivateDnsZoneId reports whether the ID is the resource ID of a private
+// DNS zone.
+func IsPrivateDnsZoneId(id string) bool {
+	return privateDnsZoneIdPattern.MatchString(id)
+}
+
+// Azure does not accept these ranges in the IP rules of a storage account,
+// since traffic from them never reaches its public endpoint
+var reservedIpRanges = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10"}
+
+// NormalizeIpRule checks an IPv4 address or CIDR range for the firewall of a
+// storage account and returns it as Azure stores it, single addresses
+// without a prefix length.
+func NormalizeIpRule(rule string) (string, error) {
+	ip, ipNet, err := net.ParseCIDR(rule)
+	if err != nil {
+		ip = net.ParseIP(rule)
+		if ip == nil || strings.Contains(rule, "/") {
+			return "", fmt.Errorf("IP rule %q is not an IPv4 address or CIDR range", rule)
+		}
+		ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+	}
+	if ip.To4() == nil {
+		return "", fmt.Errorf("IP rule %q is not an IPv4 address or CIDR range", rule)
+	}
+
+	for _, reserved := range reservedIpRanges {
+		_, reservedNet, _ := net.ParseCIDR(reserved)
+		if reservedNet.Contains(ip) {
+			return "", fmt.Errorf("IP rule %q lies in the private range %s, which Azure does not accept", rule, reserved)
+		}
+	}
+
+	ones, _ := ipNet.Mask.Size()
+	switch {
+	case ones == 32:
+		return ip.String(), nil
+	case ones == 31:
+		return "", fmt.Errorf("IP rule %q must be split into single addresses, since Azure does not accept /31 ranges", rule)
+	case !ipNet.IP.Equal(ip):
+		return "", fmt.Errorf("IP rule %q has host bits set, use %s", rule, ipNet)
+	}
+	return ipNet.String(), nil
+}
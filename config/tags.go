@@ -0,0 +1,35 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// The limits of Azure on tags of storage accounts, which are stricter
+	// than those of resource groups, in characters
+	MAX_TAG_NAME_LENGTH  = 128
+	MAX_TAG_VALUE_LENGTH = 256
+)
+
+var reservedTagPrefixes = []string{"microsoft", "azure", "windows"}
+
+// ValidateTag checks a tag against the naming rules of Azure.
+func ValidateTag(name, value string) error {
+	if name == "" || utf8.RuneCountInString(name) > MAX_TAG_NAME_LENGTH {
+		return fmt.Errorf("tag name %q must have 1 to %d characters", name, MAX_TAG_NAME_LENGTH)
+	}
+	if strings.ContainsAny(name, `<>%&\?/`) {
+		return fmt.Errorf(`tag name %q must not contain any of <>%%&\?/`, name)
+	}
+	for _, prefix := range reservedTagPrefixes {
+		if strings.HasPrefix(strings.ToLower(name), prefix) {
+			return fmt.Errorf("tag name %q must not start with %s, which Azure reserves", name, prefix)
+		}
+	}
+	if utf8.RuneCountInString(value) > MAX_TAG_VALUE_LENGTH {
+		return fmt.Errorf("the value of tag %s must not be longer than %d characters", name, MAX_TAG_VALUE_LENGTH)
+	}
+	return nil
+}
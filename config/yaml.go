@@ -0,0 +1,51 @@
+package config
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ParseYaml parses a YAML document into the values a JSON document decodes
+// to, with mappings as map[string]interface{}. Repeated keys are errors.
+func ParseYaml(document string) (interface{}, error) {
+	var value interface{}
+	err := yaml.UnmarshalStrict([]byte(document), &value)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return map[string]interface{}{}, nil
+	}
+	return jsonValue(value)
+}
+
+func jsonValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		mapping := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("the key %v is not a string", key)
+			}
+			converted, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			mapping[name] = converted
+		}
+		return mapping, nil
+	case []interface{}:
+		sequence := make([]interface{}, len(v))
+		for i, item := range v {
+			converted, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			sequence[i] = converted
+		}
+		return sequence, nil
+	}
+	return value, nil
+}
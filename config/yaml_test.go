@@ -0,0 +1,61 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseYaml(t *testing.T) {
+	for i, test := range []struct {
+		document      string
+		expected      interface{}
+		expectedError bool
+	}{
+		{
+			"port: \"8001\"\ndata_path: data # comment\n",
+			map[string]interface{}{"port": "8001", "data_path": "data"},
+			false,
+		},
+		{
+			"# broker\nazure:\n  subscription_id: 'sub-id'\n  client_secret: \"a#b\"\nauth:\n  username: admin\n",
+			map[string]interface{}{
+				"azure": map[string]interface{}{"subscription_id": "sub-id", "client_secret": "a#b"},
+				"auth":  map[string]interface{}{"username": "admin"},
+			},
+			false,
+		},
+		{
+			"regions:\n- westus\n- eastus\nflow: [1, true, \"x, y\"]\nempty:\n",
+			map[string]interface{}{
+				"regions": []interface{}{"westus", "eastus"},
+				"flow":    []interface{}{1, true, "x, y"},
+				"empty":   nil,
+			},
+			false,
+		},
+		{
+			"profiles:\n  - name: a\n    subscription_id: x\n  - name: b\n",
+			map[string]interface{}{
+				"profiles": []interface{}{
+					map[string]interface{}{"name": "a", "subscription_id": "x"},
+					map[string]interface{}{"name": "b"},
+				},
+			},
+			false,
+		},
+		{"url: http://example.com:8080/path\n", map[string]interface{}{"url": "http://example.com:8080/path"}, false},
+		{"a: 1\n  b: 2\n", nil, true},
+		{"a: 1\na: 2\n", nil, true},
+		{"a: [1, 2\n", nil, true},
+		{"", map[string]interface{}{}, false},
+	} {
+		value, err := ParseYaml(test.document)
+		if (err != nil) != test.expectedError {
+			t.Errorf("Test %d: error was %v but expected error %v\n", i, err, test.expectedError)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(value, test.expected) {
+			t.Errorf("Test %d: value was %#v but expected %#v\n", i, value, test.expected)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package json_schema
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ValidationError lists every violation found while validating a document.
+type ValidationError struct {
+	Violations []string
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.Violations, "; ")
+}
+
+// Validate checks the value, as decoded by encoding/json, against the schema.
+// It supports the draft-04 keywords type, enum, properties, required,
+// additionalProperties, items, minItems, maxItems, minLength, maxLength,
+// pattern, minimum and maximum. A nil schema accepts every value.
+func Validate(schema map[string]interface{}, value interface{}) error {
+	if schema == nil {
+		return nil
+	}
+
+	var violations []string
+	validate(schema, value, "parameters", &violations)
+	if len(violations) > 0 {
+		return &ValidationError{Violations: violations}
+	}
+
+	return nil
+}
+
+func validate(schema map[string]interface{}, value interface{}, path string, violations *[]string) {
+	report := func(format string, args ...interface{}) {
+		*violations = append(*violations, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if t, ok := schema["type"]; ok {
+		types := toStrings(t)
+		if !matchesAnyType(types, value) {
+			report("expected %s but got %s", strings.Join(types, " or "), typeOf(value))
+			return
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if reflect.DeepEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			report("must be one of %s", formatValues(enum))
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		validateObject(schema, v, path, violations, report)
+	case []interface{}:
+		validateArray(schema, v, path, violations, report)
+	case string:
+		validateString(schema, v, report)
+	case float64:
+		validateNumber(schema, v, report)
+	}
+}
+
+func validateObject(schema map[string]interface{}, object map[string]interface{}, path string, violations *[]string, report func(string, ...interface{})) {
+	for _, name := range toStrings(schema["required"]) {
+		if _, ok := object[name]; !ok {
+			report("missing required property %q", name)
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if property, ok := properties[name].(map[string]interface{}); ok {
+			validate(property, object[name], path+"."+name, violations)
+			continue
+		}
+
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				report("property %q is not allowed", name)
+			}
+		case map[string]interface{}:
+			validate(additional, object[name], path+"."+name, violations)
+		}
+	}
+}
+
+func validateArray(schema map[string]interface{}, array []interface{}, path string, violations *[]string, report func(string, ...interface{})) {
+	if min, ok := toInt(schema["minItems"]); ok && len(array) < min {
+		report("must contain at least %d items", min)
+	}
+	if max, ok := toInt(schema["maxItems"]); ok && len(array) > max {
+		report("must contain at most %d items", max)
+	}
+
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+		for i, item := range array {
+			validate(items, item, fmt.Sprintf("%s[%d]", path, i), violations)
+		}
+	}
+}
+
+func validateString(schema map[string]interface{}, s string, report func(string, ...interface{})) {
+	length := len([]rune(s))
+	if min, ok := toInt(schema["minLength"]); ok && length < min {
+		report("must be at least %d characters long", min)
+	}
+	if max, ok := toInt(schema["maxLength"]); ok && length > max {
+		report("must be at most %d characters long", max)
+	}
+
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			report("schema pattern %q is invalid: %v", pattern, err)
+		} else if !re.MatchString(s) {
+			report("must match the pattern %q", pattern)
+		}
+	}
+}
+
+func validateNumber(schema map[string]interface{}, n float64, report func(string, ...interface{})) {
+	if min, ok := schema["minimum"].(float64); ok && n < min {
+		report("must be greater than or equal to %v", min)
+	}
+	if max, ok := schema["maximum"].(float64); ok && n > max {
+		report("must be less than or equal to %v", max)
+	}
+}
+
+func matchesAnyType(types []string, value interface{}) bool {
+	actual := typeOf(value)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func typeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func toStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var result []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+func toInt(value interface{}) (int, bool) {
+	n, ok := value.(float64)
+	return int(n), ok
+}
+
+func formatValues(values []interface{}) string {
+	formatted := make([]string, len(values))
+	for i, v := range values {
+		formatted[i] = fmt.Sprintf("%q", fmt.Sprint(v))
+	}
+	return strings.Join(formatted, ", ")
+}
@@ -0,0 +1,65 @@
+package json_schema
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const testSchema = `{
+	"$schema": "http://json-schema.org/draft-04/schema#",
+	"type": "object",
+	"additionalProperties": false,
+	"required": ["location"],
+	"properties": {
+		"location": {"type": "string", "pattern": "^[a-z0-9]+$"},
+		"access_tier": {"type": "string", "enum": ["Hot", "Cool"]},
+		"retention_days": {"type": "integer", "minimum": 1, "maximum": 365},
+		"ip_rules": {"type": "array", "maxItems": 2, "items": {"type": "string", "minLength": 7}}
+	}
+}`
+
+func TestValidate(t *testing.T) {
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte(testSchema), &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, test := range []struct {
+		parameters         string
+		expectedViolations int
+	}{
+		{`{"location": "westus"}`, 0},
+		{`{"location": "westus", "access_tier": "Cool", "retention_days": 30, "ip_rules": ["1.2.3.4"]}`, 0},
+		{`{}`, 1},
+		{`{"location": 1}`, 1},
+		{`{"location": "West US"}`, 1},
+		{`{"location": "westus", "acess_tier": "Cool"}`, 1},
+		{`{"location": "westus", "access_tier": "Archive"}`, 1},
+		{`{"location": "westus", "retention_days": 1.5}`, 1},
+		{`{"location": "westus", "retention_days": 0}`, 1},
+		{`{"location": "westus", "ip_rules": ["1.2.3.4", "5.6.7.8", "9"]}`, 2},
+		{`{"access_tier": 3, "sku": "Premium_LRS"}`, 3},
+		{`[]`, 1},
+	} {
+		var parameters interface{}
+		if err := json.Unmarshal([]byte(test.parameters), &parameters); err != nil {
+			t.Fatal(err)
+		}
+
+		err := Validate(schema, parameters)
+		violations := 0
+		if err != nil {
+			violations = len(err.(*ValidationError).Violations)
+		}
+
+		if violations != test.expectedViolations {
+			t.Errorf("Test %d: got %d violations (%v) but expected %d\n", i, violations, err, test.expectedViolations)
+		}
+	}
+}
+
+func TestValidateWithoutSchema(t *testing.T) {
+	if err := Validate(nil, map[string]interface{}{"anything": true}); err != nil {
+		t.Errorf("expected no error without a schema but got %v\n", err)
+	}
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
 
-	conf "github.com/bingosummer/azure_storage_service_broker/config"
+	"github.com/bingosummer/azure_storage_service_broker/config"
 	utils "github.com/bingosummer/azure_storage_service_broker/utils"
 	webs "github.com/bingosummer/azure_storage_service_broker/web_server"
 )
@@ -11,19 +13,55 @@ import (
 func main() {
 	// Step1. Get Config Path
 	defaultConfigPath := utils.GetPath([]string{"assets", "config.json"})
-	configPath := flag.String("c", defaultConfigPath, "use '-c' option to specify the config file path")
+	configPath := flag.String("c", defaultConfigPath, "use '-c' option to specify the config file path, in JSON or YAML")
+	recoverState := flag.Bool("recover", false, "rebuild the service instances and bindings missing from the state files from Azure, then exit")
+	dryRun := flag.Bool("dry-run", false, "with -recover, report what would be recovered without writing the state files")
+	flag.Parse()
 
 	// Step2. Load configuration
-	_, err := conf.LoadConfig(*configPath)
+	conf, err := config.Load(*configPath)
 	if err != nil {
-		panic("Error loading config file...")
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *recoverState {
+		recoverAndExit(conf, *dryRun)
 	}
 
 	// Step3. Start Server
-	server := webs.NewServer()
+	server := webs.NewServer(*configPath, conf)
 	if server == nil {
 		panic("Error creating a server...")
 	}
 
 	server.Start()
 }
+
+func recoverAndExit(conf *config.Config, dryRun bool) {
+	report, err := webs.Recover(conf, dryRun)
+	if report != nil {
+		fmt.Printf("Recovered %d service instances and %d service bindings\n", len(report.Instances), len(report.Bindings))
+		for _, id := range report.Instances {
+			fmt.Printf("  service instance %s\n", id)
+		}
+		for _, id := range report.Bindings {
+			fmt.Printf("  service binding %s\n", id)
+		}
+		fmt.Printf("Tagged %d resource groups as created by the broker\n", len(report.ResourceGroups))
+		for _, name := range report.ResourceGroups {
+			fmt.Printf("  resource group %s\n", name)
+		}
+		for _, conflict := range report.Conflicts {
+			fmt.Printf("CONFLICT: %s\n", conflict)
+		}
+		if dryRun {
+			fmt.Println("Dry run, the state files were not written and the resource groups not tagged")
+		}
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
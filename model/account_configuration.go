@@ -0,0 +1,60 @@
+package model
+
+import (
+	"strconv"
+)
+
+// AccountConfiguration is the configuration of a storage account which the
+// broker manages. On a service instance it is the desired configuration,
+// derived from the plan and parameters; empty settings are not managed.
+type AccountConfiguration struct {
+	Sku               string `json:"sku,omitempty"`
+	Kind              string `json:"kind,omitempty"`
+	AccessTier        string `json:"access_tier,omitempty"`
+	HttpsOnly         *bool  `json:"https_only,omitempty"`
+	MinimumTlsVersion string `json:"minimum_tls_version,omitempty"`
+
+	AllowBlobPublicAccess *bool `json:"allow_blob_public_access,omitempty"`
+	AllowSharedKeyAccess  *bool `json:"allow_shared_key_access,omitempty"`
+
+	// The network ACL, including the egress IPs of the platform
+	NetworkRules *NetworkRules `json:"network_rules,omitempty"`
+}
+
+// Drift is a setting whose live value differs from the desired one.
+type Drift struct {
+	Setting string `json:"setting"`
+	Desired string `json:"desired"`
+	Actual  string `json:"actual"`
+}
+
+// Diff returns the managed settings which the live configuration does not
+// match.
+func (c *AccountConfiguration) Diff(live *AccountConfiguration) []Drift {
+	var drift []Drift
+	for _, setting := range []struct {
+		name            string
+		desired, actual string
+	}{
+		{"sku", c.Sku, live.Sku},
+		{"kind", c.Kind, live.Kind},
+		{"access_tier", c.AccessTier, live.AccessTier},
+		{"https_only", formatBool(c.HttpsOnly), formatBool(live.HttpsOnly)},
+		{"minimum_tls_version", c.MinimumTlsVersion, live.MinimumTlsVersion},
+		{"allow_blob_public_access", formatBool(c.AllowBlobPublicAccess), formatBool(live.AllowBlobPublicAccess)},
+		{"allow_shared_key_access", formatBool(c.AllowSharedKeyAccess), formatBool(live.AllowSharedKeyAccess)},
+		{"network_rules", c.NetworkRules.String(), live.NetworkRules.String()},
+	} {
+		if setting.desired != "" && setting.desired != setting.actual {
+			drift = append(drift, Drift{Setting: setting.name, Desired: setting.desired, Actual: setting.actual})
+		}
+	}
+	return drift
+}
+
+func formatBool(b *bool) string {
+	if b == nil {
+		return ""
+	}
+	return strconv.FormatBool(*b)
+}
@@ -0,0 +1,41 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAccountConfigurationDiff(t *testing.T) {
+	enabled, disabled := true, false
+	desired := &AccountConfiguration{Sku: "Standard_GRS", AccessTier: "Hot", HttpsOnly: &enabled, MinimumTlsVersion: "TLS1_2", AllowBlobPublicAccess: &disabled,
+		NetworkRules: &NetworkRules{DefaultAction: "Deny", IpRules: []string{"5.6.7.8", "1.2.3.4"}, SubnetIds: []string{"/subscriptions/sub/resourceGroups/network/providers/Microsoft.Network/virtualNetworks/vnet/subnets/apps"}}}
+	rules := &NetworkRules{DefaultAction: "Deny", IpRules: []string{"1.2.3.4", "5.6.7.8"}, SubnetIds: []string{"/subscriptions/sub/resourcegroups/network/providers/Microsoft.Network/virtualNetworks/vnet/subnets/apps"}}
+
+	for i, test := range []struct {
+		live     *AccountConfiguration
+		expected []Drift
+	}{
+		{&AccountConfiguration{Sku: "Standard_GRS", Kind: "StorageV2", AccessTier: "Hot", HttpsOnly: &enabled, MinimumTlsVersion: "TLS1_2", AllowBlobPublicAccess: &disabled, NetworkRules: rules}, nil},
+		{
+			&AccountConfiguration{Sku: "Standard_LRS", AccessTier: "Hot", HttpsOnly: &disabled, MinimumTlsVersion: "TLS1_2", AllowBlobPublicAccess: &disabled, NetworkRules: rules},
+			[]Drift{{"sku", "Standard_GRS", "Standard_LRS"}, {"https_only", "true", "false"}},
+		},
+		{
+			&AccountConfiguration{Sku: "Standard_GRS", AccessTier: "Cool", HttpsOnly: &enabled, AllowBlobPublicAccess: &disabled, NetworkRules: rules},
+			[]Drift{{"access_tier", "Hot", "Cool"}, {"minimum_tls_version", "TLS1_2", ""}},
+		},
+		{
+			&AccountConfiguration{Sku: "Standard_GRS", AccessTier: "Hot", HttpsOnly: &enabled, MinimumTlsVersion: "TLS1_2", AllowBlobPublicAccess: &enabled, NetworkRules: rules},
+			[]Drift{{"allow_blob_public_access", "false", "true"}},
+		},
+		{
+			&AccountConfiguration{Sku: "Standard_GRS", AccessTier: "Hot", HttpsOnly: &enabled, MinimumTlsVersion: "TLS1_2", AllowBlobPublicAccess: &disabled, NetworkRules: &NetworkRules{DefaultAction: "Allow"}},
+			[]Drift{{"network_rules", "default_action=Deny ip_rules=1.2.3.4,5.6.7.8 subnet_ids=/subscriptions/sub/resourcegroups/network/providers/microsoft.network/virtualnetworks/vnet/subnets/apps", "default_action=Allow ip_rules= subnet_ids="}},
+		},
+	} {
+		drift := desired.Diff(test.live)
+		if !reflect.DeepEqual(drift, test.expected) {
+			t.Errorf("Test %d: drift was %+v but expected %+v\n", i, drift, test.expected)
+		}
+	}
+}
@@ -1,5 +1,55 @@
 package model
 
+import (
+	"fmt"
+)
+
 type Catalog struct {
 	Services []Service `json:"services"`
 }
+
+// FindService returns the service with the given id.
+func (c *Catalog) FindService(serviceId string) (*Service, error) {
+	if serviceId == "" {
+		return nil, fmt.Errorf("service_id is required")
+	}
+
+	for i := range c.Services {
+		if c.Services[i].Id == serviceId {
+			return &c.Services[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("service_id %q is not offered by this broker", serviceId)
+}
+
+// FindPlan returns the service and the plan with the given ids. The plan must
+// belong to the service.
+func (c *Catalog) FindPlan(serviceId, planId string) (*Service, *ServicePlan, error) {
+	service, err := c.FindService(serviceId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if planId == "" {
+		return nil, nil, fmt.Errorf("plan_id is required")
+	}
+
+	plan := service.FindPlan(planId)
+	if plan == nil {
+		return nil, nil, fmt.Errorf("plan_id %q is not a plan of service %q", planId, service.Name)
+	}
+
+	return service, plan, nil
+}
+
+// LookupPlan returns the plan with the given id and its service, for records
+// which carry no service_id.
+func (c *Catalog) LookupPlan(planId string) (*Service, *ServicePlan, error) {
+	for i := range c.Services {
+		if plan := c.Services[i].FindPlan(planId); plan != nil {
+			return &c.Services[i], plan, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("plan_id %q is not offered by this broker", planId)
+}
@@ -0,0 +1,58 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestFindPlan(t *testing.T) {
+	catalog := Catalog{
+		Services: []Service{
+			{
+				Name: "azurestorageblob",
+				Id:   "fake-service-id",
+				Plans: []ServicePlan{
+					{Name: "default", Id: "fake-plan-id"},
+				},
+			},
+			{
+				Name: "other",
+				Id:   "other-service-id",
+				Plans: []ServicePlan{
+					{Name: "other", Id: "other-plan-id"},
+				},
+			},
+		},
+	}
+
+	for i, test := range []struct {
+		serviceId        string
+		planId           string
+		expectedPlanName string
+		expectedErr      bool
+	}{
+		{"fake-service-id", "fake-plan-id", "default", false},
+		{"other-service-id", "other-plan-id", "other", false},
+		{"", "fake-plan-id", "", true},
+		{"fake-service-id", "", "", true},
+		{"3", "fake-plan-id", "", true},
+		{"fake-service-id", "2", "", true},
+		{"fake-service-id", "other-plan-id", "", true},
+	} {
+		_, plan, err := catalog.FindPlan(test.serviceId, test.planId)
+
+		if test.expectedErr {
+			if err == nil {
+				t.Errorf("Test %d: expected an error but got plan %v\n", i, plan)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Test %d: unexpected error %v\n", i, err)
+			continue
+		}
+		if plan.Name != test.expectedPlanName {
+			t.Errorf("Test %d: plan was %s but expected %s\n", i, plan.Name, test.expectedPlanName)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package model
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	PLATFORM_CLOUDFOUNDRY = "cloudfoundry"
+	PLATFORM_KUBERNETES   = "kubernetes"
+)
+
+// Context is the platform specific context object which OSB requests carry
+// since 2.12.
+type Context struct {
+	Platform string `json:"platform,omitempty"`
+
+	// Cloud Foundry
+	OrganizationGuid string `json:"organization_guid,omitempty"`
+	OrganizationName string `json:"organization_name,omitempty"`
+	SpaceGuid        string `json:"space_guid,omitempty"`
+	SpaceName        string `json:"space_name,omitempty"`
+	InstanceName     string `json:"instance_name,omitempty"`
+
+	// Kubernetes
+	Namespace string `json:"namespace,omitempty"`
+	ClusterId string `json:"clusterid,omitempty"`
+}
+
+// PlatformName returns the platform of the context. Requests without a
+// context come from Cloud Foundry, which sent none before 2.12.
+func (c *Context) PlatformName() string {
+	if c == nil || c.Platform == "" {
+		return PLATFORM_CLOUDFOUNDRY
+	}
+	return c.Platform
+}
+
+// Merge returns the context with the non-empty fields of update applied, as
+// platforms send only the current values in update requests.
+func (c *Context) Merge(update *Context) *Context {
+	if update == nil {
+		return c
+	}
+
+	var merged Context
+	if c != nil {
+		merged = *c
+	}
+
+	for _, field := range []struct {
+		target *string
+		value  string
+	}{
+		{&merged.Platform, update.Platform},
+		{&merged.OrganizationGuid, update.OrganizationGuid},
+		{&merged.OrganizationName, update.OrganizationName},
+		{&merged.SpaceGuid, update.SpaceGuid},
+		{&merged.SpaceName, update.SpaceName},
+		{&merged.InstanceName, update.InstanceName},
+		{&merged.Namespace, update.Namespace},
+		{&merged.ClusterId, update.ClusterId},
+	} {
+		if field.value != "" {
+			*field.target = field.value
+		}
+	}
+
+	return &merged
+}
+
+// OriginatingIdentity is the platform user on whose behalf a request was
+// made, as sent in the X-Broker-API-Originating-Identity header.
+type OriginatingIdentity struct {
+	Platform string                 `json:"platform"`
+	Value    map[string]interface{} `json:"value"`
+}
+
+// ParseOriginatingIdentity parses a header of the form
+// "<platform> <base64 encoded JSON object>".
+func ParseOriginatingIdentity(header string) (*OriginatingIdentity, error) {
+	parts := strings.Fields(header)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("originating identity %q is not of the form \"platform value\"", header)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("originating identity value is not base64 encoded: %v", err)
+	}
+
+	identity := OriginatingIdentity{Platform: parts[0]}
+	err = json.Unmarshal(decoded, &identity.Value)
+	if err != nil {
+		return nil, fmt.Errorf("originating identity value is not a JSON object: %v", err)
+	}
+
+	return &identity, nil
+}
+
+// User returns the id of the platform user, which is "user_id" on Cloud
+// Foundry and "username" on Kubernetes.
+func (i *OriginatingIdentity) User() string {
+	if i == nil {
+		return ""
+	}
+
+	for _, key := range []string{"user_id", "username"} {
+		if v, ok := i.Value[key].(string); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+func (i *OriginatingIdentity) String() string {
+	if i == nil {
+		return "unknown"
+	}
+	return i.Platform + " user " + i.User()
+}
@@ -0,0 +1,55 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestParseOriginatingIdentity(t *testing.T) {
+	for i, test := range []struct {
+		header           string
+		expectedPlatform string
+		expectedUser     string
+		expectedError    bool
+	}{
+		// {"user_id": "683ea748-3092-4ff4-b656-39cacc4d5360"}
+		{"cloudfoundry eyJ1c2VyX2lkIjogIjY4M2VhNzQ4LTMwOTItNGZmNC1iNjU2LTM5Y2FjYzRkNTM2MCJ9", "cloudfoundry", "683ea748-3092-4ff4-b656-39cacc4d5360", false},
+		// {"username": "duke", "uid": "c2dde242-5ce4-11e7-988c-000c2946f14f"}
+		{"kubernetes eyJ1c2VybmFtZSI6ICJkdWtlIiwgInVpZCI6ICJjMmRkZTI0Mi01Y2U0LTExZTctOTg4Yy0wMDBjMjk0NmYxNGYifQ==", "kubernetes", "duke", false},
+		{"cloudfoundry", "", "", true},
+		{"cloudfoundry not-base64!", "", "", true},
+		// "not json"
+		{"cloudfoundry Im5vdCBqc29uIg==", "", "", true},
+	} {
+		identity, err := ParseOriginatingIdentity(test.header)
+		if (err != nil) != test.expectedError {
+			t.Errorf("Test %d: error was %v but expected error %v\n", i, err, test.expectedError)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if identity.Platform != test.expectedPlatform || identity.User() != test.expectedUser {
+			t.Errorf("Test %d: identity was %s but expected %s user %s\n", i, identity, test.expectedPlatform, test.expectedUser)
+		}
+	}
+}
+
+func TestContextMerge(t *testing.T) {
+	stored := &Context{Platform: PLATFORM_CLOUDFOUNDRY, OrganizationGuid: "org-guid", SpaceName: "dev", InstanceName: "old-name"}
+
+	merged := stored.Merge(&Context{Platform: PLATFORM_CLOUDFOUNDRY, InstanceName: "new-name"})
+	if merged.InstanceName != "new-name" || merged.OrganizationGuid != "org-guid" || merged.SpaceName != "dev" {
+		t.Errorf("merged context was %+v\n", merged)
+	}
+	if stored.InstanceName != "old-name" {
+		t.Errorf("expected the stored context to be unchanged but was %+v\n", stored)
+	}
+
+	var empty *Context
+	if merged := empty.Merge(&Context{Namespace: "default"}); merged.Namespace != "default" {
+		t.Errorf("merged context was %+v\n", merged)
+	}
+	if merged := stored.Merge(nil); merged != stored {
+		t.Errorf("expected a nil update to keep the stored context\n")
+	}
+}
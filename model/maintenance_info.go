@@ -0,0 +1,67 @@
+package model
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaintenanceInfo identifies the configuration revision a plan offers and an
+// instance has applied.
+type MaintenanceInfo struct {
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// MaintenanceVersion returns the version of the maintenance info, or "" for
+// instances which were provisioned before plans carried maintenance_info.
+func (m *MaintenanceInfo) MaintenanceVersion() string {
+	if m == nil {
+		return ""
+	}
+	return m.Version
+}
+
+// CompareVersions compares two major.minor.patch versions and returns -1, 0
+// or 1. The empty version is older than every other version.
+func CompareVersions(a, b string) (int, error) {
+	va, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range va {
+		switch {
+		case va[i] < vb[i]:
+			return -1, nil
+		case va[i] > vb[i]:
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func parseVersion(version string) ([3]int, error) {
+	var result [3]int
+	if version == "" {
+		return [3]int{-1, -1, -1}, nil
+	}
+
+	parts := strings.Split(version, ".")
+	if len(parts) != 3 {
+		return result, fmt.Errorf("maintenance_info version %q is not of the form major.minor.patch", version)
+	}
+
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return result, fmt.Errorf("maintenance_info version %q is not of the form major.minor.patch", version)
+		}
+		result[i] = n
+	}
+	return result, nil
+}
@@ -0,0 +1,32 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for i, test := range []struct {
+		a             string
+		b             string
+		expected      int
+		expectedError bool
+	}{
+		{"1.0.0", "1.0.0", 0, false},
+		{"1.0.0", "1.1.0", -1, false},
+		{"1.10.0", "1.9.0", 1, false},
+		{"2.0.0", "1.99.99", 1, false},
+		{"", "1.0.0", -1, false},
+		{"", "", 0, false},
+		{"1.0", "1.0.0", 0, true},
+		{"1.0.x", "1.0.0", 0, true},
+	} {
+		result, err := CompareVersions(test.a, test.b)
+		if (err != nil) != test.expectedError {
+			t.Errorf("Test %d: error was %v but expected error %v\n", i, err, test.expectedError)
+			continue
+		}
+		if result != test.expected {
+			t.Errorf("Test %d: comparing %q to %q returned %d but expected %d\n", i, test.a, test.b, result, test.expected)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package model
+
+import (
+	"sort"
+	"strings"
+)
+
+// NetworkRules is the network ACL of a storage account: the action for
+// traffic which no rule matches, and the IP ranges and VNet subnets which
+// may reach the account.
+type NetworkRules struct {
+	DefaultAction string   `json:"default_action"`
+	IpRules       []string `json:"ip_rules,omitempty"`
+	SubnetIds     []string `json:"subnet_ids,omitempty"`
+}
+
+// String describes the rules in a canonical form, with sorted lists and
+// subnet IDs in lower case as Azure does not keep their case, and nil rules
+// as "".
+func (r *NetworkRules) String() string {
+	if r == nil {
+		return ""
+	}
+
+	ipRules := append([]string{}, r.IpRules...)
+	sort.Strings(ipRules)
+	var subnetIds []string
+	for _, id := range r.SubnetIds {
+		subnetIds = append(subnetIds, strings.ToLower(id))
+	}
+	sort.Strings(subnetIds)
+
+	return "default_action=" + r.DefaultAction + " ip_rules=" + strings.Join(ipRules, ",") + " subnet_ids=" + strings.Join(subnetIds, ",")
+}
+
+// PrivateEndpoint is the private endpoint of the blob service of a storage
+// account, in the resource group of the account. The FQDN is set once the
+// endpoint is registered in the private DNS zone.
+type PrivateEndpoint struct {
+	Name string `json:"name"`
+	Fqdn string `json:"fqdn,omitempty"`
+}
+
+// Ready reports whether the endpoint is in place.
+func (p *PrivateEndpoint) Ready() bool {
+	return p.Fqdn != ""
+}
@@ -5,11 +5,26 @@ type Service struct {
 	Id             string   `json:"id"`
 	Description    string   `json:"description"`
 	Bindable       bool     `json:"bindable"`
-	PlanUpdateable bool     `json:"plan_updateable, omitempty"`
-	Tags           []string `json:"tags, omitempty"`
-	Requires       []string `json:"requires, omitempty"`
+	PlanUpdateable bool     `json:"plan_updateable,omitempty"`
+	Tags           []string `json:"tags,omitempty"`
+	Requires       []string `json:"requires,omitempty"`
 
-	Metadata        interface{}   `json:"metadata, omitempty"`
+	InstancesRetrievable bool `json:"instances_retrievable,omitempty"`
+	BindingsRetrievable  bool `json:"bindings_retrievable,omitempty"`
+
+	Metadata        interface{}   `json:"metadata,omitempty"`
 	Plans           []ServicePlan `json:"plans"`
 	DashboardClient interface{}   `json:"dashboard_client"`
 }
+
+// FindPlan returns the plan of the service with the given id, or nil if the
+// service has no such plan.
+func (s *Service) FindPlan(planId string) *ServicePlan {
+	for i := range s.Plans {
+		if s.Plans[i].Id == planId {
+			return &s.Plans[i]
+		}
+	}
+
+	return nil
+}
@@ -1,5 +1,11 @@
 package model
 
+import (
+	"fmt"
+
+	storageclient "github.com/Azure/azure-sdk-for-go/storage"
+)
+
 type ServiceBinding struct {
 	Id                string `json:"id"`
 	ServiceId         string `json:"service_id"`
@@ -7,6 +13,24 @@ type ServiceBinding struct {
 	ServicePlanId     string `json:"service_plan_id"`
 	ServiceInstanceId string `json:"service_instance_id"`
 	Credentials       Credentials
+
+	Parameters interface{} `json:"parameters,omitempty"`
+
+	// The platform context and the platform user who created the binding
+	Context             *Context             `json:"context,omitempty"`
+	OriginatingIdentity *OriginatingIdentity `json:"originating_identity,omitempty"`
+
+	// The following items are for last operations of asynchronous bindings
+	State       string `json:"state,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+type CreateServiceBindingRequest struct {
+	ServiceId  string      `json:"service_id"`
+	PlanId     string      `json:"plan_id"`
+	AppGuid    string      `json:"app_guid"`
+	Parameters interface{} `json:"parameters,omitempty"`
+	Context    *Context    `json:"context,omitempty"`
 }
 
 type CreateServiceBindingResponse struct {
@@ -14,9 +38,56 @@ type CreateServiceBindingResponse struct {
 	Credentials interface{} `json:"credentials"`
 }
 
+type GetServiceBindingResponse struct {
+	Credentials interface{} `json:"credentials"`
+	Parameters  interface{} `json:"parameters,omitempty"`
+}
+
+type AsyncOperationResponse struct {
+	Operation string `json:"operation,omitempty"`
+}
+
 type Credentials struct {
 	StorageAccountName string `json:"storage_account_name"`
 	ContainerName      string `json:"container_name"`
-	PrimaryAccessKey   string `json:"primary_access_key"`
-	SecondaryAccessKey string `json:"secondary_access_key"`
+	// The account keys, left out for bindings which access the container
+	// with the Azure AD identity of the application
+	PrimaryAccessKey   string `json:"primary_access_key,omitempty"`
+	SecondaryAccessKey string `json:"secondary_access_key,omitempty"`
+	// The object ID of that identity
+	PrincipalId string `json:"principal_id,omitempty"`
+	// The storage DNS suffix of the cloud the account lives in
+	EndpointSuffix string `json:"endpoint_suffix,omitempty"`
+	// The name of the blob service in the private DNS zone, for accounts
+	// reached through a private endpoint
+	PrivateFqdn string `json:"private_fqdn,omitempty"`
+}
+
+// SecretData returns the credentials as flat string keys which Kubernetes
+// stores as a secret, together with a ready to use connection string when
+// the binding carries the account keys.
+func (c Credentials) SecretData() map[string]string {
+	// Bindings created before sovereign clouds were supported are all in the
+	// public cloud
+	endpointSuffix := c.EndpointSuffix
+	if endpointSuffix == "" {
+		endpointSuffix = storageclient.DefaultBaseURL
+	}
+
+	data := map[string]string{
+		"storage_account_name": c.StorageAccountName,
+		"container_name":       c.ContainerName,
+		"endpoint_suffix":      endpointSuffix,
+	}
+	if c.PrincipalId != "" {
+		data["principal_id"] = c.PrincipalId
+	} else {
+		data["primary_access_key"] = c.PrimaryAccessKey
+		data["secondary_access_key"] = c.SecondaryAccessKey
+		data["connection_string"] = fmt.Sprintf("DefaultEndpointsProtocol=https;AccountName=%s;AccountKey=%s;EndpointSuffix=%s", c.StorageAccountName, c.PrimaryAccessKey, endpointSuffix)
+	}
+	if c.PrivateFqdn != "" {
+		data["private_fqdn"] = c.PrivateFqdn
+	}
+	return data
 }
@@ -1,6 +1,8 @@
 package model
 
 import (
+	"errors"
+
 	storageclient "github.com/Azure/azure-sdk-for-go/storage"
 )
 
@@ -13,22 +15,97 @@ type ServiceInstance struct {
 	PlanId           string      `json:"plan_id"`
 	ServiceId        string      `json:"service_id"`
 	SpaceGuid        string      `json:"space_guid"`
-	Parameters       interface{} `json:"parameters, omitempty"`
+	Parameters       interface{} `json:"parameters,omitempty"`
 
 	// The following items are the allowed parameters
-	ResourceGroupName   string                            `json:"resource_group_name, omitempty"`
-	StorageAccountName  string                            `json:"storage_account_name, omitempty"`
-	ContainerAccessType storageclient.ContainerAccessType `json:"container_access_type, omitempty"`
+	ResourceGroupName   string                            `json:"resource_group_name,omitempty"`
+	StorageAccountName  string                            `json:"storage_account_name,omitempty"`
+	ContainerName       string                            `json:"container_name,omitempty"`
+	ContainerAccessType storageclient.ContainerAccessType `json:"container_access_type,omitempty"`
+
+	// The credential profile, and so the subscription, the instance lives in.
+	// Instances provisioned before profiles existed leave it empty.
+	Profile string `json:"profile,omitempty"`
+	// The region the storage account was placed in
+	Location string `json:"location,omitempty"`
+
+	// The platform context, kept up to date by update requests, and the
+	// platform user who provisioned the instance
+	Context             *Context             `json:"context,omitempty"`
+	OriginatingIdentity *OriginatingIdentity `json:"originating_identity,omitempty"`
+
+	// The maintenance_info requested on provisioning, then the one applied
+	MaintenanceInfo *MaintenanceInfo `json:"maintenance_info,omitempty"`
+
+	// The storage account configuration the plan, parameters and maintenance
+	// steps asked for, which drift detection compares the account with
+	Configuration *AccountConfiguration `json:"configuration,omitempty"`
+	// The network ACL of the storage account, nil when it admits all traffic
+	NetworkRules *NetworkRules `json:"network_rules,omitempty"`
+	// The private endpoint of the blob service, nil when the account is
+	// reached through its public endpoint
+	PrivateEndpoint *PrivateEndpoint `json:"private_endpoint,omitempty"`
+
+	// Set while a deprovisioning waits for Azure to delete the private
+	// endpoint, before the storage account can be deleted
+	Deprovisioning bool `json:"deprovisioning,omitempty"`
 
 	// The following items are for last operations
 	State       string `json:"state"`
 	Description string `json:"description"`
 }
 
+func (i *ServiceInstance) Platform() string {
+	return i.Context.PlatformName()
+}
+
+// AllowsSharedKeyAccess reports whether requests to the storage account may
+// be signed with the account keys, which Azure allows unless disabled.
+func (i *ServiceInstance) AllowsSharedKeyAccess() bool {
+	return i.Configuration == nil || i.Configuration.AllowSharedKeyAccess == nil || *i.Configuration.AllowSharedKeyAccess
+}
+
+// ValidatePlatform checks that the request identifies where the instance
+// lives: a namespace on Kubernetes, an organization and space elsewhere.
+func (i *ServiceInstance) ValidatePlatform() error {
+	if i.Platform() == PLATFORM_KUBERNETES {
+		if i.Context.Namespace == "" {
+			return errors.New("context.namespace is required for the kubernetes platform")
+		}
+		return nil
+	}
+
+	if i.OrganizationGuid == "" || i.SpaceGuid == "" {
+		return errors.New("organization_guid and space_guid are required")
+	}
+	return nil
+}
+
+type UpdateServiceInstanceRequest struct {
+	ServiceId      string      `json:"service_id"`
+	PlanId         string      `json:"plan_id"`
+	Parameters     interface{} `json:"parameters,omitempty"`
+	PreviousValues interface{} `json:"previous_values,omitempty"`
+	Context        *Context    `json:"context,omitempty"`
+
+	MaintenanceInfo *MaintenanceInfo `json:"maintenance_info,omitempty"`
+}
+
 type CreateServiceInstanceResponse struct {
 	DashboardUrl string `json:"dashboard_url"`
 }
 
+type GetServiceInstanceResponse struct {
+	ServiceId    string      `json:"service_id"`
+	PlanId       string      `json:"plan_id"`
+	DashboardUrl string      `json:"dashboard_url,omitempty"`
+	Parameters   interface{} `json:"parameters,omitempty"`
+
+	MaintenanceInfo *MaintenanceInfo `json:"maintenance_info,omitempty"`
+	// The network ACL applied, including the egress IPs of the platform
+	NetworkRules *NetworkRules `json:"network_rules,omitempty"`
+}
+
 type CreateLastOperationResponse struct {
 	State       string `json:"state"`
 	Description string `json:"description"`
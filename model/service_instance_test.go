@@ -0,0 +1,23 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestValidatePlatform(t *testing.T) {
+	for i, test := range []struct {
+		instance      ServiceInstance
+		expectedError bool
+	}{
+		{ServiceInstance{OrganizationGuid: "org-guid", SpaceGuid: "space-guid"}, false},
+		{ServiceInstance{OrganizationGuid: "org-guid", SpaceGuid: "space-guid", Context: &Context{Platform: PLATFORM_CLOUDFOUNDRY}}, false},
+		{ServiceInstance{OrganizationGuid: "org-guid"}, true},
+		{ServiceInstance{Context: &Context{Platform: PLATFORM_KUBERNETES, Namespace: "default", ClusterId: "cluster-id"}}, false},
+		{ServiceInstance{Context: &Context{Platform: PLATFORM_KUBERNETES}}, true},
+	} {
+		err := test.instance.ValidatePlatform()
+		if (err != nil) != test.expectedError {
+			t.Errorf("Test %d: error was %v but expected error %v\n", i, err, test.expectedError)
+		}
+	}
+}
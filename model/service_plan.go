@@ -1,9 +1,255 @@
 package model
 
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
 type ServicePlan struct {
-	Name        string      `json:"name"`
-	Id          string      `json:"id"`
-	Description string      `json:"description"`
-	Metadata    interface{} `json:"metadata, omitempty"`
-	Free        bool        `json:"free, omitempty"`
+	Name            string              `json:"name"`
+	Id              string              `json:"id"`
+	Description     string              `json:"description"`
+	Metadata        ServicePlanMetadata `json:"metadata,omitempty"`
+	Free            bool                `json:"free,omitempty"`
+	Schemas         *Schemas            `json:"schemas,omitempty"`
+	MaintenanceInfo *MaintenanceInfo    `json:"maintenance_info,omitempty"`
+}
+
+type Schemas struct {
+	ServiceInstance ServiceInstanceSchema `json:"service_instance"`
+	ServiceBinding  ServiceBindingSchema  `json:"service_binding"`
+}
+
+type ServiceInstanceSchema struct {
+	Create *InputParametersSchema `json:"create,omitempty"`
+	Update *InputParametersSchema `json:"update,omitempty"`
+}
+
+type ServiceBindingSchema struct {
+	Create *InputParametersSchema `json:"create,omitempty"`
+}
+
+type InputParametersSchema struct {
+	Parameters map[string]interface{} `json:"parameters"`
+}
+
+type ServicePlanMetadata struct {
+	Cost        interface{} `json:"cost,omitempty"`
+	Bullets     []string    `json:"bullets,omitempty"`
+	DisplayName string      `json:"displayName,omitempty"`
+
+	// The following items are used by the broker when provisioning and binding
+	Sku        string `json:"sku,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	AccessTier string `json:"access_tier,omitempty"`
+	Location   string `json:"location,omitempty"`
+	// The regions the location parameter may choose, all when empty
+	AllowedLocations []string `json:"allowed_locations,omitempty"`
+	MaxBindings      int      `json:"max_bindings,omitempty"`
+
+	// The security settings of new storage accounts, which parameters may
+	// override. Settings the plan leaves out are left to Azure.
+	HttpsOnly             *bool  `json:"https_only,omitempty"`
+	MinimumTlsVersion     string `json:"minimum_tls_version,omitempty"`
+	AllowBlobPublicAccess *bool  `json:"allow_blob_public_access,omitempty"`
+	AllowSharedKeyAccess  *bool  `json:"allow_shared_key_access,omitempty"`
+	// Reaches the blob service of new storage accounts through a private
+	// endpoint only, unless the private_endpoint parameter says otherwise
+	PrivateEndpoint bool `json:"private_endpoint,omitempty"`
+
+	// Storage accounts of the plan which drift from their desired
+	// configuration are reset instead of only reported
+	Enforced bool `json:"enforced,omitempty"`
+
+	// The credential profile the plan provisions with. The subscription
+	// parameter may select another one if the plan allows it.
+	Subscription string `json:"subscription,omitempty"`
+
+	// The parameters which may override the plan. All parameters are allowed
+	// when the plan does not declare the list.
+	AllowedParameters []string `json:"allowed_parameters,omitempty"`
+
+	// The keys the broker does not know, such as those which platforms
+	// display, served unchanged in the catalog
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// servicePlanMetadata has the fields of ServicePlanMetadata without its
+// JSON methods.
+type servicePlanMetadata ServicePlanMetadata
+
+// UnmarshalJSON reads the known keys into the fields and keeps the others
+// in Extra.
+func (m *ServicePlanMetadata) UnmarshalJSON(data []byte) error {
+	var known servicePlanMetadata
+	err := json.Unmarshal(data, &known)
+	if err != nil {
+		return err
+	}
+
+	var extra map[string]json.RawMessage
+	err = json.Unmarshal(data, &extra)
+	if err != nil {
+		return err
+	}
+	for _, key := range metadataKeys() {
+		delete(extra, key)
+	}
+	if len(extra) > 0 {
+		known.Extra = extra
+	}
+
+	*m = ServicePlanMetadata(known)
+	return nil
+}
+
+// MarshalJSON writes the fields together with the keys in Extra.
+func (m ServicePlanMetadata) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(servicePlanMetadata(m))
+	if err != nil || len(m.Extra) == 0 {
+		return data, err
+	}
+
+	var all map[string]json.RawMessage
+	err = json.Unmarshal(data, &all)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range m.Extra {
+		if _, ok := all[key]; !ok {
+			all[key] = value
+		}
+	}
+	return json.Marshal(all)
+}
+
+// metadataKeys returns the JSON keys of the fields of ServicePlanMetadata.
+func metadataKeys() []string {
+	var keys []string
+	t := reflect.TypeOf(ServicePlanMetadata{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			keys = append(keys, name)
+		}
+	}
+	return keys
+}
+
+// AllowsParameter reports whether the plan accepts the named parameter.
+func (p *ServicePlan) AllowsParameter(name string) bool {
+	if p.Metadata.AllowedParameters == nil {
+		return true
+	}
+
+	for _, allowed := range p.Metadata.AllowedParameters {
+		if allowed == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidateParameters returns an error naming every parameter which the plan
+// does not allow.
+func (p *ServicePlan) ValidateParameters(parameters interface{}) error {
+	param, ok := parameters.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	var rejected []string
+	for name := range param {
+		if !p.AllowsParameter(name) {
+			rejected = append(rejected, name)
+		}
+	}
+
+	if len(rejected) > 0 {
+		sort.Strings(rejected)
+		return fmt.Errorf("plan %s does not allow the parameters %s", p.Name, strings.Join(rejected, ", "))
+	}
+
+	return nil
+}
+
+// ProvisionSchema returns the JSON schema of the provisioning parameters, or
+// nil if the plan does not publish one.
+func (p *ServicePlan) ProvisionSchema() map[string]interface{} {
+	if p.Schemas == nil || p.Schemas.ServiceInstance.Create == nil {
+		return nil
+	}
+	return p.Schemas.ServiceInstance.Create.Parameters
+}
+
+// UpdateSchema returns the JSON schema of the update parameters, or nil if
+// the plan does not publish one.
+func (p *ServicePlan) UpdateSchema() map[string]interface{} {
+	if p.Schemas == nil || p.Schemas.ServiceInstance.Update == nil {
+		return nil
+	}
+	return p.Schemas.ServiceInstance.Update.Parameters
+}
+
+// AddParameterSchema adds the schema of a parameter to the provisioning and
+// update schemas of the plan, where the plan allows the parameter and the
+// schemas do not describe it already. Parameters which every plan accepts
+// alike are so described once rather than in every plan of the catalog.
+func (p *ServicePlan) AddParameterSchema(name string, schema map[string]interface{}) {
+	if !p.AllowsParameter(name) {
+		return
+	}
+
+	for _, parameters := range []map[string]interface{}{p.ProvisionSchema(), p.UpdateSchema()} {
+		addProperty(parameters, name, schema)
+	}
+}
+
+// AddBindParameterSchema adds the schema of a binding parameter to the
+// binding schema of the plan, like AddParameterSchema.
+func (p *ServicePlan) AddBindParameterSchema(name string, schema map[string]interface{}) {
+	if p.AllowsParameter(name) {
+		addProperty(p.BindSchema(), name, schema)
+	}
+}
+
+// addProperty adds the schema of a property to the object schema, unless it
+// describes the property already.
+func addProperty(parameters map[string]interface{}, name string, schema map[string]interface{}) {
+	if parameters == nil {
+		return
+	}
+	properties, ok := parameters["properties"].(map[string]interface{})
+	if !ok {
+		properties = make(map[string]interface{})
+		parameters["properties"] = properties
+	}
+	if _, ok := properties[name]; !ok {
+		properties[name] = schema
+	}
+}
+
+// BindSchema returns the JSON schema of the binding parameters, or nil if the
+// plan does not publish one.
+func (p *ServicePlan) BindSchema() map[string]interface{} {
+	if p.Schemas == nil || p.Schemas.ServiceBinding.Create == nil {
+		return nil
+	}
+	return p.Schemas.ServiceBinding.Create.Parameters
+}
+
+// ValidateUpdateTo returns an error if an instance of the plan cannot be moved
+// to the target plan. Azure converts general-purpose v1 accounts to v2, but
+// no other change of account kind.
+func (p *ServicePlan) ValidateUpdateTo(target *ServicePlan) error {
+	from, to := p.Metadata.Kind, target.Metadata.Kind
+	if from == to || (from == "Storage" && to == "StorageV2") {
+		return nil
+	}
+
+	return fmt.Errorf("plan %s (kind %s) cannot be changed to plan %s (kind %s)", p.Name, from, target.Name, to)
 }
@@ -0,0 +1,136 @@
+package model
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestValidateParameters(t *testing.T) {
+	restricted := ServicePlan{
+		Name: "restricted",
+		Metadata: ServicePlanMetadata{
+			AllowedParameters: []string{"location"},
+		},
+	}
+	locked := ServicePlan{
+		Name: "locked",
+		Metadata: ServicePlanMetadata{
+			AllowedParameters: []string{},
+		},
+	}
+	open := ServicePlan{Name: "open"}
+
+	for i, test := range []struct {
+		plan        ServicePlan
+		parameters  interface{}
+		expectedErr bool
+	}{
+		{restricted, map[string]interface{}{"location": "eastus"}, false},
+		{restricted, map[string]interface{}{"sku": "Premium_LRS"}, true},
+		{restricted, nil, false},
+		{locked, map[string]interface{}{}, false},
+		{locked, map[string]interface{}{"location": "eastus"}, true},
+		{open, map[string]interface{}{"sku": "Premium_LRS"}, false},
+	} {
+		err := test.plan.ValidateParameters(test.parameters)
+		if (err != nil) != test.expectedErr {
+			t.Errorf("Test %d: error was %v but expected error: %v\n", i, err, test.expectedErr)
+		}
+	}
+}
+
+func TestValidateUpdateTo(t *testing.T) {
+	v1 := ServicePlan{Name: "v1", Metadata: ServicePlanMetadata{Kind: "Storage"}}
+	v2 := ServicePlan{Name: "v2", Metadata: ServicePlanMetadata{Kind: "StorageV2"}}
+	blockBlob := ServicePlan{Name: "block-blob", Metadata: ServicePlanMetadata{Kind: "BlockBlobStorage"}}
+
+	for i, test := range []struct {
+		from        ServicePlan
+		to          ServicePlan
+		expectedErr bool
+	}{
+		{v1, v2, false},
+		{v2, v2, false},
+		{v2, v1, true},
+		{v2, blockBlob, true},
+		{blockBlob, v2, true},
+	} {
+		err := test.from.ValidateUpdateTo(&test.to)
+		if (err != nil) != test.expectedErr {
+			t.Errorf("Test %d: error was %v but expected error: %v\n", i, err, test.expectedErr)
+		}
+	}
+}
+
+func TestServicePlanMetadataRoundTrip(t *testing.T) {
+	for i, test := range []struct {
+		metadata string
+		expected string
+	}{
+		{`{"sku":"Standard_LRS"}`, `{"sku":"Standard_LRS"}`},
+		{
+			`{"displayName":"Standard","sku":"Standard_LRS","costs":[{"unit":"MONTHLY"}],"longDescription":"Locally redundant"}`,
+			`{"costs":[{"unit":"MONTHLY"}],"displayName":"Standard","longDescription":"Locally redundant","sku":"Standard_LRS"}`,
+		},
+	} {
+		var metadata ServicePlanMetadata
+		err := json.Unmarshal([]byte(test.metadata), &metadata)
+		if err != nil {
+			t.Errorf("Test %d: unexpected error %v\n", i, err)
+			continue
+		}
+		if metadata.Sku != "Standard_LRS" {
+			t.Errorf("Test %d: sku was %q\n", i, metadata.Sku)
+		}
+
+		data, err := json.Marshal(metadata)
+		if err != nil {
+			t.Errorf("Test %d: unexpected error %v\n", i, err)
+			continue
+		}
+		if string(data) != test.expected {
+			t.Errorf("Test %d: metadata was %s but expected %s\n", i, data, test.expected)
+		}
+	}
+}
+
+func TestAddParameterSchema(t *testing.T) {
+	tags := map[string]interface{}{"type": "object"}
+	own := map[string]interface{}{"type": "object", "maxProperties": 5.0}
+
+	for i, test := range []struct {
+		plan     ServicePlan
+		expected []interface{}
+	}{
+		{servicePlanWithSchemas(nil, map[string]interface{}{}, map[string]interface{}{"tags": own}), []interface{}{tags, own}},
+		{servicePlanWithSchemas([]string{"tags"}, map[string]interface{}{}, nil), []interface{}{tags, nil}},
+		{servicePlanWithSchemas([]string{"sku"}, map[string]interface{}{}, map[string]interface{}{}), []interface{}{nil, nil}},
+	} {
+		test.plan.AddParameterSchema("tags", tags)
+
+		for j, schema := range []map[string]interface{}{test.plan.ProvisionSchema(), test.plan.UpdateSchema()} {
+			var actual interface{}
+			if schema != nil {
+				properties, _ := schema["properties"].(map[string]interface{})
+				actual = properties["tags"]
+			}
+			if !reflect.DeepEqual(actual, test.expected[j]) {
+				t.Errorf("Test %d: schema %d of tags was %v but expected %v\n", i, j, actual, test.expected[j])
+			}
+		}
+	}
+}
+
+// servicePlanWithSchemas returns a plan with the provisioning and update
+// schemas of the properties, nil for no schema.
+func servicePlanWithSchemas(allowedParameters []string, provision, update map[string]interface{}) ServicePlan {
+	plan := ServicePlan{Metadata: ServicePlanMetadata{AllowedParameters: allowedParameters}, Schemas: &Schemas{}}
+	if provision != nil {
+		plan.Schemas.ServiceInstance.Create = &InputParametersSchema{Parameters: map[string]interface{}{"properties": provision}}
+	}
+	if update != nil {
+		plan.Schemas.ServiceInstance.Update = &InputParametersSchema{Parameters: map[string]interface{}{"properties": update}}
+	}
+	return plan
+}
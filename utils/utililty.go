@@ -45,8 +45,18 @@ func WriteResponse(w http.ResponseWriter, code int, object interface{}) {
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	fmt.Fprintf(w, string(data))
+	fmt.Fprint(w, string(data))
+}
+
+func WriteErrorResponse(w http.ResponseWriter, code int, errorCode, description string) {
+	response := make(map[string]string)
+	if errorCode != "" {
+		response["error"] = errorCode
+	}
+	response["description"] = description
+	WriteResponse(w, code, response)
 }
 
 func ProvisionDataFromRequest(r *http.Request, object interface{}) error {
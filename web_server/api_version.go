@@ -0,0 +1,137 @@
+package web_server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+const (
+	MIN_API_VERSION = "2.5"
+	MAX_API_VERSION = "2.17"
+)
+
+// ApiVersion is the OSB API version a request was made with. Features newer
+// than the version are hidden from the caller.
+type ApiVersion struct {
+	Major int
+	Minor int
+}
+
+func ParseApiVersion(apiVersion string) (ApiVersion, error) {
+	parts := strings.Split(apiVersion, ".")
+	if len(parts) != 2 {
+		return ApiVersion{}, fmt.Errorf("API version %q is not of the form major.minor", apiVersion)
+	}
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return ApiVersion{}, fmt.Errorf("API version %q has an invalid major version", apiVersion)
+	}
+
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return ApiVersion{}, fmt.Errorf("API version %q has an invalid minor version", apiVersion)
+	}
+
+	return ApiVersion{Major: major, Minor: minor}, nil
+}
+
+func mustParseApiVersion(apiVersion string) ApiVersion {
+	v, err := ParseApiVersion(apiVersion)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func (v ApiVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+func (v ApiVersion) AtLeast(other ApiVersion) bool {
+	return v.Major > other.Major || (v.Major == other.Major && v.Minor >= other.Minor)
+}
+
+// SupportsSchemas reports whether plans may carry parameter schemas.
+func (v ApiVersion) SupportsSchemas() bool {
+	return v.AtLeast(ApiVersion{2, 13})
+}
+
+// SupportsAsyncBindings reports whether bindings may be created
+// asynchronously and polled through last_operation.
+func (v ApiVersion) SupportsAsyncBindings() bool {
+	return v.AtLeast(ApiVersion{2, 14})
+}
+
+// SupportsFetchEndpoints reports whether instances and bindings may be read
+// through GET.
+func (v ApiVersion) SupportsFetchEndpoints() bool {
+	return v.AtLeast(ApiVersion{2, 14})
+}
+
+// SupportsMaintenanceInfo reports whether plans and requests may carry
+// maintenance_info.
+func (v ApiVersion) SupportsMaintenanceInfo() bool {
+	return v.AtLeast(ApiVersion{2, 15})
+}
+
+// negotiateApiVersion returns the version the broker speaks with a caller
+// which sent the header value. Callers newer than the broker are served as
+// MAX_API_VERSION.
+func negotiateApiVersion(header, minimum, maximum string) (ApiVersion, error) {
+	actual, err := ParseApiVersion(header)
+	if err != nil {
+		return ApiVersion{}, err
+	}
+
+	min, max := mustParseApiVersion(minimum), mustParseApiVersion(maximum)
+	if actual.Major != min.Major || !actual.AtLeast(min) {
+		return ApiVersion{}, fmt.Errorf("API version %s is not supported, the broker supports %s to %s", actual, min, max)
+	}
+
+	if actual.AtLeast(max) {
+		return max, nil
+	}
+	return actual, nil
+}
+
+// requestApiVersion returns the version negotiated by the
+// NegotiateApiVersion middleware.
+func requestApiVersion(r *http.Request) ApiVersion {
+	if v, ok := r.Context().Value(apiVersionKey).(ApiVersion); ok {
+		return v
+	}
+	return mustParseApiVersion(MIN_API_VERSION)
+}
+
+// catalogForApiVersion returns the catalog without the fields which the
+// caller's API version does not know.
+func catalogForApiVersion(catalog *model.Catalog, v ApiVersion) *model.Catalog {
+	result := model.Catalog{Services: make([]model.Service, len(catalog.Services))}
+
+	for i, service := range catalog.Services {
+		if !v.SupportsFetchEndpoints() {
+			service.InstancesRetrievable = false
+			service.BindingsRetrievable = false
+		}
+
+		service.Plans = make([]model.ServicePlan, len(catalog.Services[i].Plans))
+		for j, plan := range catalog.Services[i].Plans {
+			if !v.SupportsSchemas() {
+				plan.Schemas = nil
+			}
+			if !v.SupportsMaintenanceInfo() {
+				plan.MaintenanceInfo = nil
+			}
+			service.Plans[j] = plan
+		}
+
+		result.Services[i] = service
+	}
+
+	return &result
+}
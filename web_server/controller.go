@@ -4,134 +4,174 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
-	"strconv"
-	"strings"
+	"reflect"
+	"sync"
 
 	"github.com/Azure/azure-sdk-for-go/arm/storage"
 	storageclient "github.com/Azure/azure-sdk-for-go/storage"
 
 	ac "github.com/bingosummer/azure_storage_service_broker/azure_client"
+	"github.com/bingosummer/azure_storage_service_broker/broker_error"
+	"github.com/bingosummer/azure_storage_service_broker/config"
+	"github.com/bingosummer/azure_storage_service_broker/json_schema"
 	"github.com/bingosummer/azure_storage_service_broker/model"
 	"github.com/bingosummer/azure_storage_service_broker/utils"
 )
 
-const (
-	X_BROKER_API_VERSION_NAME = "X-Broker-Api-Version"
-	X_BROKER_API_VERSION      = "2.5"
-)
-
 type Controller struct {
-	serviceClient ac.Client
-
+	// The configuration the broker started with, for the settings which need
+	// a restart. Everything else comes from the snapshot of the request.
+	conf      *config.Config
+	snapshots *SnapshotStore
+	capacity  *CapacityTracker
+
+	// The instances in the map are not changed in place: a request changes a
+	// copy and saves it, so an instance which was looked up stays consistent
 	instanceMap map[string]*model.ServiceInstance
 	bindingMap  map[string]*model.ServiceBinding
-}
 
-func NewController(instanceMap map[string]*model.ServiceInstance, bindingMap map[string]*model.ServiceBinding) *Controller {
-	serviceClient := ac.NewClient()
-	if serviceClient == nil {
-		return nil
-	}
+	// The instances an update or a remediation is changing in Azure, which
+	// is recorded only when it is done
+	operations map[string]bool
 
+	// Guards instanceMap, bindingMap and operations, which concurrent
+	// requests, asynchronous bindings and the reconciler update
+	mutex sync.RWMutex
+}
+
+func NewController(conf *config.Config, snapshots *SnapshotStore, instanceMap map[string]*model.ServiceInstance, bindingMap map[string]*model.ServiceBinding) *Controller {
 	return &Controller{
-		instanceMap:   instanceMap,
-		bindingMap:    bindingMap,
-		serviceClient: serviceClient,
+		conf:        conf,
+		snapshots:   snapshots,
+		capacity:    NewCapacityTracker(),
+		instanceMap: instanceMap,
+		bindingMap:  bindingMap,
+		operations:  make(map[string]bool),
 	}
 }
 
 func (c *Controller) Catalog(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("Get Service Broker Catalog...")
 
-	statusCode, err := authentication(r)
+	utils.WriteResponse(w, http.StatusOK, catalogForApiVersion(c.snapshot(r).Catalog, requestApiVersion(r)))
+}
+
+func (c *Controller) CreateServiceInstance(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Create Service Instance...")
+
+	snapshot := c.snapshot(r)
+
+	var instance model.ServiceInstance
+	instance.DashboardUrl = "http://dashbaord_url"
+
+	err := utils.ProvisionDataFromRequest(r, &instance)
 	if err != nil {
-		w.WriteHeader(statusCode)
+		broker_error.Write(w, broker_error.BadRequest("The request body is invalid: "+err.Error()))
 		return
 	}
 
-	apiVersion := r.Header.Get(X_BROKER_API_VERSION_NAME)
-	supported := validateApiVersion(apiVersion, X_BROKER_API_VERSION)
-	if !supported {
-		fmt.Printf("API Version is %s, not supported.\n", apiVersion)
-		w.WriteHeader(http.StatusPreconditionFailed)
+	acceptsIncomplete := r.URL.Query().Get("accepts_incomplete")
+	if acceptsIncomplete != "true" {
+		broker_error.Write(w, broker_error.AsyncRequired())
 		return
 	}
-	fmt.Println("API Version is " + apiVersion)
 
-	var catalog model.Catalog
-	err = utils.ReadAndUnmarshal(&catalog, conf.CatalogPath, "catalog.json")
+	_, plan, err := snapshot.Catalog.FindPlan(instance.ServiceId, instance.PlanId)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Printf("Invalid provision request: %v\n", err)
+		broker_error.Write(w, broker_error.BadRequest(err.Error()))
 		return
 	}
 
-	utils.WriteResponse(w, http.StatusOK, catalog)
-}
-
-func (c *Controller) CreateServiceInstance(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Create Service Instance...")
-
-	statusCode, err := authentication(r)
-	if err != nil {
-		w.WriteHeader(statusCode)
-		return
+	containerAccessType := storageclient.ContainerAccessTypePrivate
+	if param, ok := instance.Parameters.(map[string]interface{}); ok {
+		if v, ok := param["container_access_type"].(string); ok {
+			containerAccessType = storageclient.ContainerAccessType(v)
+		}
 	}
 
-	var instance model.ServiceInstance
-	instance.DashboardUrl = "http://dashbaord_url"
-
-	err = utils.ProvisionDataFromRequest(r, &instance)
+	err = validateParameters(plan, plan.ProvisionSchema(), instance.Parameters)
+	if err == nil {
+		_, err = ac.UserTags(instance.Parameters, snapshot.Conf.Tags)
+	}
+	if err == nil {
+		err = validateSecurity(&plan.Metadata, instance.Parameters, containerAccessType)
+	}
+	if err == nil {
+		_, err = ac.InstanceNetworkRules(instance.Parameters, snapshot.Conf.Network.EgressIps)
+	}
+	if err == nil {
+		err = validatePrivateEndpoint(snapshot.Conf, plan, instance.Parameters)
+	}
 	if err != nil {
-		fmt.Println("Failed to provision data from request")
-		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Printf("Invalid provision parameters: %v\n", err)
+		broker_error.Write(w, broker_error.InvalidParameters(err))
 		return
 	}
 
-	acceptsIncomplete := r.URL.Query().Get("accepts_incomplete")
-	if acceptsIncomplete != "true" {
-		fmt.Println("Only asynchronous provisioning is supported")
-		response := make(map[string]string)
-		response["error"] = "AsyncRequired"
-		response["description"] = "This service plan requires client support for asynchronous service operations."
-		utils.WriteResponse(w, 422, response)
+	if instance.MaintenanceInfo != nil && instance.MaintenanceInfo.Version != plan.MaintenanceInfo.MaintenanceVersion() {
+		broker_error.Write(w, broker_error.MaintenanceInfoConflict("maintenance_info.version "+instance.MaintenanceInfo.Version+" does not match the catalog"))
 		return
 	}
+	instance.MaintenanceInfo = plan.MaintenanceInfo
 
 	serviceInstanceGuid := utils.ExtractVarsFromRequest(r, "service_instance_guid")
 	instance.Id = serviceInstanceGuid
+	instance.OriginatingIdentity = OriginatingIdentity(r)
+	if instance.Context != nil {
+		if instance.OrganizationGuid == "" {
+			instance.OrganizationGuid = instance.Context.OrganizationGuid
+		}
+		if instance.SpaceGuid == "" {
+			instance.SpaceGuid = instance.Context.SpaceGuid
+		}
+	}
 
-	var containerAccessType storageclient.ContainerAccessType
-	switch instance.Parameters.(type) {
-	case map[string]interface{}:
-		param := instance.Parameters.(map[string]interface{})
+	err = instance.ValidatePlatform()
+	if err != nil {
+		fmt.Printf("Invalid provision request: %v\n", err)
+		broker_error.Write(w, broker_error.BadRequest(err.Error()))
+		return
+	}
 
-		if param["container_access_type"] != nil {
-			containerAccessType = storageclient.ContainerAccessType(param["container_access_type"].(string))
-		} else {
-			containerAccessType = storageclient.ContainerAccessTypePrivate
-		}
-	default:
-		containerAccessType = storageclient.ContainerAccessTypePrivate
+	instance.Location = ac.InstanceLocation(plan, instance.Parameters, snapshot.Conf.Defaults)
+	err = validateLocation(snapshot.Conf, plan, &instance)
+	if err != nil {
+		broker_error.Write(w, err)
+		return
 	}
 
-	resourceGroupName, storageAccountName, err := c.serviceClient.CreateInstance(serviceInstanceGuid, instance.Parameters)
+	instance.Profile, err = c.capacity.Place(snapshot, placementCandidates(snapshot.Conf, plan, instance.Parameters), instance.Location)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		broker_error.Write(w, err)
+		return
+	}
+	serviceClient, ok := c.serviceClient(w, snapshot, &instance)
+	if !ok {
+		c.capacity.Release(snapshot, &instance)
+		return
+	}
+
+	audit(r, "provision", "service instance "+instance.Id+" in subscription "+instance.Profile)
+
+	resourceGroupName, storageAccountName, containerName, err := serviceClient.CreateInstance(&instance, plan)
+	if err != nil {
+		c.capacity.Release(snapshot, &instance)
+		broker_error.Write(w, err)
 		return
 	}
 
 	instance.ResourceGroupName = resourceGroupName
 	instance.StorageAccountName = storageAccountName
+	instance.ContainerName = containerName
 	instance.ContainerAccessType = containerAccessType
 
 	instance.State = "in progress"
 	instance.Description = "creating service instance..."
 
-	c.instanceMap[instance.Id] = &instance
-	err = utils.MarshalAndRecord(c.instanceMap, conf.DataPath, conf.ServiceInstancesFileName)
+	err = c.saveInstance(&instance)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		broker_error.Write(w, err)
 		return
 	}
 
@@ -141,28 +181,264 @@ func (c *Controller) CreateServiceInstance(w http.ResponseWriter, r *http.Reques
 	utils.WriteResponse(w, http.StatusAccepted, response)
 }
 
-func (c *Controller) GetServiceInstance(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Get Service Instance State....")
+func (c *Controller) UpdateServiceInstance(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Update Service Instance...")
+
+	snapshot := c.snapshot(r)
+
+	var request model.UpdateServiceInstanceRequest
+	err := utils.ProvisionDataFromRequest(r, &request)
+	if err != nil {
+		broker_error.Write(w, broker_error.BadRequest("The request body is invalid: "+err.Error()))
+		return
+	}
+
+	instanceId := utils.ExtractVarsFromRequest(r, "service_instance_guid")
+	if !c.beginOperation(instanceId) {
+		broker_error.Write(w, broker_error.ConcurrencyError("Service instance "+instanceId+" is being updated"))
+		return
+	}
+	defer c.endOperation(instanceId)
+
+	instance := c.getInstance(instanceId)
+	if instance == nil {
+		broker_error.Write(w, broker_error.NotFound("Service instance "+instanceId+" does not exist"))
+		return
+	}
+	if instance.Deprovisioning {
+		broker_error.Write(w, broker_error.ConcurrencyError("Service instance "+instanceId+" is being deprovisioned"))
+		return
+	}
+	instance = copyInstance(instance)
+
+	if request.PlanId == "" {
+		request.PlanId = instance.PlanId
+	}
+
+	service, plan, err := snapshot.Catalog.FindPlan(request.ServiceId, request.PlanId)
+	if err != nil {
+		fmt.Printf("Invalid update request: %v\n", err)
+		broker_error.Write(w, broker_error.BadRequest(err.Error()))
+		return
+	}
+
+	err = validateParameters(plan, plan.UpdateSchema(), request.Parameters)
+	if err == nil {
+		_, err = ac.UserTags(request.Parameters, snapshot.Conf.Tags)
+	}
+	if err == nil {
+		// The security settings of the plan only apply when the plan changes
+		var defaults *model.ServicePlanMetadata
+		if plan.Id != instance.PlanId {
+			defaults = &plan.Metadata
+		}
+		err = validateSecurity(defaults, request.Parameters, instance.ContainerAccessType)
+	}
+	if err == nil {
+		_, err = ac.InstanceNetworkRules(request.Parameters, snapshot.Conf.Network.EgressIps)
+	}
+	if err != nil {
+		fmt.Printf("Invalid update parameters: %v\n", err)
+		broker_error.Write(w, broker_error.InvalidParameters(err))
+		return
+	}
+
+	if plan.Id != instance.PlanId {
+		if !service.PlanUpdateable {
+			broker_error.Write(w, broker_error.BadRequest("The plan of service "+service.Name+" cannot be changed"))
+			return
+		}
+
+		currentPlan := service.FindPlan(instance.PlanId)
+		if currentPlan != nil {
+			err = currentPlan.ValidateUpdateTo(plan)
+			if err != nil {
+				broker_error.Write(w, broker_error.BadRequest(err.Error()))
+				return
+			}
+		}
+	}
+
+	err = validateProfileUpdate(instance, plan, request.Parameters)
+	if err != nil {
+		broker_error.Write(w, err)
+		return
+	}
 
-	statusCode, err := authentication(r)
+	upgrade, err := maintenanceUpgrade(instance, plan, request.MaintenanceInfo)
 	if err != nil {
-		w.WriteHeader(statusCode)
+		broker_error.Write(w, err)
+		return
+	}
+
+	serviceClient, ok := c.serviceClient(w, snapshot, instance)
+	if !ok {
+		return
+	}
+	audit(r, "update", "service instance "+instance.Id)
+
+	updated := *instance
+	updated.Context = instance.Context.Merge(request.Context)
+	planChanged := plan.Id != instance.PlanId
+	if planChanged || request.Parameters != nil {
+		err = serviceClient.UpdateInstance(&updated, plan, request.Parameters)
+		if err != nil {
+			broker_error.Write(w, err)
+			return
+		}
+		instance.PlanId = plan.Id
+		instance.Configuration = updated.Configuration
+		instance.NetworkRules = updated.NetworkRules
+	}
+
+	// A new organization or space name only changes the tags, which the
+	// update above sets only with a new plan or new tags
+	param, _ := request.Parameters.(map[string]interface{})
+	_, tagsChanged := param[ac.TAGS_PARAMETER]
+	if !reflect.DeepEqual(updated.Context, instance.Context) && !planChanged && !tagsChanged {
+		err = serviceClient.TagInstance(&updated, plan)
+		if err != nil {
+			broker_error.Write(w, err)
+			return
+		}
+	}
+
+	if upgrade {
+		err = serviceClient.UpgradeInstance(instance.ResourceGroupName, instance.StorageAccountName, instance.MaintenanceInfo.MaintenanceVersion(), plan.MaintenanceInfo.Version)
+		if err != nil {
+			broker_error.Write(w, err)
+			return
+		}
+		// Instances provisioned before drift detection have no desired configuration
+		if instance.Configuration != nil {
+			upgraded, err := ac.UpgradeConfiguration(instance.Configuration, instance.MaintenanceInfo.MaintenanceVersion(), plan.MaintenanceInfo.Version)
+			if err == nil {
+				instance.Configuration = upgraded
+			}
+		}
+		instance.MaintenanceInfo = plan.MaintenanceInfo
+	}
+
+	if param, ok := request.Parameters.(map[string]interface{}); ok {
+		merged := make(map[string]interface{})
+		if stored, ok := instance.Parameters.(map[string]interface{}); ok {
+			for name, value := range stored {
+				merged[name] = value
+			}
+		}
+		for name, value := range param {
+			merged[name] = value
+		}
+		instance.Parameters = merged
+	}
+
+	instance.Context = instance.Context.Merge(request.Context)
+
+	err = c.saveInstance(instance)
+	if err != nil {
+		broker_error.Write(w, err)
+		return
+	}
+
+	response := make(map[string]string)
+	utils.WriteResponse(w, http.StatusOK, response)
+}
+
+func (c *Controller) FetchServiceInstance(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Fetch Service Instance...")
+
+	if !requireFeature(w, requestApiVersion(r).SupportsFetchEndpoints(), "Fetching a service instance") {
 		return
 	}
 
 	instanceId := utils.ExtractVarsFromRequest(r, "service_instance_guid")
-	instance := c.instanceMap[instanceId]
+	instance := c.getInstance(instanceId)
+	if instance == nil || instance.State == "in progress" {
+		broker_error.Write(w, broker_error.NotFound("Service instance "+instanceId+" does not exist or is being provisioned"))
+		return
+	}
+
+	response := model.GetServiceInstanceResponse{
+		ServiceId:    instance.ServiceId,
+		PlanId:       instance.PlanId,
+		DashboardUrl: instance.DashboardUrl,
+		Parameters:   instance.Parameters,
+		NetworkRules: instance.NetworkRules,
+	}
+	if requestApiVersion(r).SupportsMaintenanceInfo() {
+		response.MaintenanceInfo = instance.MaintenanceInfo
+	}
+	utils.WriteResponse(w, http.StatusOK, response)
+}
+
+func (c *Controller) GetServiceInstance(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Get Service Instance State....")
+
+	snapshot := c.snapshot(r)
+
+	instanceId := utils.ExtractVarsFromRequest(r, "service_instance_guid")
+	instance := c.getInstance(instanceId)
+	if instance == nil {
+		utils.WriteResponse(w, http.StatusGone, make(map[string]string))
+		return
+	}
+
+	// A poll takes the next step of the operation in Azure, so it takes turns
+	// with other polls, updates and the reconciler. While one of them has the
+	// instance, the state last recorded is reported.
+	if !c.beginOperation(instanceId) {
+		writeLastOperation(w, instance)
+		return
+	}
+	defer c.endOperation(instanceId)
+
+	instance = c.getInstance(instanceId)
 	if instance == nil {
-		w.WriteHeader(http.StatusGone)
+		utils.WriteResponse(w, http.StatusGone, make(map[string]string))
+		return
+	}
+	instance = copyInstance(instance)
+
+	serviceClient, ok := c.serviceClient(w, snapshot, instance)
+	if !ok {
+		return
+	}
+
+	if instance.Deprovisioning {
+		gone, err := serviceClient.DeletePrivateEndpoint(instance.ResourceGroupName, instance.PrivateEndpoint.Name)
+		if err != nil {
+			instance.State = "failed"
+			instance.Description = "Failed to delete the private endpoint of the service instance: " + broker_error.FromAzureError(err).Description
+		} else if !gone {
+			instance.State = "in progress"
+			instance.Description = "Deleting the private endpoint of the service instance"
+		} else {
+			err = c.deleteInstance(snapshot, serviceClient, instance)
+			if err != nil {
+				broker_error.Write(w, err)
+				return
+			}
+			instance.State = "succeeded"
+			instance.Description = "Successfully deleted the service instance"
+			writeLastOperation(w, instance)
+			return
+		}
+
+		err = c.saveInstance(instance)
+		if err != nil {
+			broker_error.Write(w, err)
+			return
+		}
+		writeLastOperation(w, instance)
 		return
 	}
 
-	state, err := c.serviceClient.GetInstanceState(instance.ResourceGroupName, instance.StorageAccountName)
+	state, err := serviceClient.GetInstanceState(instance.ResourceGroupName, instance.StorageAccountName)
 	if err != nil {
-		if strings.Contains(err.Error(), "404") {
-			w.WriteHeader(http.StatusGone)
+		if broker_error.IsNotFound(err) {
+			utils.WriteResponse(w, http.StatusGone, make(map[string]string))
 		} else {
-			w.WriteHeader(http.StatusInternalServerError)
+			broker_error.Write(w, err)
 		}
 		return
 	}
@@ -173,17 +449,34 @@ func (c *Controller) GetServiceInstance(w http.ResponseWriter, r *http.Request)
 	} else if state == storage.Succeeded {
 		instance.State = "succeeded"
 		instance.Description = "Successfully created the service instance, state: " + string(state)
+
+		// The private endpoint needs the storage account, so it is
+		// provisioned step by step while the platform polls
+		if instance.PrivateEndpoint != nil && !instance.PrivateEndpoint.Ready() {
+			ready, err := serviceClient.ProvisionPrivateEndpoint(instance)
+			if err != nil {
+				instance.State = "failed"
+				instance.Description = "Failed to create the private endpoint of the service instance: " + broker_error.FromAzureError(err).Description
+			} else if !ready {
+				instance.State = "in progress"
+				instance.Description = "Creating the private endpoint of the service instance"
+			}
+		}
 	} else {
 		instance.State = "failed"
 		instance.Description = "Failed to create the service instance, state: " + string(state)
 	}
 
-	err = utils.MarshalAndRecord(c.instanceMap, conf.DataPath, conf.ServiceInstancesFileName)
+	err = c.saveInstance(instance)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		broker_error.Write(w, err)
 		return
 	}
 
+	writeLastOperation(w, instance)
+}
+
+func writeLastOperation(w http.ResponseWriter, instance *model.ServiceInstance) {
 	response := model.CreateLastOperationResponse{
 		State:       instance.State,
 		Description: instance.Description,
@@ -194,35 +487,65 @@ func (c *Controller) GetServiceInstance(w http.ResponseWriter, r *http.Request)
 func (c *Controller) RemoveServiceInstance(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("Remove Service Instance...")
 
-	statusCode, err := authentication(r)
-	if err != nil {
-		w.WriteHeader(statusCode)
-		return
-	}
+	snapshot := c.snapshot(r)
 
 	instanceId := utils.ExtractVarsFromRequest(r, "service_instance_guid")
-	instance := c.instanceMap[instanceId]
+	instance := c.getInstance(instanceId)
 	if instance == nil {
-		w.WriteHeader(http.StatusGone)
+		utils.WriteResponse(w, http.StatusGone, make(map[string]string))
 		return
 	}
 
-	err = c.serviceClient.DeleteInstance(instance.ResourceGroupName, instance.StorageAccountName)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	serviceClient, ok := c.serviceClient(w, snapshot, instance)
+	if !ok {
 		return
 	}
+	// Azure deletes the private endpoint in the background and keeps the
+	// storage account until then, so the account is deleted by the polls of
+	// last_operation
+	if instance.PrivateEndpoint != nil {
+		if r.URL.Query().Get("accepts_incomplete") != "true" {
+			broker_error.Write(w, broker_error.AsyncRequired())
+			return
+		}
+		if !c.beginOperation(instanceId) {
+			broker_error.Write(w, broker_error.ConcurrencyError("Service instance "+instanceId+" is being changed"))
+			return
+		}
+		defer c.endOperation(instanceId)
+
+		instance = c.getInstance(instanceId)
+		if instance == nil {
+			utils.WriteResponse(w, http.StatusGone, make(map[string]string))
+			return
+		}
+	}
+	audit(r, "deprovision", "service instance "+instance.Id)
 
-	delete(c.instanceMap, instanceId)
-	utils.MarshalAndRecord(c.instanceMap, conf.DataPath, conf.ServiceInstancesFileName)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	if instance.PrivateEndpoint != nil {
+		gone, err := serviceClient.DeletePrivateEndpoint(instance.ResourceGroupName, instance.PrivateEndpoint.Name)
+		if err != nil {
+			broker_error.Write(w, err)
+			return
+		}
+		if !gone {
+			instance = copyInstance(instance)
+			instance.Deprovisioning = true
+			instance.State = "in progress"
+			instance.Description = "Deleting the private endpoint of the service instance"
+			err = c.saveInstance(instance)
+			if err != nil {
+				broker_error.Write(w, err)
+				return
+			}
+			utils.WriteResponse(w, http.StatusAccepted, model.AsyncOperationResponse{Operation: "deprovision"})
+			return
+		}
 	}
 
-	err = c.deleteAssociatedBindings(instanceId)
+	err := c.deleteInstance(snapshot, serviceClient, instance)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		broker_error.Write(w, err)
 		return
 	}
 
@@ -230,85 +553,206 @@ func (c *Controller) RemoveServiceInstance(w http.ResponseWriter, r *http.Reques
 	utils.WriteResponse(w, http.StatusOK, response)
 }
 
+// deleteInstance deletes the storage account of the instance and forgets the
+// instance with its bindings.
+func (c *Controller) deleteInstance(snapshot *Snapshot, serviceClient ac.Client, instance *model.ServiceInstance) error {
+	err := serviceClient.DeleteInstance(instance.ResourceGroupName, instance.StorageAccountName)
+	if err != nil && !broker_error.IsNotFound(err) {
+		return err
+	}
+	c.capacity.Release(snapshot, instance)
+
+	err = c.removeInstance(instance.Id)
+	if err != nil {
+		return err
+	}
+	return c.deleteAssociatedBindings(instance.Id)
+}
+
 func (c *Controller) Bind(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("Bind Service Instance...")
 
-	statusCode, err := authentication(r)
+	snapshot := c.snapshot(r)
+
+	var request model.CreateServiceBindingRequest
+	err := utils.ProvisionDataFromRequest(r, &request)
 	if err != nil {
-		w.WriteHeader(statusCode)
+		broker_error.Write(w, broker_error.BadRequest("The request body is invalid: "+err.Error()))
 		return
 	}
 
 	bindingId := utils.ExtractVarsFromRequest(r, "service_binding_guid")
 	instanceId := utils.ExtractVarsFromRequest(r, "service_instance_guid")
 
-	instance := c.instanceMap[instanceId]
+	instance := c.getInstance(instanceId)
 	if instance == nil {
-		w.WriteHeader(http.StatusNotFound)
+		broker_error.Write(w, broker_error.NotFound("Service instance "+instanceId+" does not exist"))
 		return
 	}
 
-	primaryAccessKey, secondaryAccessKey, containerName, err := c.serviceClient.GetAccessKeys(instanceId, instance.ResourceGroupName, instance.StorageAccountName, instance.ContainerAccessType)
+	_, plan, err := snapshot.Catalog.FindPlan(request.ServiceId, request.PlanId)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Printf("Invalid bind request: %v\n", err)
+		broker_error.Write(w, broker_error.BadRequest(err.Error()))
 		return
 	}
 
-	credentials := model.Credentials{
-		StorageAccountName: instance.StorageAccountName,
-		ContainerName:      containerName,
-		PrimaryAccessKey:   primaryAccessKey,
-		SecondaryAccessKey: secondaryAccessKey,
+	err = validateParameters(plan, plan.BindSchema(), request.Parameters)
+	if err != nil {
+		fmt.Printf("Invalid bind parameters: %v\n", err)
+		broker_error.Write(w, broker_error.InvalidParameters(err))
+		return
 	}
 
-	response := model.CreateServiceBindingResponse{
-		Credentials: credentials,
+	// The account keys do not work then, so the application needs access
+	// through its Azure AD identity
+	if ac.BindingPrincipal(request.Parameters) == "" && !instance.AllowsSharedKeyAccess() {
+		broker_error.Write(w, broker_error.BadRequest("Storage account "+instance.StorageAccountName+" does not allow shared key access, bind with the "+ac.PRINCIPAL_ID_PARAMETER+" parameter of the Azure AD identity of the application"))
+		return
 	}
 
-	c.bindingMap[bindingId] = &model.ServiceBinding{
-		Id:                bindingId,
-		ServiceId:         instance.ServiceId,
-		ServicePlanId:     instance.PlanId,
-		ServiceInstanceId: instance.Id,
-		Credentials:       credentials,
+	if plan.Metadata.MaxBindings > 0 && c.countBindings(instanceId, bindingId) >= plan.Metadata.MaxBindings {
+		description := fmt.Sprintf("Plan %s allows at most %d bindings per service instance", plan.Name, plan.Metadata.MaxBindings)
+		broker_error.Write(w, broker_error.BadRequest(description))
+		return
+	}
+
+	binding := &model.ServiceBinding{
+		Id:                  bindingId,
+		AppId:               request.AppGuid,
+		ServiceId:           instance.ServiceId,
+		ServicePlanId:       instance.PlanId,
+		ServiceInstanceId:   instance.Id,
+		Parameters:          request.Parameters,
+		Context:             request.Context,
+		OriginatingIdentity: OriginatingIdentity(r),
+		State:               "in progress",
+		Description:         "creating service binding...",
 	}
 
-	err = utils.MarshalAndRecord(c.bindingMap, conf.DataPath, conf.ServiceBindingsFileName)
+	serviceClient, ok := c.serviceClient(w, snapshot, instance)
+	if !ok {
+		return
+	}
+	audit(r, "bind", "service binding "+bindingId)
+
+	if r.URL.Query().Get("accepts_incomplete") == "true" && requestApiVersion(r).SupportsAsyncBindings() {
+		err = c.saveBinding(binding)
+		if err != nil {
+			broker_error.Write(w, err)
+			return
+		}
+
+		go c.completeBinding(serviceClient, instance, binding)
+
+		utils.WriteResponse(w, http.StatusAccepted, model.AsyncOperationResponse{Operation: "bind"})
+		return
+	}
+
+	err = c.createCredentials(serviceClient, instance, binding)
+	if err != nil {
+		broker_error.Write(w, err)
+		return
+	}
+
+	err = c.saveBinding(binding)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		broker_error.Write(w, err)
 		return
 	}
 
+	response := model.CreateServiceBindingResponse{
+		Credentials: bindingCredentials(instance, binding),
+	}
 	utils.WriteResponse(w, http.StatusCreated, response)
 }
 
-func (c *Controller) UnBind(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Unbind Service Instance...")
+func (c *Controller) FetchServiceBinding(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Fetch Service Binding...")
 
-	statusCode, err := authentication(r)
-	if err != nil {
-		w.WriteHeader(statusCode)
+	if !requireFeature(w, requestApiVersion(r).SupportsFetchEndpoints(), "Fetching a service binding") {
 		return
 	}
 
 	bindingId := utils.ExtractVarsFromRequest(r, "service_binding_guid")
 	instanceId := utils.ExtractVarsFromRequest(r, "service_instance_guid")
-	instance := c.instanceMap[instanceId]
+	instance := c.getInstance(instanceId)
+	binding := c.getBinding(bindingId)
+	if instance == nil || binding == nil || binding.State == "in progress" || binding.State == "failed" {
+		broker_error.Write(w, broker_error.NotFound("Service binding "+bindingId+" does not exist or is being created"))
+		return
+	}
+
+	response := model.GetServiceBindingResponse{
+		Credentials: bindingCredentials(instance, binding),
+		Parameters:  binding.Parameters,
+	}
+	utils.WriteResponse(w, http.StatusOK, response)
+}
+
+func (c *Controller) GetServiceBinding(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Get Service Binding State...")
+
+	if !requireFeature(w, requestApiVersion(r).SupportsAsyncBindings(), "Polling a service binding") {
+		return
+	}
+
+	bindingId := utils.ExtractVarsFromRequest(r, "service_binding_guid")
+	binding := c.getBinding(bindingId)
+	if binding == nil {
+		utils.WriteResponse(w, http.StatusGone, make(map[string]string))
+		return
+	}
+
+	response := model.CreateLastOperationResponse{
+		State:       binding.State,
+		Description: binding.Description,
+	}
+	utils.WriteResponse(w, http.StatusOK, response)
+}
+
+func (c *Controller) UnBind(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Unbind Service Instance...")
+
+	snapshot := c.snapshot(r)
+
+	bindingId := utils.ExtractVarsFromRequest(r, "service_binding_guid")
+	instanceId := utils.ExtractVarsFromRequest(r, "service_instance_guid")
+	instance := c.getInstance(instanceId)
 	if instance == nil {
-		w.WriteHeader(http.StatusGone)
+		utils.WriteResponse(w, http.StatusGone, make(map[string]string))
 		return
 	}
 
-	err = c.serviceClient.RegenerateAccessKeys(instance.ResourceGroupName, instance.StorageAccountName)
+	serviceClient, ok := c.serviceClient(w, snapshot, instance)
+	if !ok {
+		return
+	}
+	audit(r, "unbind", "service binding "+bindingId)
+
+	var err error
+	binding := c.getBinding(bindingId)
+	if binding != nil && binding.Credentials.PrincipalId != "" {
+		// The binding never had the keys, so they are kept
+		err = serviceClient.RevokeContainerAccess(instance.ResourceGroupName, instance.StorageAccountName, binding.Credentials.ContainerName, bindingId)
+	} else {
+		// Bindings of private instances have no access policy
+		if binding != nil && binding.Credentials.ContainerName != "" && instance.AllowsSharedKeyAccess() && instance.PrivateEndpoint == nil {
+			err = serviceClient.ForgetBinding(instance.ResourceGroupName, instance.StorageAccountName, binding.Credentials.ContainerName, bindingId)
+			if err != nil {
+				fmt.Printf("WARNING: removing the access policy of service binding %s failed:\n%v\n", bindingId, err)
+			}
+		}
+		err = serviceClient.RegenerateAccessKeys(instance.ResourceGroupName, instance.StorageAccountName)
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		broker_error.Write(w, err)
 		return
 	}
 
-	delete(c.bindingMap, bindingId)
-	err = utils.MarshalAndRecord(c.bindingMap, conf.DataPath, conf.ServiceBindingsFileName)
+	err = c.removeBinding(bindingId)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		broker_error.Write(w, err)
 		return
 	}
 
@@ -316,65 +760,325 @@ func (c *Controller) UnBind(w http.ResponseWriter, r *http.Request) {
 	utils.WriteResponse(w, http.StatusOK, response)
 }
 
+// snapshot returns the snapshot the request is served with.
+func (c *Controller) snapshot(r *http.Request) *Snapshot {
+	if snapshot := RequestSnapshot(r); snapshot != nil {
+		return snapshot
+	}
+	return c.snapshots.Current()
+}
+
+// serviceClient returns the Azure client of the credential profile the
+// instance lives in, or writes an error if the profile is no longer
+// configured.
+func (c *Controller) serviceClient(w http.ResponseWriter, snapshot *Snapshot, instance *model.ServiceInstance) (ac.Client, bool) {
+	serviceClient, err := snapshot.ServiceClient(instance.Profile)
+	if err != nil {
+		broker_error.Write(w, broker_error.Internal(fmt.Errorf("service instance %s cannot be reached: %v", instance.Id, err)))
+		return nil, false
+	}
+	return serviceClient, true
+}
+
+// completeBinding creates the credentials of an asynchronous binding and
+// records the outcome for last_operation.
+func (c *Controller) completeBinding(serviceClient ac.Client, instance *model.ServiceInstance, binding *model.ServiceBinding) {
+	completed := *binding
+
+	err := c.createCredentials(serviceClient, instance, &completed)
+	if err != nil {
+		completed.State = "failed"
+		completed.Description = "Failed to create the service binding: " + broker_error.FromAzureError(err).Description
+	}
+
+	err = c.saveBinding(&completed)
+	if err != nil {
+		fmt.Printf("Recording service binding %s failed with error:\n%v\n", completed.Id, err)
+	}
+}
+
+func (c *Controller) createCredentials(serviceClient ac.Client, instance *model.ServiceInstance, binding *model.ServiceBinding) error {
+	containerName := instance.ContainerName
+	if containerName == "" {
+		containerName = ac.LEGACY_CONTAINER_NAME_PREFIX + instance.Id
+	}
+
+	credentials := model.Credentials{
+		StorageAccountName: instance.StorageAccountName,
+		ContainerName:      containerName,
+		EndpointSuffix:     serviceClient.StorageEndpointSuffix(),
+	}
+	if instance.PrivateEndpoint != nil {
+		credentials.PrivateFqdn = instance.PrivateEndpoint.Fqdn
+	}
+
+	// A binding with an Azure AD identity is recorded by its role assignment
+	if principalId := ac.BindingPrincipal(binding.Parameters); principalId != "" {
+		err := serviceClient.GrantContainerAccess(instance.ResourceGroupName, instance.StorageAccountName, containerName, instance.ContainerAccessType, binding.Id, principalId)
+		if err != nil {
+			return err
+		}
+		credentials.PrincipalId = principalId
+	} else {
+		primaryAccessKey, secondaryAccessKey, _, err := serviceClient.GetAccessKeys(instance.ResourceGroupName, instance.StorageAccountName, containerName, instance.ContainerAccessType)
+		if err != nil {
+			return err
+		}
+		credentials.PrimaryAccessKey, credentials.SecondaryAccessKey = primaryAccessKey, secondaryAccessKey
+
+		// The access policy only serves recovery, so the binding works without
+		// it. The broker cannot reach the blob service of a private account.
+		if instance.PrivateEndpoint != nil {
+			fmt.Printf("Service binding %s of private service instance %s is not recorded on its container, it cannot be recovered from Azure\n", binding.Id, instance.Id)
+		} else {
+			err = serviceClient.RecordBinding(instance.ResourceGroupName, instance.StorageAccountName, containerName, binding.Id)
+			if err != nil {
+				fmt.Printf("WARNING: recording service binding %s on its container failed, it cannot be recovered from Azure:\n%v\n", binding.Id, err)
+			}
+		}
+	}
+
+	binding.Credentials = credentials
+	binding.State = "succeeded"
+	binding.Description = "Successfully created the service binding"
+	return nil
+}
+
+func (c *Controller) getInstance(instanceId string) *model.ServiceInstance {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.instanceMap[instanceId]
+}
+
+func (c *Controller) saveInstance(instance *model.ServiceInstance) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.instanceMap[instance.Id] = instance
+	return utils.MarshalAndRecord(c.instanceMap, c.conf.DataPath, c.conf.ServiceInstancesFileName)
+}
+
+func (c *Controller) removeInstance(instanceId string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.instanceMap, instanceId)
+	return utils.MarshalAndRecord(c.instanceMap, c.conf.DataPath, c.conf.ServiceInstancesFileName)
+}
+
+// instances returns a copy of the instance map. The instances themselves are
+// not changed in place.
+func (c *Controller) instances() map[string]*model.ServiceInstance {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	instances := make(map[string]*model.ServiceInstance, len(c.instanceMap))
+	for id, instance := range c.instanceMap {
+		instances[id] = instance
+	}
+	return instances
+}
+
+// beginOperation claims the instance for a change in Azure, and fails while
+// another one is in progress.
+func (c *Controller) beginOperation(instanceId string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.operations[instanceId] {
+		return false
+	}
+	c.operations[instanceId] = true
+	return true
+}
+
+func (c *Controller) endOperation(instanceId string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.operations, instanceId)
+}
+
+// copyInstance returns a copy of the instance for a request to change, down
+// to the parts which are changed in place.
+func copyInstance(instance *model.ServiceInstance) *model.ServiceInstance {
+	copied := *instance
+	if instance.PrivateEndpoint != nil {
+		endpoint := *instance.PrivateEndpoint
+		copied.PrivateEndpoint = &endpoint
+	}
+	return &copied
+}
+
+func (c *Controller) getBinding(bindingId string) *model.ServiceBinding {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.bindingMap[bindingId]
+}
+
+func (c *Controller) saveBinding(binding *model.ServiceBinding) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.bindingMap[binding.Id] = binding
+	return utils.MarshalAndRecord(c.bindingMap, c.conf.DataPath, c.conf.ServiceBindingsFileName)
+}
+
+func (c *Controller) removeBinding(bindingId string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.bindingMap, bindingId)
+	return utils.MarshalAndRecord(c.bindingMap, c.conf.DataPath, c.conf.ServiceBindingsFileName)
+}
+
 func (c *Controller) deleteAssociatedBindings(instanceId string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	for id, binding := range c.bindingMap {
 		if binding.ServiceInstanceId == instanceId {
 			delete(c.bindingMap, id)
 		}
 	}
 
-	return utils.MarshalAndRecord(c.bindingMap, conf.DataPath, conf.ServiceBindingsFileName)
+	return utils.MarshalAndRecord(c.bindingMap, c.conf.DataPath, c.conf.ServiceBindingsFileName)
+}
+
+func (c *Controller) countBindings(instanceId, excludedBindingId string) int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	count := 0
+	for id, binding := range c.bindingMap {
+		if binding.ServiceInstanceId == instanceId && id != excludedBindingId {
+			count++
+		}
+	}
+
+	return count
 }
 
-func authentication(r *http.Request) (int, error) {
-	authUsername, authPassword, err := loadAuthCredentials()
+// validateParameters checks the request parameters against the parameters the
+// plan allows and against the plan's JSON schema for the operation.
+func validateParameters(plan *model.ServicePlan, schema map[string]interface{}, parameters interface{}) error {
+	err := plan.ValidateParameters(parameters)
 	if err != nil {
-		return http.StatusInternalServerError, err
+		return err
 	}
 
-	username, password, ok := r.BasicAuth()
-	if !ok {
-		return http.StatusUnauthorized, errors.New("No username and password provided in the request's Authorization header")
+	if parameters == nil {
+		parameters = map[string]interface{}{}
 	}
+	return json_schema.Validate(schema, parameters)
+}
 
-	if username != authUsername || password != authPassword {
-		return http.StatusUnauthorized, errors.New("The username and password are invalid")
+// validateSecurity checks the security parameters, and rejects disabling
+// public blob access for an instance whose container is public.
+func validateSecurity(defaults *model.ServicePlanMetadata, parameters interface{}, containerAccessType storageclient.ContainerAccessType) error {
+	security, err := ac.InstanceSecurity(defaults, parameters)
+	if err != nil {
+		return err
 	}
 
-	return 0, nil
+	if security.BlocksPublicAccess() && containerAccessType != storageclient.ContainerAccessTypePrivate {
+		return fmt.Errorf("container_access_type %s requires allow_blob_public_access", containerAccessType)
+	}
+	return nil
 }
 
-func loadAuthCredentials() (string, string, error) {
-	username := os.Getenv("authUsername")
-	if username == "" {
-		return "", "", errors.New("No auth_username provided in environment variables")
+// validatePrivateEndpoint checks the private_endpoint parameter, and that
+// the broker is configured for private endpoints if the instance needs one.
+func validatePrivateEndpoint(conf *config.Config, plan *model.ServicePlan, parameters interface{}) error {
+	usePrivateEndpoint, err := ac.UsesPrivateEndpoint(plan, parameters)
+	if err != nil {
+		return err
 	}
 
-	password := os.Getenv("authPassword")
-	if password == "" {
-		return "", "", errors.New("No auth_password provided in environment variables")
+	if usePrivateEndpoint && conf.Network.PrivateEndpointSubnetId == "" {
+		return errors.New("private endpoints are not configured in this broker")
 	}
+	return nil
+}
 
-	return username, password, nil
+// requestedProfile returns the credential profile a request pins: the
+// subscription parameter, then the plan's profile. It returns "" if neither
+// names one.
+func requestedProfile(plan *model.ServicePlan, parameters interface{}) string {
+	if param, ok := parameters.(map[string]interface{}); ok {
+		if v, ok := param["subscription"].(string); ok && v != "" {
+			return v
+		}
+	}
+	return plan.Metadata.Subscription
 }
 
-func validateApiVersion(actual, expected string) bool {
-	apiVersion := strings.Split(actual, ".")
-	majorApiVersionActual, err1 := strconv.Atoi(apiVersion[0])
-	minorApiVersionActual, err2 := strconv.Atoi(apiVersion[1])
-	if err1 != nil || err2 != nil {
-		return false
+// validateProfileUpdate rejects updates which would move the instance to
+// another credential profile, since storage accounts cannot move between
+// subscriptions.
+func validateProfileUpdate(instance *model.ServiceInstance, plan *model.ServicePlan, parameters interface{}) error {
+	current := instance.Profile
+	if current == "" {
+		current = config.DEFAULT_PROFILE
+	}
+
+	// Plans without a profile keep the instance where it is
+	target := requestedProfile(plan, parameters)
+	if target == "" || target == current {
+		return nil
 	}
+	return broker_error.BadRequest("Service instance " + instance.Id + " lives in subscription " + current + " and cannot be moved to subscription " + target)
+}
 
-	apiVersion = strings.Split(expected, ".")
-	majorApiVersionExpected, _ := strconv.Atoi(apiVersion[0])
-	minorApiVersionExpected, _ := strconv.Atoi(apiVersion[1])
+// maintenanceUpgrade reports whether an update request asks to upgrade the
+// instance to the maintenance_info of the plan.
+func maintenanceUpgrade(instance *model.ServiceInstance, plan *model.ServicePlan, requested *model.MaintenanceInfo) (bool, error) {
+	if requested == nil {
+		return false, nil
+	}
 
-	if majorApiVersionActual < majorApiVersionExpected {
-		return false
+	if requested.Version != plan.MaintenanceInfo.MaintenanceVersion() {
+		return false, broker_error.MaintenanceInfoConflict("maintenance_info.version " + requested.Version + " does not match the catalog")
 	}
-	if majorApiVersionActual == majorApiVersionExpected && minorApiVersionActual < minorApiVersionExpected {
-		return false
+
+	order, err := model.CompareVersions(instance.MaintenanceInfo.MaintenanceVersion(), requested.Version)
+	if err != nil {
+		return false, broker_error.BadRequest(err.Error())
 	}
-	return true
+	if order > 0 {
+		return false, broker_error.MaintenanceInfoConflict("Service instance " + instance.Id + " cannot be downgraded to maintenance_info.version " + requested.Version)
+	}
+
+	return order < 0, nil
+}
+
+// requireFeature rejects the request if the feature is newer than the API
+// version of the request.
+func requireFeature(w http.ResponseWriter, supported bool, feature string) bool {
+	if !supported {
+		broker_error.Write(w, broker_error.New(http.StatusPreconditionFailed, "", feature+" is not supported by the requested API version"))
+	}
+	return supported
+}
+
+// audit logs who asked for a change, so that operations on Azure resources
+// can be traced back to platform users.
+func audit(r *http.Request, operation, target string) {
+	fmt.Printf("Audit: %s of %s requested by %s in request %s\n", operation, target, OriginatingIdentity(r), RequestId(r))
+}
+
+// bindingCredentials returns the credentials in the format of the platform
+// the binding was created for.
+func bindingCredentials(instance *model.ServiceInstance, binding *model.ServiceBinding) interface{} {
+	platform := instance.Platform()
+	if binding.Context != nil {
+		platform = binding.Context.PlatformName()
+	}
+
+	if platform == model.PLATFORM_KUBERNETES {
+		return binding.Credentials.SecretData()
+	}
+	return binding.Credentials
 }
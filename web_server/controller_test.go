@@ -0,0 +1,349 @@
+package web_server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/storage"
+	storageclient "github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/gorilla/mux"
+
+	ac "github.com/bingosummer/azure_storage_service_broker/azure_client"
+
+	"github.com/bingosummer/azure_storage_service_broker/broker_error"
+	"github.com/bingosummer/azure_storage_service_broker/config"
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+func TestMaintenanceUpgrade(t *testing.T) {
+	plan := &model.ServicePlan{Id: "plan-id", MaintenanceInfo: &model.MaintenanceInfo{Version: "1.2.0"}}
+
+	for i, test := range []struct {
+		applied           *model.MaintenanceInfo
+		requested         *model.MaintenanceInfo
+		expectedUpgrade   bool
+		expectedErrorCode string
+	}{
+		{nil, nil, false, ""},
+		{nil, &model.MaintenanceInfo{Version: "1.2.0"}, true, ""},
+		{&model.MaintenanceInfo{Version: "1.1.0"}, &model.MaintenanceInfo{Version: "1.2.0"}, true, ""},
+		{&model.MaintenanceInfo{Version: "1.2.0"}, &model.MaintenanceInfo{Version: "1.2.0"}, false, ""},
+		{&model.MaintenanceInfo{Version: "1.1.0"}, &model.MaintenanceInfo{Version: "1.3.0"}, false, "MaintenanceInfoConflict"},
+		{&model.MaintenanceInfo{Version: "2.0.0"}, &model.MaintenanceInfo{Version: "1.2.0"}, false, "MaintenanceInfoConflict"},
+	} {
+		instance := &model.ServiceInstance{Id: "instance-id", MaintenanceInfo: test.applied}
+
+		upgrade, err := maintenanceUpgrade(instance, plan, test.requested)
+		errorCode := ""
+		if err != nil {
+			errorCode = broker_error.FromAzureError(err).ErrorCode
+		}
+		if errorCode != test.expectedErrorCode {
+			t.Errorf("Test %d: error was %v but expected error code %q\n", i, err, test.expectedErrorCode)
+		}
+		if upgrade != test.expectedUpgrade {
+			t.Errorf("Test %d: upgrade was %v but expected %v\n", i, upgrade, test.expectedUpgrade)
+		}
+	}
+}
+
+func TestRequestedProfile(t *testing.T) {
+	for i, test := range []struct {
+		planSubscription string
+		parameters       interface{}
+		expected         string
+	}{
+		{"", nil, ""},
+		{"emea", nil, "emea"},
+		{"emea", map[string]interface{}{"subscription": "apac"}, "apac"},
+		{"", map[string]interface{}{"subscription": ""}, ""},
+	} {
+		plan := &model.ServicePlan{Metadata: model.ServicePlanMetadata{Subscription: test.planSubscription}}
+		if profile := requestedProfile(plan, test.parameters); profile != test.expected {
+			t.Errorf("Test %d: profile was %q but expected %q\n", i, profile, test.expected)
+		}
+	}
+}
+
+func TestValidateProfileUpdate(t *testing.T) {
+	for i, test := range []struct {
+		profile          string
+		planSubscription string
+		parameters       interface{}
+		valid            bool
+	}{
+		{"", "", nil, true},
+		{"emea", "", nil, true},
+		{"emea", "", map[string]interface{}{"access_tier": "Cool"}, true},
+		{"emea", "emea", map[string]interface{}{"subscription": "emea"}, true},
+		{"", "default", nil, true},
+		{"emea", "apac", nil, false},
+		{"", "", map[string]interface{}{"subscription": "apac"}, false},
+	} {
+		instance := &model.ServiceInstance{Id: "instance-id", Profile: test.profile}
+		plan := &model.ServicePlan{Metadata: model.ServicePlanMetadata{Subscription: test.planSubscription}}
+
+		err := validateProfileUpdate(instance, plan, test.parameters)
+		if (err == nil) != test.valid {
+			t.Errorf("Test %d: error was %v but expected valid %v\n", i, err, test.valid)
+		}
+	}
+}
+
+func TestValidateSecurity(t *testing.T) {
+	disabled := false
+	plan := &model.ServicePlan{Metadata: model.ServicePlanMetadata{AllowBlobPublicAccess: &disabled}}
+
+	for i, test := range []struct {
+		defaults   *model.ServicePlanMetadata
+		parameters interface{}
+		accessType storageclient.ContainerAccessType
+		valid      bool
+	}{
+		{nil, nil, storageclient.ContainerAccessTypeBlob, true},
+		{&plan.Metadata, nil, storageclient.ContainerAccessTypePrivate, true},
+		{&plan.Metadata, nil, storageclient.ContainerAccessTypeBlob, false},
+		{&plan.Metadata, map[string]interface{}{"allow_blob_public_access": true}, storageclient.ContainerAccessTypeContainer, true},
+		{nil, map[string]interface{}{"allow_blob_public_access": false}, storageclient.ContainerAccessTypeContainer, false},
+		{nil, map[string]interface{}{"minimum_tls_version": "TLS1_3"}, storageclient.ContainerAccessTypePrivate, false},
+	} {
+		err := validateSecurity(test.defaults, test.parameters, test.accessType)
+		if (err == nil) != test.valid {
+			t.Errorf("Test %d: error was %v but expected valid %v\n", i, err, test.valid)
+		}
+	}
+}
+
+func TestValidatePrivateEndpoint(t *testing.T) {
+	configured := &config.Config{Network: config.NetworkConfig{PrivateEndpointSubnetId: "subnet-id"}}
+	plan := &model.ServicePlan{Metadata: model.ServicePlanMetadata{PrivateEndpoint: true}}
+
+	for i, test := range []struct {
+		conf       *config.Config
+		plan       *model.ServicePlan
+		parameters interface{}
+		valid      bool
+	}{
+		{&config.Config{}, &model.ServicePlan{}, nil, true},
+		{&config.Config{}, plan, nil, false},
+		{&config.Config{}, plan, map[string]interface{}{"private_endpoint": false}, true},
+		{configured, plan, nil, true},
+		{configured, &model.ServicePlan{}, map[string]interface{}{"private_endpoint": true}, true},
+		{configured, &model.ServicePlan{}, map[string]interface{}{"private_endpoint": "yes"}, false},
+	} {
+		err := validatePrivateEndpoint(test.conf, test.plan, test.parameters)
+		if (err == nil) != test.valid {
+			t.Errorf("Test %d: error was %v but expected valid %v\n", i, err, test.valid)
+		}
+	}
+}
+
+// bindClient hands out fixed access keys for a storage account which exists,
+// and fails the other operations of the client.
+type bindClient struct {
+	ac.Client
+}
+
+func (c bindClient) GetInstanceState(resourceGroupName, storageAccountName string) (storage.ProvisioningState, error) {
+	return storage.Succeeded, nil
+}
+
+func (c bindClient) GetAccessKeys(resourceGroupName, storageAccountName, containerName string, containerAccessType storageclient.ContainerAccessType) (string, string, string, error) {
+	return "primary", "secondary", containerName, nil
+}
+
+func (c bindClient) RecordBinding(resourceGroupName, storageAccountName, containerName, bindingId string) error {
+	return nil
+}
+
+func (c bindClient) GrantContainerAccess(resourceGroupName, storageAccountName, containerName string, containerAccessType storageclient.ContainerAccessType, bindingId, principalId string) error {
+	return nil
+}
+
+func (c bindClient) StorageEndpointSuffix() string {
+	return "core.windows.net"
+}
+
+func TestBindWithoutSharedKeys(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataPath)
+
+	conf := &config.Config{DataPath: dataPath, ServiceInstancesFileName: "instances.json", ServiceBindingsFileName: "bindings.json"}
+	snapshot := &Snapshot{
+		Conf:           conf,
+		Catalog:        &model.Catalog{Services: []model.Service{{Id: "service-id", Plans: []model.ServicePlan{{Id: "plan-id"}}}}},
+		ServiceClients: map[string]ac.Client{"default": bindClient{}},
+	}
+	disabled := false
+	instances := map[string]*model.ServiceInstance{
+		"instance-id": {Id: "instance-id", ServiceId: "service-id", PlanId: "plan-id", StorageAccountName: "account", ContainerName: "data", State: "succeeded",
+			Configuration: &model.AccountConfiguration{AllowSharedKeyAccess: &disabled}},
+	}
+	c := NewController(conf, NewSnapshotStore(snapshot), instances, make(map[string]*model.ServiceBinding))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{service_instance_guid}/service_bindings/{service_binding_guid}", c.Bind).Methods("PUT")
+
+	for i, test := range []struct {
+		parameters   string
+		expectedCode int
+	}{
+		{`{}`, http.StatusBadRequest},
+		{`{"principal_id": "00000000-0000-0000-0000-000000000001"}`, http.StatusCreated},
+	} {
+		w := httptest.NewRecorder()
+		body := strings.NewReader(`{"service_id": "service-id", "plan_id": "plan-id", "parameters": ` + test.parameters + `}`)
+		router.ServeHTTP(w, httptest.NewRequest("PUT", fmt.Sprintf("/v2/service_instances/instance-id/service_bindings/binding-%d", i), body))
+		if w.Code != test.expectedCode {
+			t.Errorf("Test %d: binding responded %d: %s\n", i, w.Code, w.Body.String())
+		}
+		if w.Code == http.StatusCreated && (strings.Contains(w.Body.String(), "access_key") || !strings.Contains(w.Body.String(), `"principal_id":"00000000-0000-0000-0000-000000000001"`)) {
+			t.Errorf("Test %d: credentials were %s\n", i, w.Body.String())
+		}
+	}
+}
+
+// TestConcurrentBinds binds an instance while the platform polls it, which
+// the race detector checks.
+func TestConcurrentBinds(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataPath)
+
+	conf := &config.Config{DataPath: dataPath, ServiceInstancesFileName: "instances.json", ServiceBindingsFileName: "bindings.json"}
+	snapshot := &Snapshot{
+		Conf:           conf,
+		Catalog:        &model.Catalog{Services: []model.Service{{Id: "service-id", Plans: []model.ServicePlan{{Id: "plan-id"}}}}},
+		ServiceClients: map[string]ac.Client{"default": bindClient{}},
+	}
+	instances := map[string]*model.ServiceInstance{
+		"instance-id": {Id: "instance-id", ServiceId: "service-id", PlanId: "plan-id", StorageAccountName: "account", State: "in progress"},
+	}
+	c := NewController(conf, NewSnapshotStore(snapshot), instances, make(map[string]*model.ServiceBinding))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{service_instance_guid}/last_operation", c.GetServiceInstance).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{service_instance_guid}/service_bindings/{service_binding_guid}", c.Bind).Methods("PUT")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			body := strings.NewReader(`{"service_id": "service-id", "plan_id": "plan-id"}`)
+			router.ServeHTTP(w, httptest.NewRequest("PUT", fmt.Sprintf("/v2/service_instances/instance-id/service_bindings/binding-%d", i), body))
+			if w.Code != http.StatusCreated {
+				t.Errorf("Test %d: binding responded %d: %s\n", i, w.Code, w.Body.String())
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/v2/service_instances/instance-id/last_operation", nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("Test %d: last_operation responded %d: %s\n", i, w.Code, w.Body.String())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if state := c.getInstance("instance-id").State; state != "succeeded" {
+		t.Errorf("instance is %s but expected succeeded\n", state)
+	}
+	if count := c.countBindings("instance-id", ""); count != 10 {
+		t.Errorf("instance has %d bindings but expected 10\n", count)
+	}
+}
+
+// deprovisionClient deletes the private endpoint on the third request and
+// fails the other operations of the client.
+type deprovisionClient struct {
+	ac.Client
+	calls   *int
+	deleted *bool
+}
+
+func (c deprovisionClient) DeletePrivateEndpoint(resourceGroupName, privateEndpointName string) (bool, error) {
+	*c.calls++
+	return *c.calls >= 3, nil
+}
+
+func (c deprovisionClient) DeleteInstance(resourceGroupName, storageAccountName string) error {
+	*c.deleted = true
+	return nil
+}
+
+func TestDeprovisionPrivateInstance(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataPath)
+
+	var calls int
+	var deleted bool
+	conf := &config.Config{DataPath: dataPath, ServiceInstancesFileName: "instances.json", ServiceBindingsFileName: "bindings.json"}
+	snapshot := &Snapshot{
+		Conf:           conf,
+		Catalog:        &model.Catalog{Services: []model.Service{{Id: "service-id", Plans: []model.ServicePlan{{Id: "plan-id"}}}}},
+		ServiceClients: map[string]ac.Client{"default": deprovisionClient{calls: &calls, deleted: &deleted}},
+	}
+	instances := map[string]*model.ServiceInstance{
+		"instance-id": {Id: "instance-id", ServiceId: "service-id", PlanId: "plan-id", StorageAccountName: "account", State: "succeeded",
+			PrivateEndpoint: &model.PrivateEndpoint{Name: "account-pe", Fqdn: "account.privatelink.blob.core.windows.net"}},
+	}
+	bindings := map[string]*model.ServiceBinding{
+		"binding-id": {Id: "binding-id", ServiceInstanceId: "instance-id"},
+	}
+	c := NewController(conf, NewSnapshotStore(snapshot), instances, bindings)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{service_instance_guid}", c.RemoveServiceInstance).Methods("DELETE")
+	router.HandleFunc("/v2/service_instances/{service_instance_guid}/last_operation", c.GetServiceInstance).Methods("GET")
+
+	for i, test := range []struct {
+		method        string
+		url           string
+		claimed       bool
+		expectedCode  int
+		expectedState string
+		expectedCalls int
+	}{
+		{"DELETE", "/v2/service_instances/instance-id", false, http.StatusUnprocessableEntity, "", 0},
+		{"DELETE", "/v2/service_instances/instance-id?accepts_incomplete=true", false, http.StatusAccepted, "", 1},
+		{"GET", "/v2/service_instances/instance-id/last_operation", false, http.StatusOK, "in progress", 2},
+		// A poll while an update has the instance reports the recorded state
+		{"GET", "/v2/service_instances/instance-id/last_operation", true, http.StatusOK, "in progress", 2},
+		{"GET", "/v2/service_instances/instance-id/last_operation", false, http.StatusOK, "succeeded", 3},
+		{"GET", "/v2/service_instances/instance-id/last_operation", false, http.StatusGone, "", 3},
+	} {
+		if test.claimed {
+			c.beginOperation("instance-id")
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(test.method, test.url, nil))
+		if test.claimed {
+			c.endOperation("instance-id")
+		}
+
+		if w.Code != test.expectedCode || !strings.Contains(w.Body.String(), test.expectedState) || calls != test.expectedCalls {
+			t.Errorf("Test %d: %s responded %d: %s after %d deletions of the private endpoint\n", i, test.url, w.Code, w.Body.String(), calls)
+		}
+	}
+
+	if !deleted || c.getInstance("instance-id") != nil || c.getBinding("binding-id") != nil {
+		t.Errorf("the storage account was deleted %v, the instance and binding were kept %v %v\n", deleted, c.getInstance("instance-id"), c.getBinding("binding-id"))
+	}
+}
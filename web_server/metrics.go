@@ -0,0 +1,71 @@
+package web_server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+const METRICS_PREFIX = "azure_storage_broker_"
+
+// ServeMetrics exposes the findings of the last reconciliation in the
+// Prometheus text format.
+func (r *Reconciler) ServeMetrics(w http.ResponseWriter, req *http.Request) {
+	report, deleted, remediated := r.Report()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s %s\n", METRICS_PREFIX, name, help, METRICS_PREFIX, name, kind)
+	}
+
+	metric("orphaned_storage_accounts_deleted_total", "counter", "Orphaned storage accounts deleted by the reconciler.")
+	fmt.Fprintf(w, "%sorphaned_storage_accounts_deleted_total %d\n", METRICS_PREFIX, deleted)
+	metric("drifted_storage_accounts_remediated_total", "counter", "Drifted storage accounts of enforced plans reset by the reconciler.")
+	fmt.Fprintf(w, "%sdrifted_storage_accounts_remediated_total %d\n", METRICS_PREFIX, remediated)
+	if report == nil {
+		return
+	}
+
+	orphans := make(map[string]int)
+	missing := make(map[string]int)
+	drifted := make(map[string]int)
+	for _, profile := range r.snapshots.Current().Conf.ProfileNames() {
+		orphans[profile], missing[profile], drifted[profile] = 0, 0, 0
+	}
+	for _, orphan := range report.Orphans {
+		if !orphan.Deleted {
+			orphans[orphan.Profile]++
+		}
+	}
+	for _, account := range report.Missing {
+		missing[account.Profile]++
+	}
+	for _, account := range report.Drifted {
+		if !account.Remediated {
+			drifted[account.Profile]++
+		}
+	}
+
+	metric("orphaned_storage_accounts", "gauge", "Storage accounts tagged by this broker which no service instance records.")
+	writeByProfile(w, "orphaned_storage_accounts", orphans)
+	metric("missing_storage_accounts", "gauge", "Service instances whose storage account no longer exists.")
+	writeByProfile(w, "missing_storage_accounts", missing)
+	metric("drifted_storage_accounts", "gauge", "Storage accounts whose configuration differs from the desired one and was not reset.")
+	writeByProfile(w, "drifted_storage_accounts", drifted)
+	metric("reconciliation_errors", "gauge", "Errors of the last reconciliation.")
+	fmt.Fprintf(w, "%sreconciliation_errors %d\n", METRICS_PREFIX, len(report.Errors))
+	metric("last_reconciliation_timestamp_seconds", "gauge", "When the last reconciliation ran.")
+	fmt.Fprintf(w, "%slast_reconciliation_timestamp_seconds %d\n", METRICS_PREFIX, report.Time.Unix())
+}
+
+func writeByProfile(w http.ResponseWriter, name string, counts map[string]int) {
+	var profiles []string
+	for profile := range counts {
+		profiles = append(profiles, profile)
+	}
+	sort.Strings(profiles)
+
+	for _, profile := range profiles {
+		fmt.Fprintf(w, "%s%s{profile=%q} %d\n", METRICS_PREFIX, name, profile, counts[profile])
+	}
+}
@@ -0,0 +1,190 @@
+package web_server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/bingosummer/azure_storage_service_broker/broker_error"
+	"github.com/bingosummer/azure_storage_service_broker/config"
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+const (
+	X_BROKER_API_VERSION_NAME         = "X-Broker-Api-Version"
+	X_REQUEST_ID_NAME                 = "X-Request-Id"
+	X_BROKER_API_ORIGINATING_IDENTITY = "X-Broker-Api-Originating-Identity"
+)
+
+type contextKey int
+
+const (
+	requestIdKey contextKey = iota
+	apiVersionKey
+	originatingIdentityKey
+	snapshotKey
+)
+
+// Middleware wraps a handler with behaviour shared by every route.
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps the handler with the middlewares. The first middleware is the
+// outermost one and sees the request first.
+func Chain(handler http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Recovery turns a panic in a handler into a 500 response instead of
+// dropping the connection.
+func Recovery() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				if rec := recover(); rec != nil {
+					fmt.Printf("Recovered from panic while serving %s %s: %v\n%s\n", r.Method, r.URL.Path, rec, debug.Stack())
+					broker_error.Write(w, broker_error.New(http.StatusInternalServerError, "", "Internal error while serving the request "+RequestId(r)))
+				}
+			}()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequestIds tags each request with the X-Request-Id sent by the platform, or
+// with a generated one, and echoes it in the response.
+func RequestIds() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestId := r.Header.Get(X_REQUEST_ID_NAME)
+			if requestId == "" {
+				requestId = newRequestId()
+			}
+
+			w.Header().Set(X_REQUEST_ID_NAME, requestId)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey, requestId)))
+		})
+	}
+}
+
+// AccessLog logs every request together with its status and duration.
+func AccessLog() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+
+			next.ServeHTTP(recorder, r)
+
+			fmt.Printf("%s %s %s %d %v\n", RequestId(r), r.Method, r.URL.Path, recorder.statusCode, time.Since(start))
+		})
+	}
+}
+
+// Authentication rejects requests without the broker's basic auth
+// credentials, as configured in the snapshot of the request.
+func Authentication() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			err := authentication(r, RequestSnapshot(r).Conf.Auth)
+			if err != nil {
+				broker_error.Write(w, err)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// NegotiateApiVersion rejects requests whose X-Broker-Api-Version is missing
+// or older than the minimum version, and records the version the request is
+// served with.
+func NegotiateApiVersion(minimum, maximum string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			apiVersion, err := negotiateApiVersion(r.Header.Get(X_BROKER_API_VERSION_NAME), minimum, maximum)
+			if err != nil {
+				broker_error.Write(w, broker_error.New(http.StatusPreconditionFailed, "", err.Error()))
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey, apiVersion)))
+		})
+	}
+}
+
+// OriginatingIdentities records the platform user sent in the
+// X-Broker-API-Originating-Identity header and rejects malformed headers.
+func OriginatingIdentities() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get(X_BROKER_API_ORIGINATING_IDENTITY)
+			if header == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			identity, err := model.ParseOriginatingIdentity(header)
+			if err != nil {
+				broker_error.Write(w, broker_error.BadRequest(err.Error()))
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), originatingIdentityKey, identity)))
+		})
+	}
+}
+
+// OriginatingIdentity returns the platform user the request was made for, or
+// nil if the platform did not send one.
+func OriginatingIdentity(r *http.Request) *model.OriginatingIdentity {
+	identity, _ := r.Context().Value(originatingIdentityKey).(*model.OriginatingIdentity)
+	return identity
+}
+
+// RequestId returns the id the RequestIds middleware assigned to the request.
+func RequestId(r *http.Request) string {
+	requestId, _ := r.Context().Value(requestIdKey).(string)
+	return requestId
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func newRequestId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+func authentication(r *http.Request, auth config.AuthConfig) error {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return broker_error.Unauthorized(errors.New("No username and password provided in the request's Authorization header"))
+	}
+
+	if username != auth.Username || password != auth.Password {
+		return broker_error.Unauthorized(errors.New("The username and password are invalid"))
+	}
+
+	return nil
+}
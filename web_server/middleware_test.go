@@ -0,0 +1,154 @@
+package web_server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bingosummer/azure_storage_service_broker/config"
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+func TestNegotiateApiVersion(t *testing.T) {
+	for i, test := range []struct {
+		actual        string
+		expected      string
+		expectedError bool
+	}{
+		{"2.5", "2.5", false},
+		{"2.13", "2.13", false},
+		{"2.17", "2.17", false},
+		{"2.20", "2.17", false},
+		{"3.0", "", true},
+		{"2.4", "", true},
+		{"1.9", "", true},
+		{"2", "", true},
+		{"", "", true},
+		{"two.five", "", true},
+		{"2.5.1", "", true},
+	} {
+		negotiated, err := negotiateApiVersion(test.actual, "2.5", "2.17")
+		if (err != nil) != test.expectedError {
+			t.Errorf("Test %d: %q error was %v but expected error %v\n", i, test.actual, err, test.expectedError)
+			continue
+		}
+		if err == nil && negotiated.String() != test.expected {
+			t.Errorf("Test %d: %q negotiated %s but expected %s\n", i, test.actual, negotiated, test.expected)
+		}
+	}
+}
+
+func TestCatalogForApiVersion(t *testing.T) {
+	catalog := &model.Catalog{Services: []model.Service{{
+		Id:                   "service-id",
+		InstancesRetrievable: true,
+		BindingsRetrievable:  true,
+		Plans:                []model.ServicePlan{{Id: "plan-id", Schemas: &model.Schemas{}}},
+	}}}
+
+	for i, test := range []struct {
+		apiVersion          string
+		expectedRetrievable bool
+		expectedSchemas     bool
+	}{
+		{"2.5", false, false},
+		{"2.13", false, true},
+		{"2.14", true, true},
+	} {
+		filtered := catalogForApiVersion(catalog, mustParseApiVersion(test.apiVersion))
+		service := filtered.Services[0]
+		if service.InstancesRetrievable != test.expectedRetrievable || service.BindingsRetrievable != test.expectedRetrievable {
+			t.Errorf("Test %d: retrievable flags were %v/%v but expected %v\n", i, service.InstancesRetrievable, service.BindingsRetrievable, test.expectedRetrievable)
+		}
+		if (service.Plans[0].Schemas != nil) != test.expectedSchemas {
+			t.Errorf("Test %d: schemas present was %v but expected %v\n", i, service.Plans[0].Schemas != nil, test.expectedSchemas)
+		}
+	}
+
+	if !catalog.Services[0].InstancesRetrievable || catalog.Services[0].Plans[0].Schemas == nil {
+		t.Errorf("expected the original catalog to be unchanged\n")
+	}
+}
+
+func TestChain(t *testing.T) {
+	handler := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("boom")
+		}
+		if RequestId(r) == "" {
+			t.Errorf("expected a request id\n")
+		}
+		w.WriteHeader(http.StatusOK)
+	}),
+		RequestIds(),
+		AccessLog(),
+		Recovery(),
+		WithSnapshot(NewSnapshotStore(&Snapshot{Conf: &config.Config{Auth: config.AuthConfig{Username: "fake-username", Password: "fake-password"}}})),
+		Authentication(),
+		NegotiateApiVersion("2.5", "2.17"))
+
+	for i, test := range []struct {
+		path               string
+		username           string
+		apiVersion         string
+		expectedStatusCode int
+	}{
+		{"/v2/catalog", "fake-username", "2.5", http.StatusOK},
+		{"/v2/catalog", "", "2.5", http.StatusUnauthorized},
+		{"/v2/catalog", "wrong-username", "2.5", http.StatusUnauthorized},
+		{"/v2/catalog", "fake-username", "2", http.StatusPreconditionFailed},
+		{"/v2/catalog", "fake-username", "", http.StatusPreconditionFailed},
+		{"/panic", "fake-username", "2.5", http.StatusInternalServerError},
+	} {
+		r := httptest.NewRequest("GET", test.path, nil)
+		if test.username != "" {
+			r.SetBasicAuth(test.username, "fake-password")
+		}
+		r.Header.Set(X_BROKER_API_VERSION_NAME, test.apiVersion)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, r)
+
+		if w.Code != test.expectedStatusCode {
+			t.Errorf("Test %d: status code was %d but expected %d\n", i, w.Code, test.expectedStatusCode)
+		}
+		if w.Header().Get(X_REQUEST_ID_NAME) == "" {
+			t.Errorf("Test %d: expected the %s response header\n", i, X_REQUEST_ID_NAME)
+		}
+	}
+}
+
+func TestOriginatingIdentities(t *testing.T) {
+	var user string
+	handler := OriginatingIdentities()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user = OriginatingIdentity(r).User()
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for i, test := range []struct {
+		header             string
+		expectedStatusCode int
+		expectedUser       string
+	}{
+		{"", http.StatusOK, ""},
+		// {"user_id": "683ea748-3092-4ff4-b656-39cacc4d5360"}
+		{"cloudfoundry eyJ1c2VyX2lkIjogIjY4M2VhNzQ4LTMwOTItNGZmNC1iNjU2LTM5Y2FjYzRkNTM2MCJ9", http.StatusOK, "683ea748-3092-4ff4-b656-39cacc4d5360"},
+		{"cloudfoundry", http.StatusBadRequest, ""},
+	} {
+		user = ""
+		r := httptest.NewRequest("PUT", "/v2/service_instances/instance-id", nil)
+		if test.header != "" {
+			r.Header.Set(X_BROKER_API_ORIGINATING_IDENTITY, test.header)
+		}
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, r)
+
+		if w.Code != test.expectedStatusCode {
+			t.Errorf("Test %d: status code was %d but expected %d\n", i, w.Code, test.expectedStatusCode)
+		}
+		if user != test.expectedUser {
+			t.Errorf("Test %d: user was %q but expected %q\n", i, user, test.expectedUser)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package web_server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	ac "github.com/bingosummer/azure_storage_service_broker/azure_client"
+	"github.com/bingosummer/azure_storage_service_broker/broker_error"
+	"github.com/bingosummer/azure_storage_service_broker/config"
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+// How long the storage account usage of a region is trusted before it is
+// read from Azure again
+const CAPACITY_REFRESH_INTERVAL = 5 * time.Minute
+
+// How long a failed read of the usage is remembered, so that a subscription
+// which Azure throttles is not asked on every placement
+const CAPACITY_RETRY_INTERVAL = 30 * time.Second
+
+// CapacityTracker counts the storage accounts of each subscription and
+// region, so that new instances are placed where Azure still has room.
+// Placements since the last refresh are counted locally. The mutex guards
+// the counts only, Azure is read without it.
+type CapacityTracker struct {
+	mutex  sync.Mutex
+	usages map[capacityKey]*capacity
+	now    func() time.Time
+}
+
+type capacityKey struct {
+	subscriptionId string
+	location       string
+}
+
+// capacity is replaced on each read, only used changes in place.
+type capacity struct {
+	used      int
+	limit     int
+	refreshed time.Time
+	// Set when the usage could not be read
+	unknown bool
+}
+
+func NewCapacityTracker() *CapacityTracker {
+	return &CapacityTracker{usages: make(map[capacityKey]*capacity), now: time.Now}
+}
+
+// Place picks the profile among the candidates which takes a new storage
+// account in the location, following the placement policy, and counts the
+// account against it. Profiles whose subscription does not offer the
+// location are passed over. Profiles whose usage cannot be read are assumed
+// to have room, so that Azure itself has the final say, but only take the
+// account if no profile is known to have room.
+func (t *CapacityTracker) Place(snapshot *Snapshot, candidates []string, location string) (string, error) {
+	spread := snapshot.Conf.Placement.Policy == config.PLACEMENT_SPREAD
+	unknown := ""
+	var known, unavailable []string
+	for _, profile := range candidates {
+		serviceClient, err := snapshot.ServiceClient(profile)
+		if err != nil {
+			return "", broker_error.BadRequest("The subscription of the service instance is invalid: " + err.Error())
+		}
+		if !offersLocation(serviceClient, profile, location) {
+			unavailable = append(unavailable, profile)
+			continue
+		}
+
+		if !t.refresh(serviceClient, snapshot, profile, location) {
+			if unknown == "" {
+				unknown = profile
+			}
+			continue
+		}
+		known = append(known, profile)
+
+		// Unless the accounts are spread, the first profile with room takes
+		// the account and the usage of the others is not read
+		if !spread {
+			if best, _ := t.claim(snapshot, []string{profile}, location); best != "" {
+				return best, nil
+			}
+		}
+	}
+
+	best, full := t.claim(snapshot, known, location)
+	if best == "" {
+		best = unknown
+	}
+
+	if best == "" && len(full) == 0 {
+		return "", broker_error.RegionNotAllowed(fmt.Sprintf("Region %s is not available to the subscriptions of profiles %s", location, strings.Join(unavailable, ", ")))
+	}
+	if best == "" {
+		return "", broker_error.QuotaExceeded(fmt.Sprintf("No subscription has room for another storage account in %s, the storage accounts per region are exhausted in %s", location, strings.Join(full, ", ")))
+	}
+	return best, nil
+}
+
+// claim counts a new storage account against the profile with the most room
+// under the spread policy, else against the first profile with room. It
+// also returns the profiles without room.
+func (t *CapacityTracker) claim(snapshot *Snapshot, profiles []string, location string) (string, []string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	placement := snapshot.Conf.Placement
+	var best *capacity
+	bestProfile, bestRoom := "", 0
+	var full []string
+	for _, profile := range profiles {
+		c := t.usages[t.key(snapshot, profile, location)]
+		if c == nil || c.unknown {
+			continue
+		}
+
+		room := c.room(placement.MaxAccountsPerRegion)
+		if room <= 0 {
+			full = append(full, fmt.Sprintf("%s (%d of %d)", profile, c.used, c.limit))
+			continue
+		}
+		if best == nil || (placement.Policy == config.PLACEMENT_SPREAD && room > bestRoom) {
+			best, bestProfile, bestRoom = c, profile, room
+		}
+		if placement.Policy != config.PLACEMENT_SPREAD {
+			break
+		}
+	}
+
+	if best != nil {
+		best.used++
+	}
+	return bestProfile, full
+}
+
+// Release gives back the storage account of an instance which failed to
+// provision or was deprovisioned.
+func (t *CapacityTracker) Release(snapshot *Snapshot, instance *model.ServiceInstance) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if c := t.usages[t.key(snapshot, instance.Profile, instance.Location)]; c != nil && c.used > 0 {
+		c.used--
+	}
+}
+
+// refresh reads the usage of the profile in the location from Azure when it
+// is stale, and reports whether it is known.
+func (t *CapacityTracker) refresh(serviceClient ac.Client, snapshot *Snapshot, profile, location string) bool {
+	key := t.key(snapshot, profile, location)
+	t.mutex.Lock()
+	cached := t.usages[key]
+	t.mutex.Unlock()
+
+	if cached != nil && cached.unknown && t.now().Sub(cached.refreshed) < CAPACITY_RETRY_INTERVAL {
+		return false
+	}
+	if cached != nil && !cached.unknown && t.now().Sub(cached.refreshed) < CAPACITY_REFRESH_INTERVAL {
+		return true
+	}
+
+	started := t.now()
+	c := &capacity{refreshed: started}
+	used, limit, err := serviceClient.StorageAccountUsage(location)
+	if err != nil {
+		fmt.Printf("WARNING: the storage account usage of profile %s in %s is unknown: %v\n", profile, location, err)
+		c.unknown = true
+	} else {
+		c.used, c.limit = used, limit
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// A read which started later has counted the placements since
+	if current := t.usages[key]; current != nil && current != cached && current.refreshed.After(started) {
+		return !current.unknown
+	}
+	t.usages[key] = c
+	return !c.unknown
+}
+
+// key identifies the usage by subscription, since several profiles may
+// manage the same subscription.
+func (t *CapacityTracker) key(snapshot *Snapshot, profile, location string) capacityKey {
+	azure, _ := snapshot.Conf.Profile(profile)
+	return capacityKey{subscriptionId: azure.SubscriptionId, location: strings.ToLower(location)}
+}
+
+func (c *capacity) room(maxAccounts int) int {
+	limit := c.limit
+	if maxAccounts > 0 && maxAccounts < limit {
+		limit = maxAccounts
+	}
+	return limit - c.used
+}
+
+// placementCandidates returns the profiles a new instance may be placed in,
+// in order of preference.
+func placementCandidates(conf *config.Config, plan *model.ServicePlan, parameters interface{}) []string {
+	if profile := requestedProfile(plan, parameters); profile != "" {
+		return []string{profile}
+	}
+	if conf.Placement.Policy == config.PLACEMENT_FIXED {
+		return []string{config.DEFAULT_PROFILE}
+	}
+	return conf.PlacementProfiles()
+}
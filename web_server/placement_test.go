@@ -0,0 +1,179 @@
+package web_server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	ac "github.com/bingosummer/azure_storage_service_broker/azure_client"
+	"github.com/bingosummer/azure_storage_service_broker/broker_error"
+	"github.com/bingosummer/azure_storage_service_broker/config"
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+// usageClient reports fixed regions and storage account usage and fails the
+// other operations of the client.
+type usageClient struct {
+	ac.Client
+	locations   []string
+	used, limit int
+	err         error
+	reads       *int
+	blocked     chan struct{}
+}
+
+func (c usageClient) Locations() ([]string, error) {
+	return c.locations, c.err
+}
+
+func (c usageClient) StorageAccountUsage(location string) (int, int, error) {
+	if c.blocked != nil {
+		<-c.blocked
+		return c.used, c.limit, c.err
+	}
+	*c.reads++
+	return c.used, c.limit, c.err
+}
+
+var westus = []string{"westus", "eastus"}
+
+func placementSnapshot(policy string, maxAccounts int, reads *int) *Snapshot {
+	conf := &config.Config{
+		Azure: config.AzureConfig{SubscriptionId: "default-id"},
+		Profiles: map[string]config.AzureConfig{
+			"emea":  {SubscriptionId: "emea-id"},
+			"apac":  {SubscriptionId: "apac-id"},
+			"blind": {SubscriptionId: "blind-id"},
+			"latam": {SubscriptionId: "latam-id"},
+		},
+		Placement: config.PlacementConfig{Policy: policy, MaxAccountsPerRegion: maxAccounts},
+	}
+	return &Snapshot{Conf: conf, ServiceClients: map[string]ac.Client{
+		"default": usageClient{locations: westus, used: 250, limit: 250, reads: reads},
+		"emea":    usageClient{locations: westus, used: 100, limit: 250, reads: reads},
+		"apac":    usageClient{locations: westus, used: 10, limit: 250, reads: reads},
+		"blind":   usageClient{err: errors.New("forbidden"), reads: reads},
+		"latam":   usageClient{locations: []string{"brazilsouth"}, used: 0, limit: 250, reads: reads},
+	}}
+}
+
+func TestCapacityTrackerPlace(t *testing.T) {
+	for i, test := range []struct {
+		policy      string
+		maxAccounts int
+		candidates  []string
+		expected    string
+		errorCode   string
+	}{
+		{config.PLACEMENT_FIXED, 0, []string{"emea"}, "emea", ""},
+		{config.PLACEMENT_FIXED, 0, []string{"default"}, "", "QuotaExceeded"},
+		{config.PLACEMENT_FILL_FIRST, 0, []string{"default", "emea", "apac"}, "emea", ""},
+		{config.PLACEMENT_SPREAD, 0, []string{"default", "emea", "apac"}, "apac", ""},
+		{config.PLACEMENT_SPREAD, 0, []string{"blind", "emea"}, "emea", ""},
+		// Unknown usage only takes the account if no subscription has room
+		{config.PLACEMENT_FILL_FIRST, 0, []string{"blind", "emea"}, "emea", ""},
+		{config.PLACEMENT_FILL_FIRST, 0, []string{"blind", "default"}, "blind", ""},
+		{config.PLACEMENT_FILL_FIRST, 100, []string{"default", "emea", "apac"}, "apac", ""},
+		{config.PLACEMENT_SPREAD, 10, []string{"default", "emea", "apac"}, "", "QuotaExceeded"},
+		{config.PLACEMENT_FIXED, 0, []string{"us"}, "", ""},
+		// Subscriptions without the region are passed over
+		{config.PLACEMENT_FILL_FIRST, 0, []string{"latam", "emea"}, "emea", ""},
+		{config.PLACEMENT_SPREAD, 0, []string{"latam", "default", "emea", "apac"}, "apac", ""},
+		{config.PLACEMENT_FIXED, 0, []string{"latam"}, "", "RegionNotAllowed"},
+	} {
+		reads := 0
+		profile, err := NewCapacityTracker().Place(placementSnapshot(test.policy, test.maxAccounts, &reads), test.candidates, "westus")
+
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("Test %d: placed in %s but expected an error\n", i, profile)
+			} else if code := broker_error.FromAzureError(err).ErrorCode; code != test.errorCode {
+				t.Errorf("Test %d: error was %v but expected error code %q\n", i, err, test.errorCode)
+			}
+			continue
+		}
+		if err != nil || profile != test.expected {
+			t.Errorf("Test %d: placed in %q with error %v but expected %q\n", i, profile, err, test.expected)
+		}
+	}
+}
+
+func TestCapacityTrackerCounts(t *testing.T) {
+	reads := 0
+	snapshot := placementSnapshot(config.PLACEMENT_FIXED, 102, &reads)
+	tracker := NewCapacityTracker()
+	now := time.Now()
+	tracker.now = func() time.Time { return now }
+
+	for i, expected := range []string{"emea", "emea", ""} {
+		profile, err := tracker.Place(snapshot, []string{"emea"}, "westus")
+		if profile != expected {
+			t.Errorf("Test %d: placed in %q with error %v but expected %q\n", i, profile, err, expected)
+		}
+	}
+
+	tracker.Release(snapshot, &model.ServiceInstance{Profile: "emea", Location: "WestUS"})
+	if profile, _ := tracker.Place(snapshot, []string{"emea"}, "westus"); profile != "emea" {
+		t.Errorf("the released account was not given back\n")
+	}
+	if reads != 1 {
+		t.Errorf("the usage was read %d times but expected once\n", reads)
+	}
+
+	now = now.Add(CAPACITY_REFRESH_INTERVAL)
+	if profile, _ := tracker.Place(snapshot, []string{"emea"}, "westus"); profile != "emea" || reads != 2 {
+		t.Errorf("the stale usage was not read again\n")
+	}
+}
+
+func TestCapacityTrackerUnknownUsage(t *testing.T) {
+	reads := 0
+	snapshot := placementSnapshot(config.PLACEMENT_FIXED, 0, &reads)
+	tracker := NewCapacityTracker()
+	now := time.Now()
+	tracker.now = func() time.Time { return now }
+
+	for i, expected := range []int{1, 1, 2} {
+		if i == 2 {
+			now = now.Add(CAPACITY_RETRY_INTERVAL)
+		}
+		if profile, err := tracker.Place(snapshot, []string{"blind"}, "westus"); profile != "blind" || reads != expected {
+			t.Errorf("Test %d: placed in %q with error %v after %d reads but expected %d\n", i, profile, err, reads, expected)
+		}
+	}
+}
+
+// TestCapacityTrackerSlowSubscription places in one subscription while the
+// usage of another is being read.
+func TestCapacityTrackerSlowSubscription(t *testing.T) {
+	reads := 0
+	snapshot := placementSnapshot(config.PLACEMENT_FIXED, 0, &reads)
+	blocked := make(chan struct{})
+	snapshot.ServiceClients["apac"] = usageClient{locations: westus, used: 10, limit: 250, blocked: blocked}
+	tracker := NewCapacityTracker()
+
+	done := make(chan string)
+	go func() {
+		profile, _ := tracker.Place(snapshot, []string{"apac"}, "westus")
+		done <- profile
+	}()
+
+	placed := make(chan string)
+	go func() {
+		profile, _ := tracker.Place(snapshot, []string{"emea"}, "westus")
+		placed <- profile
+	}()
+	select {
+	case profile := <-placed:
+		if profile != "emea" {
+			t.Errorf("placed in %q but expected emea\n", profile)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("placing waited for the usage of another subscription\n")
+	}
+
+	close(blocked)
+	if profile := <-done; profile != "apac" {
+		t.Errorf("placed in %q but expected apac\n", profile)
+	}
+}
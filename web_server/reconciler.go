@@ -0,0 +1,317 @@
+package web_server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ac "github.com/bingosummer/azure_storage_service_broker/azure_client"
+	"github.com/bingosummer/azure_storage_service_broker/broker_error"
+	"github.com/bingosummer/azure_storage_service_broker/config"
+	"github.com/bingosummer/azure_storage_service_broker/model"
+	"github.com/bingosummer/azure_storage_service_broker/utils"
+)
+
+// OrphanedAccount is a storage account tagged by this broker which no
+// service instance records.
+type OrphanedAccount struct {
+	Profile            string     `json:"profile"`
+	ResourceGroupName  string     `json:"resource_group_name"`
+	StorageAccountName string     `json:"storage_account_name"`
+	InstanceId         string     `json:"instance_id"`
+	Created            *time.Time `json:"created,omitempty"`
+	Deleted            bool       `json:"deleted"`
+}
+
+// MissingAccount is a service instance whose storage account no longer
+// exists.
+type MissingAccount struct {
+	Profile            string `json:"profile"`
+	InstanceId         string `json:"instance_id"`
+	ResourceGroupName  string `json:"resource_group_name"`
+	StorageAccountName string `json:"storage_account_name"`
+}
+
+// DriftedAccount is a storage account whose live configuration differs from
+// the desired configuration of its service instance.
+type DriftedAccount struct {
+	Profile            string        `json:"profile"`
+	InstanceId         string        `json:"instance_id"`
+	ResourceGroupName  string        `json:"resource_group_name"`
+	StorageAccountName string        `json:"storage_account_name"`
+	Drift              []model.Drift `json:"drift"`
+	Remediated         bool          `json:"remediated"`
+}
+
+// ReconciliationReport is the outcome of one comparison of broker state
+// with Azure.
+type ReconciliationReport struct {
+	Time    time.Time         `json:"time"`
+	Orphans []OrphanedAccount `json:"orphans"`
+	Missing []MissingAccount  `json:"missing"`
+	Drifted []DriftedAccount  `json:"drifted"`
+	Errors  []string          `json:"errors,omitempty"`
+}
+
+// Reconciler periodically compares the recorded service instances with the
+// storage accounts in Azure, and keeps the last report for metrics and the
+// admin API.
+type Reconciler struct {
+	snapshots  *SnapshotStore
+	controller *Controller
+	now        func() time.Time
+
+	mutex      sync.Mutex
+	report     *ReconciliationReport
+	deleted    int
+	remediated int
+}
+
+func NewReconciler(snapshots *SnapshotStore, controller *Controller) *Reconciler {
+	return &Reconciler{snapshots: snapshots, controller: controller, now: time.Now}
+}
+
+// Run reconciles every reconciler.interval of the current configuration.
+func (r *Reconciler) Run() {
+	for {
+		interval := r.snapshots.Current().Conf.Reconciler.IntervalDuration()
+		if interval <= 0 {
+			time.Sleep(CONFIG_POLL_INTERVAL)
+			continue
+		}
+
+		time.Sleep(interval)
+		r.ReconcileNow()
+	}
+}
+
+// ReconcileNow compares the instances of the controller with Azure.
+func (r *Reconciler) ReconcileNow() *ReconciliationReport {
+	report := reconcile(r.snapshots.Current(), r.controller, r.now())
+	r.record(report)
+
+	fmt.Printf("Reconciliation found %d orphaned, %d missing and %d drifted storage accounts, %d errors\n", len(report.Orphans), len(report.Missing), len(report.Drifted), len(report.Errors))
+	return report
+}
+
+// record keeps the report and counts its deletions and remediations.
+func (r *Reconciler) record(report *ReconciliationReport) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.report = report
+	for _, orphan := range report.Orphans {
+		if orphan.Deleted {
+			r.deleted++
+		}
+	}
+	for _, drifted := range report.Drifted {
+		if drifted.Remediated {
+			r.remediated++
+		}
+	}
+}
+
+// Report returns the last report, or nil before the first reconciliation,
+// and how many orphans and drifted accounts the reconciler repaired since
+// the broker started.
+func (r *Reconciler) Report() (*ReconciliationReport, int, int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.report, r.deleted, r.remediated
+}
+
+// reconcile lists the tagged storage accounts of every credential profile
+// and compares them with the instances, and the configuration of every
+// account with the desired one. With cleanup on, orphans older than the
+// grace period are deleted. Drifted accounts of enforced plans are reset.
+func reconcile(snapshot *Snapshot, controller *Controller, now time.Time) *ReconciliationReport {
+	instances := controller.instances()
+	report := &ReconciliationReport{Time: now, Orphans: []OrphanedAccount{}, Missing: []MissingAccount{}, Drifted: []DriftedAccount{}}
+	settings := snapshot.Conf.Reconciler
+
+	// The recorded storage accounts, by resource group and name
+	recorded := make(map[string]bool)
+	for _, instance := range instances {
+		recorded[accountKey(instance.ResourceGroupName, instance.StorageAccountName)] = true
+	}
+
+	seen := make(map[string]bool)
+	for _, profile := range snapshot.Conf.ProfileNames() {
+		serviceClient, _ := snapshot.ServiceClient(profile)
+		accounts, err := serviceClient.BrokerStorageAccounts()
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("the storage accounts of profile %s cannot be listed: %v", profile, err))
+			continue
+		}
+
+		tagged := make(map[string]bool)
+		for _, account := range accounts {
+			key := accountKey(ac.ResourceGroupOf(account.Id), account.Name)
+			tagged[key] = true
+			if recorded[key] || seen[strings.ToLower(account.Id)] {
+				continue
+			}
+			seen[strings.ToLower(account.Id)] = true
+
+			orphan := OrphanedAccount{
+				Profile:            profile,
+				ResourceGroupName:  ac.ResourceGroupOf(account.Id),
+				StorageAccountName: account.Name,
+				InstanceId:         account.Tags["instance_id"],
+			}
+			if created, err := time.Parse(time.RFC3339, account.Properties.CreationTime); err == nil {
+				orphan.Created = &created
+			}
+
+			if settings.Cleanup && orphan.Created != nil && now.Sub(*orphan.Created) > settings.GracePeriodDuration() {
+				err = serviceClient.DeleteInstance(orphan.ResourceGroupName, orphan.StorageAccountName)
+				if err != nil {
+					report.Errors = append(report.Errors, fmt.Sprintf("deleting orphaned storage account %s.%s failed: %v", orphan.ResourceGroupName, orphan.StorageAccountName, err))
+				} else {
+					fmt.Printf("Deleted storage account %s.%s, orphaned since %s\n", orphan.ResourceGroupName, orphan.StorageAccountName, orphan.Created.Format(time.RFC3339))
+					orphan.Deleted = true
+				}
+			}
+			report.Orphans = append(report.Orphans, orphan)
+		}
+
+		report.Missing = append(report.Missing, missingAccounts(serviceClient, profile, instances, tagged, report)...)
+		report.Drifted = append(report.Drifted, driftedAccounts(snapshot, controller, serviceClient, profile, instances, report)...)
+	}
+
+	return report
+}
+
+// missingAccounts returns the instances of the profile whose storage account
+// is gone. Accounts created before tagging are not listed, so their absence
+// is confirmed one by one.
+func missingAccounts(serviceClient ac.Client, profile string, instances map[string]*model.ServiceInstance, tagged map[string]bool, report *ReconciliationReport) []MissingAccount {
+	var missing []MissingAccount
+	for _, instance := range profileInstances(instances, profile) {
+		if tagged[accountKey(instance.ResourceGroupName, instance.StorageAccountName)] {
+			continue
+		}
+
+		_, err := serviceClient.GetInstanceState(instance.ResourceGroupName, instance.StorageAccountName)
+		if err == nil {
+			continue
+		}
+		if !broker_error.IsNotFound(err) {
+			report.Errors = append(report.Errors, fmt.Sprintf("the storage account of service instance %s cannot be read: %v", instance.Id, err))
+			continue
+		}
+		missing = append(missing, MissingAccount{
+			Profile:            profile,
+			InstanceId:         instance.Id,
+			ResourceGroupName:  instance.ResourceGroupName,
+			StorageAccountName: instance.StorageAccountName,
+		})
+	}
+	return missing
+}
+
+// driftedAccounts compares the live configuration of the accounts of the
+// profile with the desired configuration of their instances. Instances which
+// are being updated are skipped, as the update changes the desired
+// configuration once Azure has it.
+func driftedAccounts(snapshot *Snapshot, controller *Controller, serviceClient ac.Client, profile string, instances map[string]*model.ServiceInstance, report *ReconciliationReport) []DriftedAccount {
+	var drifted []DriftedAccount
+	for _, listed := range profileInstances(instances, profile) {
+		if !controller.beginOperation(listed.Id) {
+			continue
+		}
+		// The instance may have been updated or deleted since it was listed
+		instance := controller.getInstance(listed.Id)
+		if instance != nil && instance.Configuration != nil && !instance.Deprovisioning {
+			if account := driftedAccount(snapshot, serviceClient, profile, instance, report); account != nil {
+				drifted = append(drifted, *account)
+			}
+		}
+		controller.endOperation(listed.Id)
+	}
+	return drifted
+}
+
+// driftedAccount compares the account of the instance with its desired
+// configuration, and resets it if the plan is enforced. It returns nil
+// without drift.
+func driftedAccount(snapshot *Snapshot, serviceClient ac.Client, profile string, instance *model.ServiceInstance, report *ReconciliationReport) *DriftedAccount {
+	live, err := serviceClient.AccountConfiguration(instance.ResourceGroupName, instance.StorageAccountName)
+	if err != nil {
+		// Missing accounts are reported on their own
+		if !broker_error.IsNotFound(err) {
+			report.Errors = append(report.Errors, fmt.Sprintf("the configuration of service instance %s cannot be read: %v", instance.Id, err))
+		}
+		return nil
+	}
+
+	drift := instance.Configuration.Diff(live)
+	if len(drift) == 0 {
+		return nil
+	}
+	account := &DriftedAccount{
+		Profile:            profile,
+		InstanceId:         instance.Id,
+		ResourceGroupName:  instance.ResourceGroupName,
+		StorageAccountName: instance.StorageAccountName,
+		Drift:              drift,
+	}
+
+	if _, plan, err := snapshot.Catalog.FindPlan(instance.ServiceId, instance.PlanId); err == nil && plan.Metadata.Enforced {
+		err = serviceClient.RemediateInstance(instance.ResourceGroupName, instance.StorageAccountName, instance.Configuration, drift)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("remediating the drift of service instance %s failed: %v", instance.Id, err))
+		} else {
+			account.Remediated = true
+		}
+	}
+	return account
+}
+
+// profileInstances returns the provisioned instances of the profile, ordered
+// by ID.
+func profileInstances(instances map[string]*model.ServiceInstance, profile string) []*model.ServiceInstance {
+	var ids []string
+	for id := range instances {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var selected []*model.ServiceInstance
+	for _, id := range ids {
+		instance := instances[id]
+		instanceProfile := instance.Profile
+		if instanceProfile == "" {
+			instanceProfile = config.DEFAULT_PROFILE
+		}
+		if instanceProfile == profile && instance.StorageAccountName != "" && instance.State != "in progress" {
+			selected = append(selected, instance)
+		}
+	}
+	return selected
+}
+
+func accountKey(resourceGroupName, storageAccountName string) string {
+	return strings.ToLower(resourceGroupName + "/" + storageAccountName)
+}
+
+// ServeReport sends the last report to operators.
+func (r *Reconciler) ServeReport(w http.ResponseWriter, req *http.Request) {
+	report, _, _ := r.Report()
+	if report == nil {
+		broker_error.Write(w, broker_error.NotFound("No reconciliation has run yet"))
+		return
+	}
+	utils.WriteResponse(w, http.StatusOK, report)
+}
+
+// ServeReconciliation reconciles right away and sends the report.
+func (r *Reconciler) ServeReconciliation(w http.ResponseWriter, req *http.Request) {
+	audit(req, "reconciliation", "the storage accounts of every subscription")
+	utils.WriteResponse(w, http.StatusOK, r.ReconcileNow())
+}
@@ -0,0 +1,210 @@
+package web_server
+
+import (
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/storage"
+
+	ac "github.com/bingosummer/azure_storage_service_broker/azure_client"
+	"github.com/bingosummer/azure_storage_service_broker/config"
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+// reconcileClient offers fixed tagged storage accounts, knows which untagged
+// accounts exist and the live configuration of accounts, records deletions
+// and remediations and fails the other operations of the client.
+type reconcileClient struct {
+	ac.Client
+	accounts   []ac.StorageAccount
+	existing   map[string]bool
+	live       map[string]*model.AccountConfiguration
+	deleted    *[]string
+	remediated *[]string
+	err        error
+}
+
+func (c reconcileClient) BrokerStorageAccounts() ([]ac.StorageAccount, error) {
+	return c.accounts, c.err
+}
+
+func (c reconcileClient) GetInstanceState(resourceGroupName, storageAccountName string) (storage.ProvisioningState, error) {
+	if c.existing[storageAccountName] {
+		return storage.Succeeded, nil
+	}
+	return "", ac.ServiceError{StatusCode: 404, Code: "ResourceNotFound"}
+}
+
+func (c reconcileClient) DeleteInstance(resourceGroupName, storageAccountName string) error {
+	*c.deleted = append(*c.deleted, storageAccountName)
+	return nil
+}
+
+func (c reconcileClient) AccountConfiguration(resourceGroupName, storageAccountName string) (*model.AccountConfiguration, error) {
+	if live, ok := c.live[storageAccountName]; ok {
+		return live, nil
+	}
+	return nil, ac.ServiceError{StatusCode: 404, Code: "ResourceNotFound"}
+}
+
+func (c reconcileClient) RemediateInstance(resourceGroupName, storageAccountName string, desired *model.AccountConfiguration, drift []model.Drift) error {
+	*c.remediated = append(*c.remediated, storageAccountName)
+	return nil
+}
+
+func taggedAccount(name, created string) ac.StorageAccount {
+	return ac.StorageAccount{
+		Id:         "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/" + name,
+		Name:       name,
+		Tags:       map[string]string{"broker_id": "broker", "instance_id": name + "-id"},
+		Properties: ac.StorageAccountProperties{CreationTime: created},
+	}
+}
+
+func reconcileSnapshot(cleanup bool, deleted, remediated *[]string) *Snapshot {
+	return &Snapshot{
+		Conf: &config.Config{
+			Profiles:   map[string]config.AzureConfig{"blind": {}},
+			Reconciler: config.ReconcilerConfig{Cleanup: cleanup, GracePeriod: "24h"},
+		},
+		Catalog: &model.Catalog{Services: []model.Service{{
+			Id: "service-id",
+			Plans: []model.ServicePlan{
+				{Id: "plan-id"},
+				{Id: "enforced-plan-id", Metadata: model.ServicePlanMetadata{Enforced: true}},
+			},
+		}}},
+		ServiceClients: map[string]ac.Client{
+			"default": reconcileClient{
+				accounts: []ac.StorageAccount{
+					taggedAccount("known", "2018-01-01T00:00:00Z"),
+					taggedAccount("old", "2018-01-01T00:00:00Z"),
+					taggedAccount("new", "2018-01-09T12:00:00Z"),
+				},
+				existing: map[string]bool{"legacy": true},
+				live: map[string]*model.AccountConfiguration{
+					"known":  {Sku: "Standard_GRS", AccessTier: "Hot"},
+					"legacy": {Sku: "Standard_GRS", AccessTier: "Cool"},
+				},
+				deleted:    deleted,
+				remediated: remediated,
+			},
+			"blind": reconcileClient{err: errors.New("forbidden")},
+		},
+	}
+}
+
+func reconcileController(instances map[string]*model.ServiceInstance) *Controller {
+	if instances == nil {
+		instances = make(map[string]*model.ServiceInstance)
+	}
+	return NewController(&config.Config{}, nil, instances, make(map[string]*model.ServiceBinding))
+}
+
+func TestReconcile(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2018-01-10T00:00:00Z")
+	instances := map[string]*model.ServiceInstance{
+		"known-id":    {Id: "known-id", ServiceId: "service-id", PlanId: "enforced-plan-id", ResourceGroupName: "rg", StorageAccountName: "known", State: "succeeded", Configuration: &model.AccountConfiguration{Sku: "Standard_LRS", AccessTier: "Hot"}},
+		"legacy-id":   {Id: "legacy-id", ServiceId: "service-id", PlanId: "plan-id", ResourceGroupName: "rg", StorageAccountName: "legacy", State: "succeeded", Configuration: &model.AccountConfiguration{AccessTier: "Hot"}},
+		"gone-id":     {Id: "gone-id", ServiceId: "service-id", PlanId: "enforced-plan-id", ResourceGroupName: "rg", StorageAccountName: "gone", State: "succeeded", Configuration: &model.AccountConfiguration{Sku: "Standard_LRS"}},
+		"creating-id": {Id: "creating-id", ResourceGroupName: "rg", StorageAccountName: "creating", State: "in progress"},
+		"emea-id":     {Id: "emea-id", ResourceGroupName: "rg", StorageAccountName: "emea", State: "succeeded", Profile: "blind"},
+	}
+
+	for i, test := range []struct {
+		cleanup         bool
+		expectedDeleted []string
+	}{
+		{false, nil},
+		{true, []string{"old"}},
+	} {
+		var deleted, remediated []string
+		report := reconcile(reconcileSnapshot(test.cleanup, &deleted, &remediated), reconcileController(instances), now)
+
+		var orphans []string
+		for _, orphan := range report.Orphans {
+			orphans = append(orphans, orphan.StorageAccountName)
+			if orphan.Deleted != (orphan.StorageAccountName == "old" && test.cleanup) {
+				t.Errorf("Test %d: orphan %s was deleted %v\n", i, orphan.StorageAccountName, orphan.Deleted)
+			}
+		}
+		if !reflect.DeepEqual(orphans, []string{"old", "new"}) {
+			t.Errorf("Test %d: orphans were %v\n", i, orphans)
+		}
+		if !reflect.DeepEqual(report.Missing, []MissingAccount{{Profile: "default", InstanceId: "gone-id", ResourceGroupName: "rg", StorageAccountName: "gone"}}) {
+			t.Errorf("Test %d: missing accounts were %+v\n", i, report.Missing)
+		}
+		if !reflect.DeepEqual(report.Errors, []string{"the storage accounts of profile blind cannot be listed: forbidden"}) {
+			t.Errorf("Test %d: errors were %q\n", i, report.Errors)
+		}
+		if !reflect.DeepEqual(deleted, test.expectedDeleted) {
+			t.Errorf("Test %d: deleted %v but expected %v\n", i, deleted, test.expectedDeleted)
+		}
+		expectedDrifted := []DriftedAccount{
+			{Profile: "default", InstanceId: "known-id", ResourceGroupName: "rg", StorageAccountName: "known", Drift: []model.Drift{{Setting: "sku", Desired: "Standard_LRS", Actual: "Standard_GRS"}}, Remediated: true},
+			{Profile: "default", InstanceId: "legacy-id", ResourceGroupName: "rg", StorageAccountName: "legacy", Drift: []model.Drift{{Setting: "access_tier", Desired: "Hot", Actual: "Cool"}}},
+		}
+		if !reflect.DeepEqual(report.Drifted, expectedDrifted) {
+			t.Errorf("Test %d: drifted accounts were %+v\n", i, report.Drifted)
+		}
+		if !reflect.DeepEqual(remediated, []string{"known"}) {
+			t.Errorf("Test %d: remediated %v\n", i, remediated)
+		}
+	}
+}
+
+func TestReconcileSkipsUpdates(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2018-01-10T00:00:00Z")
+	controller := reconcileController(map[string]*model.ServiceInstance{
+		"known-id": {Id: "known-id", ServiceId: "service-id", PlanId: "enforced-plan-id", ResourceGroupName: "rg", StorageAccountName: "known", State: "succeeded", Configuration: &model.AccountConfiguration{Sku: "Standard_LRS", AccessTier: "Hot"}},
+	})
+	controller.beginOperation("known-id")
+
+	var deleted, remediated []string
+	report := reconcile(reconcileSnapshot(false, &deleted, &remediated), controller, now)
+	if len(report.Drifted) != 0 || len(remediated) != 0 {
+		t.Errorf("an instance being updated was reported as %+v and remediated %v\n", report.Drifted, remediated)
+	}
+
+	controller.endOperation("known-id")
+	report = reconcile(reconcileSnapshot(false, &deleted, &remediated), controller, now)
+	if len(report.Drifted) != 1 || !reflect.DeepEqual(remediated, []string{"known"}) {
+		t.Errorf("after the update the instance was reported as %+v and remediated %v\n", report.Drifted, remediated)
+	}
+	if !controller.beginOperation("known-id") {
+		t.Errorf("the reconciler kept the instance claimed\n")
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	var deleted, remediated []string
+	now, _ := time.Parse(time.RFC3339, "2018-01-10T00:00:00Z")
+	snapshot := reconcileSnapshot(false, &deleted, &remediated)
+	report := reconcile(snapshot, reconcileController(nil), now)
+	report.Orphans[0].Deleted = true
+	report.Drifted = []DriftedAccount{{Profile: "default", Remediated: true}, {Profile: "default"}}
+	reconciler := NewReconciler(NewSnapshotStore(snapshot), reconcileController(nil))
+	reconciler.record(report)
+
+	w := httptest.NewRecorder()
+	reconciler.ServeMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, line := range []string{
+		"azure_storage_broker_orphaned_storage_accounts_deleted_total 1",
+		`azure_storage_broker_orphaned_storage_accounts{profile="default"} 2`,
+		`azure_storage_broker_orphaned_storage_accounts{profile="blind"} 0`,
+		`azure_storage_broker_missing_storage_accounts{profile="default"} 0`,
+		`azure_storage_broker_drifted_storage_accounts{profile="default"} 1`,
+		"azure_storage_broker_drifted_storage_accounts_remediated_total 1",
+		"azure_storage_broker_reconciliation_errors 1",
+		"azure_storage_broker_last_reconciliation_timestamp_seconds 1515542400",
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("metrics lack %q:\n%s\n", line, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package web_server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/arm/storage"
+
+	ac "github.com/bingosummer/azure_storage_service_broker/azure_client"
+	"github.com/bingosummer/azure_storage_service_broker/config"
+	"github.com/bingosummer/azure_storage_service_broker/model"
+	"github.com/bingosummer/azure_storage_service_broker/utils"
+)
+
+// RecoveryReport describes what a recovery added to the broker state and
+// what it could not reconcile.
+type RecoveryReport struct {
+	Instances      []string
+	Bindings       []string
+	ResourceGroups []string
+	Conflicts      []string
+}
+
+func (r *RecoveryReport) conflict(format string, args ...interface{}) {
+	r.Conflicts = append(r.Conflicts, fmt.Sprintf(format, args...))
+}
+
+// Recover rebuilds the service instances and bindings missing from the state
+// files. Instances are read from the tags of the storage accounts in every
+// subscription, bindings from the access policies of their containers.
+// Records already in the state files are kept. Without dryRun the state
+// files are written, so the broker should not be running.
+func Recover(conf *config.Config, dryRun bool) (*RecoveryReport, error) {
+	snapshot, err := loadSnapshot(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := loadServiceInstances(conf)
+	if instances == nil {
+		return nil, fmt.Errorf("service instance data file '%s' cannot be read", conf.ServiceInstancesFileName)
+	}
+	bindings := loadServiceBindings(conf)
+	if bindings == nil {
+		return nil, fmt.Errorf("service binding data file '%s' cannot be read", conf.ServiceBindingsFileName)
+	}
+
+	report := recoverState(snapshot, instances, bindings)
+	adoptResourceGroups(snapshot, instances, dryRun, report)
+	if dryRun {
+		return report, nil
+	}
+
+	err = utils.MarshalAndRecord(instances, conf.DataPath, conf.ServiceInstancesFileName)
+	if err != nil {
+		return report, err
+	}
+	return report, utils.MarshalAndRecord(bindings, conf.DataPath, conf.ServiceBindingsFileName)
+}
+
+// recoverState adds the instances and bindings found in Azure to the maps.
+func recoverState(snapshot *Snapshot, instances map[string]*model.ServiceInstance, bindings map[string]*model.ServiceBinding) *RecoveryReport {
+	report := &RecoveryReport{}
+
+	// Profiles may share a subscription, so accounts are seen once by ID
+	seen := make(map[string]bool)
+	found := make(map[string]*model.ServiceInstance)
+	listed := make(map[string]bool)
+
+	for _, profile := range snapshot.Conf.ProfileNames() {
+		serviceClient, _ := snapshot.ServiceClient(profile)
+		accounts, err := serviceClient.BrokerStorageAccounts()
+		if err != nil {
+			report.conflict("the storage accounts of profile %s cannot be listed: %v", profile, err)
+			continue
+		}
+		listed[profile] = true
+
+		for _, account := range accounts {
+			if seen[strings.ToLower(account.Id)] {
+				continue
+			}
+			seen[strings.ToLower(account.Id)] = true
+
+			instance, err := instanceFromAccount(snapshot, profile, account)
+			if err != nil {
+				report.conflict("storage account %s: %v", account.Name, err)
+				continue
+			}
+			if other := found[instance.Id]; other != nil {
+				report.conflict("service instance %s is tagged on storage accounts %s and %s, keeping %s", instance.Id, other.StorageAccountName, instance.StorageAccountName, other.StorageAccountName)
+				continue
+			}
+			found[instance.Id] = instance
+
+			if existing := instances[instance.Id]; existing != nil {
+				if !strings.EqualFold(existing.StorageAccountName, instance.StorageAccountName) || !strings.EqualFold(existing.ResourceGroupName, instance.ResourceGroupName) {
+					report.conflict("service instance %s is recorded with storage account %s.%s but tagged on %s.%s, keeping the record", instance.Id, existing.ResourceGroupName, existing.StorageAccountName, instance.ResourceGroupName, instance.StorageAccountName)
+				}
+				continue
+			}
+
+			recoverNetwork(serviceClient, instance, report)
+			recoverBindings(snapshot, serviceClient, instance, bindings, report)
+			instances[instance.Id] = instance
+			report.Instances = append(report.Instances, instance.Id)
+		}
+	}
+
+	var ids []string
+	for id := range instances {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		instance := instances[id]
+		profile := instance.Profile
+		if profile == "" {
+			profile = config.DEFAULT_PROFILE
+		}
+		if found[id] == nil && listed[profile] && instance.StorageAccountName != "" {
+			report.conflict("service instance %s is recorded but storage account %s.%s carries no tags of this broker", id, instance.ResourceGroupName, instance.StorageAccountName)
+		}
+	}
+
+	return report
+}
+
+// adoptResourceGroups tags the resource groups which the broker named for the
+// instances but created before it tagged them, so that deprovisioning deletes
+// them once empty.
+func adoptResourceGroups(snapshot *Snapshot, instances map[string]*model.ServiceInstance, dryRun bool, report *RecoveryReport) {
+	var ids []string
+	for id := range instances {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	// Instances may share a group
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		instance := instances[id]
+		key := strings.ToLower(instance.Profile + "/" + instance.ResourceGroupName)
+		if instance.ResourceGroupName == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		serviceClient, err := snapshot.ServiceClient(instance.Profile)
+		if err != nil {
+			report.conflict("the resource group of service instance %s cannot be reached: %v", id, err)
+			continue
+		}
+		tagged, err := serviceClient.AdoptResourceGroup(instance, dryRun)
+		if err != nil {
+			report.conflict("resource group %s of service instance %s cannot be tagged: %v", instance.ResourceGroupName, id, err)
+			continue
+		}
+		if tagged {
+			report.ResourceGroups = append(report.ResourceGroups, instance.ResourceGroupName)
+		}
+	}
+}
+
+// instanceFromAccount reads a service instance from the tags of its storage
+// account.
+func instanceFromAccount(snapshot *Snapshot, profile string, account ac.StorageAccount) (*model.ServiceInstance, error) {
+	tags := account.Tags
+	service, plan, err := snapshot.Catalog.LookupPlan(tags["plan_id"])
+	if err != nil {
+		return nil, err
+	}
+
+	instance := &model.ServiceInstance{
+		Id:                 tags["instance_id"],
+		PlanId:             plan.Id,
+		ServiceId:          service.Id,
+		OrganizationGuid:   tags["organization_guid"],
+		SpaceGuid:          tags["space_guid"],
+		ResourceGroupName:  ac.ResourceGroupOf(account.Id),
+		StorageAccountName: account.Name,
+		Profile:            profile,
+		Location:           config.NormalizeLocation(account.Location),
+		Context: &model.Context{
+			Platform:         tags["platform"],
+			OrganizationGuid: tags["organization_guid"],
+			OrganizationName: tags["organization_name"],
+			SpaceGuid:        tags["space_guid"],
+			SpaceName:        tags["space_name"],
+			Namespace:        tags["namespace"],
+			ClusterId:        tags["cluster_id"],
+		},
+		// The live configuration, which tells how bindings access the account
+		Configuration: ac.ConfigurationOf(account),
+		Description:   "recovered from the tags of storage account " + account.Name,
+	}
+	if tags["created_by"] != "" {
+		instance.OriginatingIdentity = &model.OriginatingIdentity{Platform: instance.Platform(), Value: map[string]interface{}{"user_id": tags["created_by"]}}
+	}
+
+	userTags := make(map[string]interface{})
+	for name, value := range tags {
+		if _, ok := snapshot.Conf.Tags[name]; !ok && !ac.IsStandardTag(name) {
+			userTags[name] = value
+		}
+	}
+	if len(userTags) > 0 {
+		instance.Parameters = map[string]interface{}{ac.TAGS_PARAMETER: userTags}
+	}
+
+	switch account.Properties.ProvisioningState {
+	case storage.Creating, storage.ResolvingDNS:
+		instance.State = "in progress"
+	case storage.Succeeded:
+		instance.State = "succeeded"
+	default:
+		instance.State = "failed"
+	}
+
+	return instance, nil
+}
+
+// recoverNetwork restores the network ACL of the instance from its storage
+// account, and its private endpoint from the tags of the endpoint.
+func recoverNetwork(serviceClient ac.Client, instance *model.ServiceInstance, report *RecoveryReport) {
+	if rules := instance.Configuration.NetworkRules; rules != nil && (rules.DefaultAction == ac.NETWORK_ACTION_DENY || len(rules.IpRules) > 0 || len(rules.SubnetIds) > 0) {
+		copied := *rules
+		instance.NetworkRules = &copied
+	}
+
+	endpoint, err := serviceClient.FindPrivateEndpoint(instance)
+	if err != nil {
+		report.conflict("the private endpoints of service instance %s cannot be listed, its bindings lack private_fqdn if it has one: %v", instance.Id, err)
+		return
+	}
+	if endpoint == nil {
+		return
+	}
+	instance.PrivateEndpoint = endpoint
+	if !endpoint.Ready() {
+		report.conflict("private endpoint %s of service instance %s is not ready, its bindings lack private_fqdn", endpoint.Name, instance.Id)
+	}
+}
+
+// recoverBindings finds the container of the instance and reads its bindings
+// from the access policies of the container, and the bindings with an Azure
+// AD identity from their role assignments on it. The access policies are
+// read from the blob service with the account keys, so the bindings of
+// accounts without shared key access or with a private endpoint are only
+// found by their role assignments.
+func recoverBindings(snapshot *Snapshot, serviceClient ac.Client, instance *model.ServiceInstance, bindings map[string]*model.ServiceBinding, report *RecoveryReport) {
+	policies := instance.AllowsSharedKeyAccess() && instance.PrivateEndpoint == nil
+	containers, err := serviceClient.ListContainers(instance.ResourceGroupName, instance.StorageAccountName, policies)
+	if err != nil {
+		report.conflict("the containers of service instance %s cannot be listed, its bindings are not recovered: %v", instance.Id, err)
+	}
+	if !policies && instance.PrivateEndpoint != nil && instance.AllowsSharedKeyAccess() {
+		report.conflict("service instance %s has a private endpoint, its bindings with the account keys are not recovered", instance.Id)
+	}
+	grants, err := serviceClient.ContainerGrants(instance.ResourceGroupName, instance.StorageAccountName)
+	if err != nil {
+		report.conflict("the role assignments of service instance %s cannot be listed, its bindings with an Azure AD identity are not recovered: %v", instance.Id, err)
+	}
+	granted := make(map[string][]ac.ContainerGrant)
+	for _, grant := range grants {
+		granted[grant.ContainerName] = append(granted[grant.ContainerName], grant)
+	}
+
+	var container *ac.Container
+	for i := range containers {
+		if len(containers[i].Policies) == 0 && len(granted[containers[i].Name]) == 0 {
+			continue
+		}
+		if container != nil {
+			report.conflict("service instance %s has bindings on containers %s and %s, keeping %s", instance.Id, container.Name, containers[i].Name, container.Name)
+			continue
+		}
+		container = &containers[i]
+	}
+
+	if container == nil {
+		// Instances without bindings have no container yet
+		namer, err := ac.NewNamer(snapshot.Conf.Naming)
+		if err == nil {
+			instance.ContainerName, _ = namer.ContainerName(instance)
+		}
+		return
+	}
+	instance.ContainerName = container.Name
+	instance.ContainerAccessType = container.AccessType
+
+	recorded := func(id string) bool {
+		existing := bindings[id]
+		if existing != nil && existing.ServiceInstanceId != instance.Id {
+			report.conflict("service binding %s is recorded for service instance %s but found on service instance %s, keeping the record", id, existing.ServiceInstanceId, instance.Id)
+		}
+		return existing != nil
+	}
+	var privateFqdn string
+	if instance.PrivateEndpoint != nil {
+		privateFqdn = instance.PrivateEndpoint.Fqdn
+	}
+
+	for _, grant := range granted[container.Name] {
+		if recorded(grant.BindingId) {
+			continue
+		}
+		bindings[grant.BindingId] = &model.ServiceBinding{
+			Id:                grant.BindingId,
+			ServiceId:         instance.ServiceId,
+			ServicePlanId:     instance.PlanId,
+			ServiceInstanceId: instance.Id,
+			Parameters:        map[string]interface{}{ac.PRINCIPAL_ID_PARAMETER: grant.PrincipalId},
+			Credentials: model.Credentials{
+				StorageAccountName: instance.StorageAccountName,
+				ContainerName:      container.Name,
+				PrincipalId:        grant.PrincipalId,
+				EndpointSuffix:     serviceClient.StorageEndpointSuffix(),
+				PrivateFqdn:        privateFqdn,
+			},
+			State:       "succeeded",
+			Description: "recovered from the role assignments of container " + container.Name,
+		}
+		report.Bindings = append(report.Bindings, grant.BindingId)
+	}
+
+	var primaryAccessKey, secondaryAccessKey string
+	for _, id := range container.Policies {
+		if recorded(id) {
+			continue
+		}
+
+		if primaryAccessKey == "" {
+			primaryAccessKey, secondaryAccessKey, _, err = serviceClient.GetAccessKeys(instance.ResourceGroupName, instance.StorageAccountName, container.Name, container.AccessType)
+			if err != nil {
+				report.conflict("the access keys of service instance %s cannot be read, its bindings are not recovered: %v", instance.Id, err)
+				return
+			}
+		}
+
+		bindings[id] = &model.ServiceBinding{
+			Id:                id,
+			ServiceId:         instance.ServiceId,
+			ServicePlanId:     instance.PlanId,
+			ServiceInstanceId: instance.Id,
+			Credentials: model.Credentials{
+				StorageAccountName: instance.StorageAccountName,
+				ContainerName:      container.Name,
+				PrimaryAccessKey:   primaryAccessKey,
+				SecondaryAccessKey: secondaryAccessKey,
+				EndpointSuffix:     serviceClient.StorageEndpointSuffix(),
+				PrivateFqdn:        privateFqdn,
+			},
+			State:       "succeeded",
+			Description: "recovered from the access policies of container " + container.Name,
+		}
+		report.Bindings = append(report.Bindings, id)
+	}
+}
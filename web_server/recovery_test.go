@@ -0,0 +1,212 @@
+package web_server
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/storage"
+	storageclient "github.com/Azure/azure-sdk-for-go/storage"
+
+	ac "github.com/bingosummer/azure_storage_service_broker/azure_client"
+	"github.com/bingosummer/azure_storage_service_broker/config"
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+// recoveryClient offers fixed storage accounts, containers, role assignments
+// and private endpoints and fails the other operations of the client.
+type recoveryClient struct {
+	ac.Client
+	accounts   []ac.StorageAccount
+	containers map[string][]ac.Container
+	grants     map[string][]ac.ContainerGrant
+	endpoints  map[string]*model.PrivateEndpoint
+	err        error
+}
+
+func (c recoveryClient) BrokerStorageAccounts() ([]ac.StorageAccount, error) {
+	return c.accounts, c.err
+}
+
+func (c recoveryClient) ListContainers(resourceGroupName, storageAccountName string, policies bool) ([]ac.Container, error) {
+	var containers []ac.Container
+	for _, container := range c.containers[storageAccountName] {
+		if !policies {
+			container.Policies = nil
+		}
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
+
+func (c recoveryClient) FindPrivateEndpoint(instance *model.ServiceInstance) (*model.PrivateEndpoint, error) {
+	return c.endpoints[instance.Id], nil
+}
+
+func (c recoveryClient) ContainerGrants(resourceGroupName, storageAccountName string) ([]ac.ContainerGrant, error) {
+	return c.grants[storageAccountName], nil
+}
+
+func (c recoveryClient) GetAccessKeys(resourceGroupName, storageAccountName, containerName string, containerAccessType storageclient.ContainerAccessType) (string, string, string, error) {
+	return "key1", "key2", containerName, nil
+}
+
+func (c recoveryClient) StorageEndpointSuffix() string {
+	return "core.windows.net"
+}
+
+// adoptionClient tags the resource groups without a managed-by tag and fails
+// the other operations of the client.
+type adoptionClient struct {
+	ac.Client
+	tagged  map[string]bool
+	adopted *[]string
+}
+
+func (c adoptionClient) AdoptResourceGroup(instance *model.ServiceInstance, dryRun bool) (bool, error) {
+	if c.tagged[instance.ResourceGroupName] {
+		return false, nil
+	}
+	if !dryRun {
+		*c.adopted = append(*c.adopted, instance.ResourceGroupName)
+	}
+	return true, nil
+}
+
+func account(name, instanceId string, tags map[string]string) ac.StorageAccount {
+	all := map[string]string{"broker_id": "broker", "instance_id": instanceId, "plan_id": "plan-id", "platform": "cloudfoundry", "organization_guid": "org-guid", "space_guid": "space-guid"}
+	for tag, value := range tags {
+		all[tag] = value
+	}
+	return ac.StorageAccount{
+		Id:         "/subscriptions/sub/resourceGroups/rg-" + name + "/providers/Microsoft.Storage/storageAccounts/" + name,
+		Name:       name,
+		Location:   "westeurope",
+		Tags:       all,
+		Properties: ac.StorageAccountProperties{ProvisioningState: storage.Succeeded},
+	}
+}
+
+func TestRecoverState(t *testing.T) {
+	disabled := false
+	keyless := account("keyless", "keyless-id", nil)
+	keyless.Properties.AllowSharedKeyAccess = &disabled
+	keyless.Properties.NetworkRuleSet = &ac.NetworkRuleSet{DefaultAction: "Deny"}
+
+	snapshot := &Snapshot{
+		Conf: &config.Config{
+			Profiles: map[string]config.AzureConfig{"emea": {}, "blind": {}},
+			Naming:   config.NamingConfig{StorageAccount: "cf{instance_hash}", Container: "cloud-foundry-{instance_id}"},
+			Tags:     map[string]string{"cost_center": "42"},
+		},
+		Catalog: &model.Catalog{Services: []model.Service{{Id: "service-id", Plans: []model.ServicePlan{{Id: "plan-id"}}}}},
+		ServiceClients: map[string]ac.Client{
+			"default": recoveryClient{
+				accounts: []ac.StorageAccount{
+					account("lost", "lost-id", map[string]string{"cost_center": "42", "project": "apollo"}),
+					account("known", "known-id", nil),
+					account("moved", "moved-id", nil),
+					account("unknown", "unknown-id", map[string]string{"plan_id": "retired-plan"}),
+					keyless,
+				},
+				containers: map[string][]ac.Container{
+					"lost":    {{Name: "empty"}, {Name: "data", AccessType: "blob", Policies: []string{"binding-1", "binding-2"}}},
+					"keyless": {{Name: "empty"}, {Name: "files", Policies: []string{"binding-4"}}},
+				},
+				grants: map[string][]ac.ContainerGrant{
+					"keyless": {{BindingId: "binding-3", ContainerName: "files", PrincipalId: "principal-id"}},
+				},
+				endpoints: map[string]*model.PrivateEndpoint{
+					"keyless-id": {Name: "keyless-pe", Fqdn: "keyless.privatelink.blob.core.windows.net"},
+				},
+			},
+			"emea":  recoveryClient{accounts: []ac.StorageAccount{account("copy", "lost-id", nil)}},
+			"blind": recoveryClient{err: errors.New("forbidden")},
+		},
+	}
+	instances := map[string]*model.ServiceInstance{
+		"known-id": {Id: "known-id", ResourceGroupName: "rg-known", StorageAccountName: "known"},
+		"moved-id": {Id: "moved-id", ResourceGroupName: "rg-other", StorageAccountName: "other"},
+		"gone-id":  {Id: "gone-id", ResourceGroupName: "rg-gone", StorageAccountName: "gone"},
+	}
+	bindings := map[string]*model.ServiceBinding{
+		"binding-2": {Id: "binding-2", ServiceInstanceId: "other-id"},
+	}
+
+	report := recoverState(snapshot, instances, bindings)
+
+	if !reflect.DeepEqual(report.Instances, []string{"lost-id", "keyless-id"}) || !reflect.DeepEqual(report.Bindings, []string{"binding-1", "binding-3"}) {
+		t.Errorf("recovered instances %v and bindings %v\n", report.Instances, report.Bindings)
+	}
+
+	lost := instances["lost-id"]
+	if lost == nil || lost.ServiceId != "service-id" || lost.ResourceGroupName != "rg-lost" || lost.ContainerName != "data" || lost.ContainerAccessType != "blob" ||
+		lost.Profile != "default" || lost.State != "succeeded" || lost.OrganizationGuid != "org-guid" {
+		t.Errorf("recovered instance was %+v\n", lost)
+	} else if expected := map[string]interface{}{"tags": map[string]interface{}{"project": "apollo"}}; !reflect.DeepEqual(lost.Parameters, expected) {
+		t.Errorf("recovered parameters were %v but expected %v\n", lost.Parameters, expected)
+	}
+
+	if binding := bindings["binding-1"]; binding == nil || binding.ServiceInstanceId != "lost-id" || binding.Credentials.PrimaryAccessKey != "key1" || binding.Credentials.ContainerName != "data" {
+		t.Errorf("recovered binding was %+v\n", binding)
+	}
+	if keyless := instances["keyless-id"]; keyless == nil || keyless.AllowsSharedKeyAccess() || keyless.ContainerName != "files" ||
+		keyless.PrivateEndpoint == nil || keyless.PrivateEndpoint.Name != "keyless-pe" || keyless.NetworkRules == nil || keyless.NetworkRules.DefaultAction != "Deny" {
+		t.Errorf("recovered instance was %+v\n", keyless)
+	}
+	if lost != nil && (lost.NetworkRules != nil || lost.PrivateEndpoint != nil) {
+		t.Errorf("recovered instance without network rules was %+v\n", lost)
+	}
+	if binding := bindings["binding-3"]; binding == nil || binding.Credentials.PrincipalId != "principal-id" || binding.Credentials.PrimaryAccessKey != "" || binding.Credentials.ContainerName != "files" ||
+		binding.Credentials.PrivateFqdn != "keyless.privatelink.blob.core.windows.net" ||
+		!reflect.DeepEqual(binding.Parameters, map[string]interface{}{"principal_id": "principal-id"}) {
+		t.Errorf("recovered binding was %+v\n", binding)
+	}
+	if bindings["binding-2"].ServiceInstanceId != "other-id" || instances["moved-id"].StorageAccountName != "other" {
+		t.Errorf("recorded state was replaced\n")
+	}
+
+	conflicts := append([]string{}, report.Conflicts...)
+	sort.Strings(conflicts)
+	expected := []string{
+		`service binding binding-2 is recorded for service instance other-id but found on service instance lost-id, keeping the record`,
+		`service instance gone-id is recorded but storage account rg-gone.gone carries no tags of this broker`,
+		`service instance lost-id is tagged on storage accounts lost and copy, keeping lost`,
+		`service instance moved-id is recorded with storage account rg-other.other but tagged on rg-moved.moved, keeping the record`,
+		`storage account unknown: plan_id "retired-plan" is not offered by this broker`,
+		`the storage accounts of profile blind cannot be listed: forbidden`,
+	}
+	if !reflect.DeepEqual(conflicts, expected) {
+		t.Errorf("conflicts were %q but expected %q\n", conflicts, expected)
+	}
+}
+
+func TestAdoptResourceGroups(t *testing.T) {
+	for i, dryRun := range []bool{false, true} {
+		var adopted []string
+		snapshot := &Snapshot{
+			Conf:           &config.Config{Profiles: map[string]config.AzureConfig{"emea": {}}},
+			ServiceClients: map[string]ac.Client{"default": adoptionClient{tagged: map[string]bool{"rg-new": true}, adopted: &adopted}},
+		}
+		instances := map[string]*model.ServiceInstance{
+			"a": {Id: "a", ResourceGroupName: "rg-old"},
+			"b": {Id: "b", ResourceGroupName: "RG-OLD"},
+			"c": {Id: "c", ResourceGroupName: "rg-new"},
+			"d": {Id: "d", ResourceGroupName: "rg-lost", Profile: "gone"},
+			"e": {Id: "e"},
+		}
+		report := &RecoveryReport{}
+		adoptResourceGroups(snapshot, instances, dryRun, report)
+
+		if !reflect.DeepEqual(report.ResourceGroups, []string{"rg-old"}) {
+			t.Errorf("Test %d: tagged resource groups were %v\n", i, report.ResourceGroups)
+		}
+		if dryRun != (len(adopted) == 0) {
+			t.Errorf("Test %d: adopted %v in a dry run %v\n", i, adopted, dryRun)
+		}
+		if len(report.Conflicts) != 1 {
+			t.Errorf("Test %d: conflicts were %v but expected one for the missing profile\n", i, report.Conflicts)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package web_server
+
+import (
+	"fmt"
+	"strings"
+
+	ac "github.com/bingosummer/azure_storage_service_broker/azure_client"
+	"github.com/bingosummer/azure_storage_service_broker/broker_error"
+	"github.com/bingosummer/azure_storage_service_broker/config"
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+// validateLocation checks the region of a new instance against the regions
+// the broker, the plan and the data residency of the organization allow.
+func validateLocation(conf *config.Config, plan *model.ServicePlan, instance *model.ServiceInstance) error {
+	location := instance.Location
+
+	if !config.AllowsLocation(conf.Regions.Allowed, location) {
+		return broker_error.RegionNotAllowed(fmt.Sprintf("Region %s is not allowed, the broker allows %s", location, strings.Join(conf.Regions.Allowed, ", ")))
+	}
+
+	if !config.AllowsLocation(plan.Metadata.AllowedLocations, location) {
+		return broker_error.RegionNotAllowed(fmt.Sprintf("Region %s is not allowed, plan %s allows %s", location, plan.Name, strings.Join(plan.Metadata.AllowedLocations, ", ")))
+	}
+
+	if owner, allowed := residency(conf, instance); !config.AllowsLocation(allowed, location) {
+		return broker_error.RegionNotAllowed(fmt.Sprintf("Region %s violates the data residency of %s, which keeps its data in %s", location, owner, strings.Join(allowed, ", ")))
+	}
+
+	return nil
+}
+
+// residency returns the data residency rule which applies to the instance:
+// the one of its organization, or of its cluster on Kubernetes.
+func residency(conf *config.Config, instance *model.ServiceInstance) (string, []string) {
+	if allowed, ok := conf.Regions.Organizations[instance.OrganizationGuid]; ok && instance.OrganizationGuid != "" {
+		return "organization " + instance.OrganizationGuid, allowed
+	}
+	if c := instance.Context; c != nil && c.ClusterId != "" {
+		if allowed, ok := conf.Regions.Organizations[c.ClusterId]; ok {
+			return "cluster " + c.ClusterId, allowed
+		}
+	}
+	return "", nil
+}
+
+// offersLocation reports whether the subscription of the profile offers the
+// region. Subscriptions whose regions cannot be read are left to Azure.
+func offersLocation(serviceClient ac.Client, profile, location string) bool {
+	locations, err := serviceClient.Locations()
+	if err != nil {
+		fmt.Printf("WARNING: the regions of profile %s are unknown: %v\n", profile, err)
+		return true
+	}
+
+	for _, l := range locations {
+		if l == location {
+			return true
+		}
+	}
+	return false
+}
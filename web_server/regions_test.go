@@ -0,0 +1,67 @@
+package web_server
+
+import (
+	"errors"
+	"testing"
+
+	ac "github.com/bingosummer/azure_storage_service_broker/azure_client"
+	"github.com/bingosummer/azure_storage_service_broker/broker_error"
+	"github.com/bingosummer/azure_storage_service_broker/config"
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+func TestValidateLocation(t *testing.T) {
+	conf := &config.Config{Regions: config.RegionsConfig{
+		Allowed:       []string{"westeurope", "northeurope", "eastus", "West US"},
+		Organizations: map[string][]string{"eu-org": {"westeurope", "northeurope"}, "eu-cluster": {"westeurope"}},
+	}}
+	plan := &model.ServicePlan{Name: "standard", Metadata: model.ServicePlanMetadata{AllowedLocations: []string{"westeurope", "northeurope", "westus"}}}
+
+	for i, test := range []struct {
+		instance model.ServiceInstance
+		valid    bool
+	}{
+		{model.ServiceInstance{Location: "westeurope", OrganizationGuid: "eu-org"}, true},
+		{model.ServiceInstance{Location: "westus", OrganizationGuid: "us-org"}, true},
+		{model.ServiceInstance{Location: "westus", OrganizationGuid: "eu-org"}, false},
+		{model.ServiceInstance{Location: "eastus", OrganizationGuid: "us-org"}, false},
+		{model.ServiceInstance{Location: "japaneast", OrganizationGuid: "us-org"}, false},
+		{model.ServiceInstance{Location: "northeurope", Context: &model.Context{Platform: model.PLATFORM_KUBERNETES, ClusterId: "eu-cluster"}}, false},
+		{model.ServiceInstance{Location: "westeurope", Context: &model.Context{Platform: model.PLATFORM_KUBERNETES, ClusterId: "eu-cluster"}}, true},
+	} {
+		err := validateLocation(conf, plan, &test.instance)
+		if test.valid && err != nil {
+			t.Errorf("Test %d: validation failed with %v\n", i, err)
+		}
+		if !test.valid && (err == nil || broker_error.FromAzureError(err).StatusCode != 400) {
+			t.Errorf("Test %d: error was %v but expected a bad request\n", i, err)
+		}
+	}
+}
+
+// locationsClient offers a fixed list of regions and fails the other
+// operations of the client.
+type locationsClient struct {
+	ac.Client
+	locations []string
+	err       error
+}
+
+func (c locationsClient) Locations() ([]string, error) {
+	return c.locations, c.err
+}
+
+func TestOffersLocation(t *testing.T) {
+	for i, test := range []struct {
+		client   ac.Client
+		expected bool
+	}{
+		{locationsClient{locations: []string{"westus", "eastus"}}, true},
+		{locationsClient{locations: []string{"eastus"}}, false},
+		{locationsClient{err: errors.New("forbidden")}, true},
+	} {
+		if offers := offersLocation(test.client, "default", "westus"); offers != test.expected {
+			t.Errorf("Test %d: offers was %v but expected %v\n", i, offers, test.expected)
+		}
+	}
+}
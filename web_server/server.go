@@ -7,26 +7,33 @@ import (
 
 	"github.com/gorilla/mux"
 
+	ac "github.com/bingosummer/azure_storage_service_broker/azure_client"
 	"github.com/bingosummer/azure_storage_service_broker/config"
 	"github.com/bingosummer/azure_storage_service_broker/model"
 	"github.com/bingosummer/azure_storage_service_broker/utils"
 )
 
-var (
-	conf = config.GetConfig()
-)
+const CATALOG_FILE_NAME = "catalog.json"
 
 type Server struct {
+	configPath string
+	conf       *config.Config
+	snapshots  *SnapshotStore
 	controller *Controller
+	reconciler *Reconciler
 }
 
-func NewServer() *Server {
-	controller := NewController(loadServiceInstances(), loadServiceBindings())
-	if controller == nil {
+func NewServer(configPath string, conf *config.Config) *Server {
+	snapshot, err := loadSnapshot(conf)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
 		return nil
 	}
 
-	return &Server{controller: controller}
+	snapshots := NewSnapshotStore(snapshot)
+	controller := NewController(conf, snapshots, loadServiceInstances(conf), loadServiceBindings(conf))
+
+	return &Server{configPath: configPath, conf: conf, snapshots: snapshots, controller: controller, reconciler: NewReconciler(snapshots, controller)}
 }
 
 func (s *Server) Start() {
@@ -34,23 +41,83 @@ func (s *Server) Start() {
 
 	router.HandleFunc("/v2/catalog", s.controller.Catalog).Methods("GET")
 	router.HandleFunc("/v2/service_instances/{service_instance_guid}", s.controller.CreateServiceInstance).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{service_instance_guid}", s.controller.FetchServiceInstance).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{service_instance_guid}", s.controller.UpdateServiceInstance).Methods("PATCH")
 	router.HandleFunc("/v2/service_instances/{service_instance_guid}/last_operation", s.controller.GetServiceInstance).Methods("GET")
 	router.HandleFunc("/v2/service_instances/{service_instance_guid}", s.controller.RemoveServiceInstance).Methods("DELETE")
 	router.HandleFunc("/v2/service_instances/{service_instance_guid}/service_bindings/{service_binding_guid}", s.controller.Bind).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{service_instance_guid}/service_bindings/{service_binding_guid}", s.controller.FetchServiceBinding).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{service_instance_guid}/service_bindings/{service_binding_guid}/last_operation", s.controller.GetServiceBinding).Methods("GET")
 	router.HandleFunc("/v2/service_instances/{service_instance_guid}/service_bindings/{service_binding_guid}", s.controller.UnBind).Methods("DELETE")
 
-	http.Handle("/", router)
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = conf.Port
-	}
+	http.Handle("/", Chain(router,
+		RequestIds(),
+		AccessLog(),
+		Recovery(),
+		WithSnapshot(s.snapshots),
+		Authentication(),
+		NegotiateApiVersion(MIN_API_VERSION, MAX_API_VERSION),
+		OriginatingIdentities()))
+
+	// Operator endpoints, which the platform does not call and so carry no
+	// broker API version
+	admin := mux.NewRouter()
+	admin.HandleFunc("/admin/reconciliation", s.reconciler.ServeReport).Methods("GET")
+	admin.HandleFunc("/admin/reconciliation", s.reconciler.ServeReconciliation).Methods("POST")
+	admin.HandleFunc("/metrics", s.reconciler.ServeMetrics).Methods("GET")
+	adminHandler := Chain(admin,
+		RequestIds(),
+		AccessLog(),
+		Recovery(),
+		WithSnapshot(s.snapshots),
+		Authentication())
+	http.Handle("/admin/", adminHandler)
+	http.Handle("/metrics", adminHandler)
+
+	go s.watchConfiguration(CONFIG_POLL_INTERVAL)
+	go s.reconciler.Run()
+
+	port := s.conf.Port
 	fmt.Println("Server started, listening on port " + port + "...")
 	http.ListenAndServe(":"+port, nil)
 }
 
+// The schemas of the parameters which every plan allowing them accepts alike,
+// added to the plans on loading instead of being repeated in the catalog
+var sharedParameterSchemas = map[string]map[string]interface{}{
+	ac.TAGS_PARAMETER:          ac.TagsSchema,
+	ac.NETWORK_RULES_PARAMETER: ac.NetworkRulesSchema,
+}
+
+// The schemas of the binding parameters shared the same way
+var sharedBindParameterSchemas = map[string]map[string]interface{}{
+	ac.PRINCIPAL_ID_PARAMETER: ac.PrincipalIdSchema,
+}
+
 // private methods
-func loadServiceInstances() map[string]*model.ServiceInstance {
+func loadCatalog(conf *config.Config) (*model.Catalog, error) {
+	var catalog model.Catalog
+
+	err := utils.ReadAndUnmarshal(&catalog, conf.CatalogPath, CATALOG_FILE_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range catalog.Services {
+		for j := range catalog.Services[i].Plans {
+			for name, schema := range sharedParameterSchemas {
+				catalog.Services[i].Plans[j].AddParameterSchema(name, schema)
+			}
+			for name, schema := range sharedBindParameterSchemas {
+				catalog.Services[i].Plans[j].AddBindParameterSchema(name, schema)
+			}
+		}
+	}
+
+	return &catalog, nil
+}
+
+func loadServiceInstances(conf *config.Config) map[string]*model.ServiceInstance {
 	var serviceInstancesMap map[string]*model.ServiceInstance
 
 	err := utils.ReadAndUnmarshal(&serviceInstancesMap, conf.DataPath, conf.ServiceInstancesFileName)
@@ -62,7 +129,7 @@ func loadServiceInstances() map[string]*model.ServiceInstance {
 	return serviceInstancesMap
 }
 
-func loadServiceBindings() map[string]*model.ServiceBinding {
+func loadServiceBindings(conf *config.Config) map[string]*model.ServiceBinding {
 	var bindingMap map[string]*model.ServiceBinding
 
 	err := utils.ReadAndUnmarshal(&bindingMap, conf.DataPath, conf.ServiceBindingsFileName)
@@ -0,0 +1,163 @@
+package web_server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	ac "github.com/bingosummer/azure_storage_service_broker/azure_client"
+	"github.com/bingosummer/azure_storage_service_broker/config"
+	"github.com/bingosummer/azure_storage_service_broker/model"
+)
+
+// How often the configuration file and the catalog are checked for changes
+const CONFIG_POLL_INTERVAL = 5 * time.Second
+
+// Snapshot is the configuration a request is served with. A reload replaces
+// the current snapshot, while requests in flight keep the one they started
+// with.
+type Snapshot struct {
+	Conf    *config.Config
+	Catalog *model.Catalog
+
+	// One Azure client per credential profile
+	ServiceClients map[string]ac.Client
+}
+
+// ServiceClient returns the Azure client of a credential profile. The empty
+// name stands for the default profile.
+func (s *Snapshot) ServiceClient(profile string) (ac.Client, error) {
+	if profile == "" {
+		profile = config.DEFAULT_PROFILE
+	}
+
+	serviceClient, ok := s.ServiceClients[profile]
+	if !ok {
+		return nil, fmt.Errorf("credential profile %q is not configured", profile)
+	}
+	return serviceClient, nil
+}
+
+// SnapshotStore holds the current snapshot and swaps it atomically.
+type SnapshotStore struct {
+	current atomic.Value
+}
+
+func NewSnapshotStore(snapshot *Snapshot) *SnapshotStore {
+	store := &SnapshotStore{}
+	store.Swap(snapshot)
+	return store
+}
+
+func (s *SnapshotStore) Current() *Snapshot {
+	return s.current.Load().(*Snapshot)
+}
+
+func (s *SnapshotStore) Swap(snapshot *Snapshot) {
+	s.current.Store(snapshot)
+}
+
+// loadSnapshot loads the catalog and creates the Azure clients for a
+// validated configuration.
+func loadSnapshot(conf *config.Config) (*Snapshot, error) {
+	catalog, err := loadCatalog(conf)
+	if err != nil {
+		return nil, fmt.Errorf("loading the catalog failed: %v", err)
+	}
+
+	serviceClients := make(map[string]ac.Client)
+	for _, profile := range conf.ProfileNames() {
+		serviceClient, err := ac.NewClient(conf, profile)
+		if err != nil {
+			return nil, fmt.Errorf("creating the Azure client of profile %s failed: %v", profile, err)
+		}
+		serviceClients[profile] = serviceClient
+	}
+
+	return &Snapshot{Conf: conf, Catalog: catalog, ServiceClients: serviceClients}, nil
+}
+
+// WithSnapshot pins the current snapshot to the request.
+func WithSnapshot(store *SnapshotStore) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), snapshotKey, store.Current())))
+		})
+	}
+}
+
+// RequestSnapshot returns the snapshot pinned by WithSnapshot, or nil.
+func RequestSnapshot(r *http.Request) *Snapshot {
+	snapshot, _ := r.Context().Value(snapshotKey).(*Snapshot)
+	return snapshot
+}
+
+// Reload loads and validates the configuration, the catalog and the Azure
+// credentials again, and swaps them in only if all of them succeed.
+func (s *Server) Reload() error {
+	conf, err := config.Load(s.configPath)
+	if err != nil {
+		return err
+	}
+
+	for _, setting := range conf.KeepRestartSettings(s.conf) {
+		fmt.Printf("WARNING: %s changed but only takes effect after a restart\n", setting)
+	}
+
+	snapshot, err := loadSnapshot(conf)
+	if err != nil {
+		return err
+	}
+
+	s.snapshots.Swap(snapshot)
+	return nil
+}
+
+// watchConfiguration reloads the configuration on SIGHUP and when the
+// configuration file or the catalog changes.
+func (s *Server) watchConfiguration(interval time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	modified := s.modificationTimes()
+	for {
+		var reason string
+		select {
+		case <-signals:
+			reason = "SIGHUP"
+		case <-ticker.C:
+			current := s.modificationTimes()
+			if current == modified {
+				continue
+			}
+			reason = "a file change"
+		}
+		modified = s.modificationTimes()
+
+		err := s.Reload()
+		if err != nil {
+			fmt.Printf("Reloading the configuration after %s failed, keeping the current one: %v\n", reason, err)
+			continue
+		}
+		fmt.Printf("Reloaded the configuration after %s\n", reason)
+	}
+}
+
+func (s *Server) modificationTimes() string {
+	var times string
+	for _, path := range []string{s.configPath, filepath.Join(s.snapshots.Current().Conf.CatalogPath, CATALOG_FILE_NAME)} {
+		if info, err := os.Stat(path); err == nil {
+			times += info.ModTime().String() + ";"
+		}
+	}
+	return times
+}
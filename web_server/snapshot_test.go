@@ -0,0 +1,76 @@
+package web_server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ac "github.com/bingosummer/azure_storage_service_broker/azure_client"
+	"github.com/bingosummer/azure_storage_service_broker/config"
+)
+
+func TestWithSnapshot(t *testing.T) {
+	old := &Snapshot{Conf: &config.Config{Port: "8001"}}
+	reloaded := &Snapshot{Conf: &config.Config{Port: "8002"}}
+	store := NewSnapshotStore(old)
+
+	var first, second *Snapshot
+	handler := WithSnapshot(store)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first = RequestSnapshot(r)
+		store.Swap(reloaded)
+		second = RequestSnapshot(r)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v2/catalog", nil))
+
+	if first != old || second != old {
+		t.Errorf("expected the request to keep the snapshot it started with\n")
+	}
+	if store.Current() != reloaded {
+		t.Errorf("expected the store to hold the reloaded snapshot\n")
+	}
+}
+
+func TestLoadCatalog(t *testing.T) {
+	catalog, err := loadCatalog(&config.Config{CatalogPath: "../data"})
+	if err != nil {
+		t.Fatalf("loading the catalog failed: %v\n", err)
+	}
+
+	for _, service := range catalog.Services {
+		for _, plan := range service.Plans {
+			for name := range sharedParameterSchemas {
+				for _, schema := range []map[string]interface{}{plan.ProvisionSchema(), plan.UpdateSchema()} {
+					properties, _ := schema["properties"].(map[string]interface{})
+					if plan.AllowsParameter(name) && properties[name] == nil {
+						t.Errorf("plan %s lacks the schema of %s\n", plan.Name, name)
+					}
+				}
+			}
+			if plan.Metadata.Kind == "Storage" && plan.AllowsParameter("access_tier") {
+				t.Errorf("plan %s accepts an access tier, which accounts of kind Storage do not have\n", plan.Name)
+			}
+			if err := validateParameters(&plan, plan.ProvisionSchema(), map[string]interface{}{ac.TAGS_PARAMETER: map[string]interface{}{"project": "apollo"}}); err != nil {
+				t.Errorf("plan %s rejects tags: %v\n", plan.Name, err)
+			}
+			if err := validateParameters(&plan, plan.ProvisionSchema(), map[string]interface{}{ac.NETWORK_RULES_PARAMETER: map[string]interface{}{"default_action": "Deny", "ip_rules": []interface{}{"1.2.3.4"}}}); err != nil {
+				t.Errorf("plan %s rejects network rules: %v\n", plan.Name, err)
+			}
+			if err := validateParameters(&plan, plan.ProvisionSchema(), map[string]interface{}{ac.NETWORK_RULES_PARAMETER: map[string]interface{}{"default_action": "Block"}}); err == nil {
+				t.Errorf("plan %s accepts an unknown network action\n", plan.Name)
+			}
+			if err := validateParameters(&plan, plan.BindSchema(), map[string]interface{}{ac.PRINCIPAL_ID_PARAMETER: "00000000-0000-0000-0000-000000000001"}); err != nil {
+				t.Errorf("plan %s rejects a principal: %v\n", plan.Name, err)
+			}
+			if err := validateParameters(&plan, plan.BindSchema(), map[string]interface{}{ac.PRINCIPAL_ID_PARAMETER: "my-app"}); err == nil {
+				t.Errorf("plan %s accepts a principal which is no object ID\n", plan.Name)
+			}
+		}
+	}
+
+	// bin/bind binds the default plan without a principal
+	_, plan, err := catalog.FindPlan("azure-storage-service-guid", "azure-storage-plan-guid")
+	if err != nil || plan.Metadata.AllowSharedKeyAccess == nil || !*plan.Metadata.AllowSharedKeyAccess {
+		t.Errorf("the default plan does not allow shared key access: %v\n", err)
+	}
+}